@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// completionShells lists the shells supported by --completion.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// flagArgKind describes how the argument of a flag is completed.
+type flagArgKind int
+
+const (
+	argNone flagArgKind = iota
+	argFile
+	argConfigFile
+	argDir
+	argWords
+)
+
+// flagArgs describes the arguments of flags whose values can be completed.
+// Flags that take a value but are not listed here get no completion.
+var flagArgs = map[string]struct {
+	kind  flagArgKind
+	words []string
+}{
+	"file":           {kind: argConfigFile},
+	"toolchain":      {kind: argConfigFile},
+	"profile":        {kind: argConfigFile},
+	"report-file":    {kind: argFile},
+	"log-file":       {kind: argFile},
+	"graph":          {kind: argFile},
+	"sysroot":        {kind: argDir},
+	"destdir":        {kind: argDir},
+	"builddir":       {kind: argDir},
+	"log-dir":        {kind: argDir},
+	"download-cache": {kind: argDir},
+	"arch":           {kind: argWords, words: []string{"x86_64", "aarch64", "arm", "i686"}},
+	"host":           {kind: argWords, words: []string{"x86_64-linux-musl", "aarch64-linux-musl", "arm-linux-musleabi", "armv7-linux-musleabihf", "i686-linux-musl"}},
+	"jobs":           {kind: argWords, words: []string{"auto"}},
+	"make-jobs":      {kind: argWords, words: []string{"auto"}},
+	"prune":          {kind: argWords, words: []string{"stale", "archives", "sources"}},
+	"log-format":     {kind: argWords, words: []string{"text", "json"}},
+	"color":          {kind: argWords, words: []string{"auto", "always", "never"}},
+}
+
+// writeCompletion writes a completion script for shell to w. Flags are
+// taken from the registered pflag set, and package names are completed by
+// running makepkg --list.
+func writeCompletion(w io.Writer, shell string) error {
+	var flags []*pflag.Flag
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		if !f.Hidden {
+			flags = append(flags, f)
+		}
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, flags)
+	case "zsh":
+		writeZshCompletion(w, flags)
+	case "fish":
+		writeFishCompletion(w, flags)
+	default:
+		return fmt.Errorf("unsupported shell %q (expected %s)", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+// takesValue reports whether f consumes the following word as its value.
+func takesValue(f *pflag.Flag) bool {
+	return f.Value.Type() != "bool" && f.NoOptDefVal == ""
+}
+
+// optionalValue reports whether f takes a value that must be attached with
+// "=" because the flag may also be given alone.
+func optionalValue(f *pflag.Flag) bool {
+	return f.Value.Type() != "bool" && f.NoOptDefVal != ""
+}
+
+func flagNames(f *pflag.Flag) []string {
+	names := []string{"--" + f.Name}
+	if f.Shorthand != "" {
+		names = append([]string{"-" + f.Shorthand}, names...)
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer, flags []*pflag.Flag) {
+	var all, files, dirs, values []string
+	words := make(map[string][]string)
+	for _, f := range flags {
+		names := flagNames(f)
+		for _, name := range names {
+			if optionalValue(f) {
+				all = append(all, name+"=")
+			}
+			all = append(all, name)
+		}
+		if !takesValue(f) {
+			continue
+		}
+		switch arg := flagArgs[f.Name]; arg.kind {
+		case argFile, argConfigFile:
+			files = append(files, names...)
+		case argDir:
+			dirs = append(dirs, names...)
+		case argWords:
+			words[strings.Join(names, "|")] = arg.words
+		default:
+			values = append(values, names...)
+		}
+	}
+
+	fmt.Fprintln(w, "# bash completion for makepkg")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_makepkg_packages() {")
+	fmt.Fprintln(w, "    local i file=()")
+	fmt.Fprintln(w, "    for ((i = 1; i < COMP_CWORD; i++)); do")
+	fmt.Fprintln(w, "        case \"${COMP_WORDS[i]}\" in")
+	fmt.Fprintln(w, "            -f|--file) file=(--file \"${COMP_WORDS[i+1]}\") ;;")
+	fmt.Fprintln(w, "        esac")
+	fmt.Fprintln(w, "    done")
+	fmt.Fprintln(w, "    makepkg \"${file[@]}\" --list 2>/dev/null")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_makepkg() {")
+	fmt.Fprintln(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"")
+	fmt.Fprintln(w, "    COMPREPLY=()")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    case \"$prev\" in")
+	if len(files) > 0 {
+		fmt.Fprintf(w, "        %s)\n            COMPREPLY=($(compgen -f -- \"$cur\"))\n            return ;;\n", strings.Join(files, "|"))
+	}
+	if len(dirs) > 0 {
+		fmt.Fprintf(w, "        %s)\n            COMPREPLY=($(compgen -d -- \"$cur\"))\n            return ;;\n", strings.Join(dirs, "|"))
+	}
+	patterns := make([]string, 0, len(words))
+	for pattern := range words {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		fmt.Fprintf(w, "        %s)\n            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n            return ;;\n",
+			pattern, strings.Join(words[pattern], " "))
+	}
+	if len(values) > 0 {
+		fmt.Fprintf(w, "        %s)\n            return ;;\n", strings.Join(values, "|"))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    if [[ \"$cur\" == -* ]]; then")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(all, " "))
+	fmt.Fprintln(w, "        [[ ${COMPREPLY[0]} == *= ]] && compopt -o nospace")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    COMPREPLY=($(compgen -W \"$(_makepkg_packages)\" -- \"$cur\"))")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "complete -F _makepkg makepkg")
+}
+
+func writeZshCompletion(w io.Writer, flags []*pflag.Flag) {
+	fmt.Fprintln(w, "#compdef makepkg")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# Helper function to extract package names from config file")
+	fmt.Fprintln(w, "_makepkg_packages() {")
+	fmt.Fprintln(w, "    local packages file=${opt_args[--file]:-${opt_args[-f]}}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    # Call makepkg --list to get package names, honoring any --file option")
+	fmt.Fprintln(w, "    packages=(${(f)\"$(makepkg ${file:+--file=$file} --list 2>/dev/null)\"})")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    if [[ ${#packages} -gt 0 ]]; then")
+	fmt.Fprintln(w, "        _describe 'package' packages")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "# Main completion function")
+	fmt.Fprintln(w, "_makepkg() {")
+	fmt.Fprintln(w, "    local curcontext=\"$curcontext\" state line")
+	fmt.Fprintln(w, "    typeset -A opt_args")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    _arguments -C \\")
+	for _, f := range flags {
+		varname, usage := pflag.UnquoteUsage(f)
+		desc := zshEscape(usage)
+
+		var action string
+		switch arg := flagArgs[f.Name]; arg.kind {
+		case argConfigFile:
+			action = `_files -g "*.{yaml,yml,toml,json}"`
+		case argFile:
+			action = "_files"
+		case argDir:
+			action = "_directories"
+		case argWords:
+			action = "(" + strings.Join(arg.words, " ") + ")"
+		}
+		label := strings.ToLower(varname)
+		if label == "" {
+			label = f.Name
+		}
+
+		var spec string
+		switch {
+		case optionalValue(f):
+			spec = fmt.Sprintf("'--%s=-[%s]::%s:%s'", f.Name, desc, label, action)
+		case f.Shorthand != "":
+			spec = fmt.Sprintf("'(-%s --%s)'{-%s,--%s}'[%s]", f.Shorthand, f.Name, f.Shorthand, f.Name, desc)
+		default:
+			spec = fmt.Sprintf("'--%s[%s]", f.Name, desc)
+		}
+		if !optionalValue(f) {
+			if takesValue(f) {
+				spec += fmt.Sprintf(":%s:%s", label, action)
+			}
+			spec += "'"
+		}
+		fmt.Fprintf(w, "        %s \\\n", spec)
+	}
+	fmt.Fprintln(w, "        '*::package:_makepkg_packages'")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_makepkg \"$@\"")
+}
+
+// zshEscape escapes s for use inside a single-quoted _arguments description.
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func writeFishCompletion(w io.Writer, flags []*pflag.Flag) {
+	fmt.Fprintln(w, "# fish completion for makepkg")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "function __makepkg_packages")
+	fmt.Fprintln(w, "    set -l tokens (commandline -opc)")
+	fmt.Fprintln(w, "    set -l file")
+	fmt.Fprintln(w, "    for i in (seq (count $tokens))")
+	fmt.Fprintln(w, "        switch $tokens[$i]")
+	fmt.Fprintln(w, "            case -f --file")
+	fmt.Fprintln(w, "                set file --file=$tokens[(math $i + 1)]")
+	fmt.Fprintln(w, "            case '--file=*'")
+	fmt.Fprintln(w, "                set file $tokens[$i]")
+	fmt.Fprintln(w, "        end")
+	fmt.Fprintln(w, "    end")
+	fmt.Fprintln(w, "    makepkg $file --list 2>/dev/null")
+	fmt.Fprintln(w, "end")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "complete -c makepkg -f -a '(__makepkg_packages)'")
+	for _, f := range flags {
+		_, usage := pflag.UnquoteUsage(f)
+		spec := "complete -c makepkg"
+		if f.Shorthand != "" {
+			spec += " -s " + f.Shorthand
+		}
+		spec += " -l " + f.Name
+		spec += " -d " + fishQuote(usage)
+
+		if f.Value.Type() != "bool" {
+			if f.NoOptDefVal == "" {
+				spec += " -r"
+			}
+			switch arg := flagArgs[f.Name]; arg.kind {
+			case argFile, argConfigFile:
+				spec += " -F"
+			case argDir:
+				spec += " -a '(__fish_complete_directories)'"
+			case argWords:
+				spec += " -a " + fishQuote(strings.Join(arg.words, " "))
+			}
+		}
+		fmt.Fprintln(w, spec)
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
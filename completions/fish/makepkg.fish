@@ -0,0 +1,76 @@
+# fish completion for makepkg
+
+function __makepkg_packages
+    set -l tokens (commandline -opc)
+    set -l file
+    for i in (seq (count $tokens))
+        switch $tokens[$i]
+            case -f --file
+                set file --file=$tokens[(math $i + 1)]
+            case '--file=*'
+                set file $tokens[$i]
+        end
+    end
+    makepkg $file --list 2>/dev/null
+end
+
+complete -c makepkg -f -a '(__makepkg_packages)'
+complete -c makepkg -s I -l always-install -d 'Always reinstall packages ignoring cache'
+complete -c makepkg -s B -l always-make -d 'Clean then build packages (force rebuild)'
+complete -c makepkg -s a -l arch -d 'The target ARCH to build for (e.g., x86_64)' -r -a 'x86_64 aarch64 arm i686'
+complete -c makepkg -l artifacts-dir -d 'Keep build artifacts in DIR instead of the artifacts directory of the build directory' -r
+complete -c makepkg -l ascii -d 'Use plain ASCII markers in the build summary'
+complete -c makepkg -l assert-clean -d 'Fail if any package still needs a rebuild or reinstall after building'
+complete -c makepkg -l build-only -d 'Build packages without installing them'
+complete -c makepkg -l build-retries -d 'Retry a failed package build N times from a clean source' -r
+complete -c makepkg -s b -l builddir -d 'The PATH to the directory where packages should be built' -r -a '(__fish_complete_directories)'
+complete -c makepkg -l ccache -d 'Compile C and C++ through ccache, caching objects in the build directory'
+complete -c makepkg -l check -d 'Validate the configuration and toolchain, report every problem and exit'
+complete -c makepkg -l clean -d 'Clean package builds instead of building them'
+complete -c makepkg -l color -d 'Color warnings, errors and the build summary WHEN auto, always or never' -r -a 'auto always never'
+complete -c makepkg -l continue -d 'Skip packages that succeeded in the previous build and retry the rest'
+complete -c makepkg -l delete-archives -d 'Remove downloaded archives once they have been extracted'
+complete -c makepkg -l destdir -d 'Install packages into PATH instead of the sysroot they are built against' -r -a '(__fish_complete_directories)'
+complete -c makepkg -l discard-source -d 'Remove package sources and archives after a successful build and install'
+complete -c makepkg -l download-cache -d 'Share downloaded archives across build directories in DIR' -a '(__fish_complete_directories)'
+complete -c makepkg -l download-retries -d 'The number of attempts N for each download' -r
+complete -c makepkg -l download-timeout -d 'The timeout DURATION for each download attempt' -r
+complete -c makepkg -s n -l dry-run -d 'Print what would be done without actually building'
+complete -c makepkg -l exclude -d 'Leave PACKAGE and the packages that depend on it out of the build (repeatable)' -r
+complete -c makepkg -s F -l fail-fast -d 'Stop building immediately on first error'
+complete -c makepkg -s f -l file -d 'Read FILE (or an http(s) URL) as the package configuration file' -r -F
+complete -c makepkg -l graph -d 'Write the dependency graph in Graphviz DOT format to FILE (default stdout) and exit' -F
+complete -c makepkg -l graph-levels -d 'Rank packages in the same build level together in --graph output'
+complete -c makepkg -s h -l host -d 'The target HOST to build for (e.g., x86_64-linux-musl)' -r -a 'x86_64-linux-musl aarch64-linux-musl arm-linux-musleabi armv7-linux-musleabihf i686-linux-musl'
+complete -c makepkg -l inherit-env -d 'Pass the host variable VAR through to package scripts (repeatable)' -r
+complete -c makepkg -l install-only -d 'Install the previous builds of packages without building them'
+complete -c makepkg -s j -l jobs -d 'The maximum concurrency N for building packages, or auto for one per CPU' -r -a 'auto'
+complete -c makepkg -l keep-archives -d 'Keep downloaded archives after extracting them (default)'
+complete -c makepkg -l keep-source -d 'Keep package sources after a successful build and install (default)'
+complete -c makepkg -l list -d 'List all package names from the configuration'
+complete -c makepkg -l list-artifacts -d 'List the artifacts PACKAGE wrote to its artifacts directory and exit' -r
+complete -c makepkg -l log-dir -d 'Write package script logs under PATH instead of the build directory' -r -a '(__fish_complete_directories)'
+complete -c makepkg -l log-file -d 'Also append makepkg\'s own messages, timestamped, to FILE' -r -F
+complete -c makepkg -l log-format -d 'Write makepkg\'s own messages to the terminal in FORMAT text or json' -r -a 'text json'
+complete -c makepkg -s m -l make-jobs -d 'The number of jobs N for each make invocation, or auto for one per CPU' -r -a 'auto'
+complete -c makepkg -l offline -d 'Fail packages whose sources are not already downloaded instead of fetching them'
+complete -c makepkg -l only -d 'Build only the named packages, not their dependencies'
+complete -c makepkg -l print-env -d 'Print the environment the scripts of PACKAGE run in and exit' -r
+complete -c makepkg -l profile -d 'Read FILE as a build profile selecting packages and overrides' -r -F
+complete -c makepkg -l prune -d 'Remove build directories of packages no longer in the configuration; MODE archives or sources also prunes the remaining packages' -a 'stale archives sources'
+complete -c makepkg -s q -l quiet -d 'Do not log build output, only info and summary'
+complete -c makepkg -l report-file -d 'Write a JSON report of the build results to FILE' -r -F
+complete -c makepkg -l required-by -d 'List the packages that depend on PACKAGE, directly or transitively, in build order and exit' -r
+complete -c makepkg -l set -d 'Override a package field with PKG.FIELD=VALUE, or append with PKG.FIELD+=VALUE (repeatable)' -r
+complete -c makepkg -l source-date-epoch -d 'Build every package with SOURCE_DATE_EPOCH set to SECONDS instead of the date of its source' -r
+complete -c makepkg -l stream-downloads -d 'Extract tar archives while downloading them instead of saving them first'
+complete -c makepkg -l strict -d 'Fail packages on suspicious conditions such as undefined variables or failed cache writes instead of warning'
+complete -c makepkg -s s -l sysroot -d 'The PATH to use as the sysroot when installing and building' -r -a '(__fish_complete_directories)'
+complete -c makepkg -l sysroot-template -d 'Copy the template DIR into the sysroot before building, or create standard directories if no DIR is given'
+complete -c makepkg -s t -l toolchain -d 'Read FILE as the toolchain configuration file' -r -F
+complete -c makepkg -l toolchain-name -d 'Select the toolchain NAME from the toolchains defined in the toolchain file' -r
+complete -c makepkg -l track-source -d 'Rebuild packages whose source directory was modified since the last build'
+complete -c makepkg -s v -l verbose -d 'Enable verbose debug logging'
+complete -c makepkg -s V -l version -d 'Show version information'
+complete -c makepkg -l why -d 'Explain whether and why PACKAGE would be rebuilt or reinstalled and exit' -r
+complete -c makepkg -s y -l yes -d 'Install to / without asking when no sysroot is given'
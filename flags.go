@@ -2,55 +2,160 @@ package main
 
 import (
 	"fmt"
+	"github.com/aar10n/makepkg/pkg/build"
 	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/download"
+	"github.com/aar10n/makepkg/pkg/logger"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 )
 
 // flags holds all command-line flag values
 type flags struct {
-	configFile    string
-	toolchainFile string
-	sysroot       string
-	builddir      string
-	arch          string
-	host          string
-	jobs          int
-	makeJobs      int
-	quiet         bool
-	failFast      bool
-	dryRun        bool
-	verbose       bool
-	list          bool
-	clean         bool
-	alwaysMake    bool
-	alwaysInstall bool
-	showVersion   bool
+	configFile      string
+	toolchainFile   string
+	toolchainName   string
+	profileFile     string
+	sysroot         string
+	destdir         string
+	sysrootTemplate string
+	sourceDateEpoch string
+	builddir        string
+	artifactsDir    string
+	arch            string
+	host            string
+	jobs            int
+	makeJobs        int
+	quiet           bool
+	failFast        bool
+	dryRun          bool
+	verbose         bool
+	list            bool
+	check           bool
+	printEnv        string
+	requiredBy      string
+	listArtifacts   string
+	why             string
+	clean           bool
+	alwaysMake      bool
+	alwaysInstall   bool
+	buildOnly       bool
+	installOnly     bool
+	only            bool
+	exclude         []string
+	overrides       []string
+	inheritEnv      []string
+	keepSource      bool
+	discardSource   bool
+	trackSource     bool
+	continueBuild   bool
+	ccache          bool
+	strict          bool
+	offline         bool
+	ascii           bool
+	assertClean     bool
+	assumeYes       bool
+	prune           string
+	graph           string
+	graphLevels     bool
+	completion      string
+	reportFile      string
+	logDir          string
+	logFile         string
+	logFormat       string
+	color           string
+	downloadCache   string
+	streamDownloads bool
+	keepArchives    bool
+	deleteArchives  bool
+	downloadRetries int
+	buildRetries    int
+	downloadTimeout time.Duration
+	showVersion     bool
 }
 
 func parseFlags() *flags {
 	f := &flags{}
 
-	pflag.StringVarP(&f.configFile, "file", "f", "", "Read `FILE` as the package configuration file")
+	pflag.StringVarP(&f.configFile, "file", "f", "", "Read `FILE` (or an http(s) URL) as the package configuration file")
 	pflag.StringVarP(&f.toolchainFile, "toolchain", "t", "", "Read `FILE` as the toolchain configuration file")
+	pflag.StringVar(&f.toolchainName, "toolchain-name", "", "Select the toolchain `NAME` from the toolchains defined in the toolchain file")
+	pflag.StringVar(&f.profileFile, "profile", "", "Read `FILE` as a build profile selecting packages and overrides")
+	pflag.StringArrayVar(&f.overrides, "set", nil, "Override a package field with `PKG.FIELD=VALUE`, or append with PKG.FIELD+=VALUE (repeatable)")
 	pflag.StringVarP(&f.sysroot, "sysroot", "s", "", "The `PATH` to use as the sysroot when installing and building")
+	pflag.StringVar(&f.destdir, "destdir", "", "Install packages into `PATH` instead of the sysroot they are built against")
+	pflag.StringVar(&f.sysrootTemplate, "sysroot-template", "", "Copy the template `DIR` into the sysroot before building, or create standard directories if no DIR is given")
+	pflag.Lookup("sysroot-template").NoOptDefVal = build.FHSTemplate
 	pflag.StringVarP(&f.builddir, "builddir", "b", "build", "The `PATH` to the directory where packages should be built")
+	pflag.StringVar(&f.artifactsDir, "artifacts-dir", "", "Keep build artifacts in `DIR` instead of the artifacts directory of the build directory")
 	pflag.StringVarP(&f.arch, "arch", "a", "", "The target `ARCH` to build for (e.g., x86_64)")
 	pflag.StringVarP(&f.host, "host", "h", "", "The target `HOST` to build for (e.g., x86_64-linux-musl)")
-	pflag.IntVarP(&f.jobs, "jobs", "j", 1, "The maximum concurrency `N` for building packages")
-	pflag.IntVarP(&f.makeJobs, "make-jobs", "m", 1, "The number of jobs `N` for each make invocation")
+	f.jobs, f.makeJobs = 1, 1
+	pflag.VarP((*jobsValue)(&f.jobs), "jobs", "j", "The maximum concurrency `N` for building packages, or auto for one per CPU")
+	pflag.VarP((*jobsValue)(&f.makeJobs), "make-jobs", "m", "The number of jobs `N` for each make invocation, or auto for one per CPU")
 	pflag.BoolVarP(&f.quiet, "quiet", "q", false, "Do not log build output, only info and summary")
 	pflag.BoolVarP(&f.failFast, "fail-fast", "F", false, "Stop building immediately on first error")
 	pflag.BoolVarP(&f.dryRun, "dry-run", "n", false, "Print what would be done without actually building")
 	pflag.BoolVarP(&f.verbose, "verbose", "v", false, "Enable verbose debug logging")
 	pflag.BoolVar(&f.list, "list", false, "List all package names from the configuration")
+	pflag.StringVar(&f.graph, "graph", "", "Write the dependency graph in Graphviz DOT format to `FILE` (default stdout) and exit")
+	pflag.Lookup("graph").NoOptDefVal = "-"
+	pflag.StringVar(&f.requiredBy, "required-by", "", "List the packages that depend on `PACKAGE`, directly or transitively, in build order and exit")
+	pflag.StringVar(&f.listArtifacts, "list-artifacts", "", "List the artifacts `PACKAGE` wrote to its artifacts directory and exit")
+	pflag.BoolVar(&f.graphLevels, "graph-levels", false, "Rank packages in the same build level together in --graph output")
+	pflag.StringVar(&f.prune, "prune", "", "Remove build directories of packages no longer in the configuration; `MODE` archives or sources also prunes the remaining packages")
+	pflag.Lookup("prune").NoOptDefVal = string(build.PruneStale)
+	pflag.BoolVar(&f.check, "check", false, "Validate the configuration and toolchain, report every problem and exit")
+	pflag.StringVar(&f.why, "why", "", "Explain whether and why `PACKAGE` would be rebuilt or reinstalled and exit")
+	pflag.StringVar(&f.printEnv, "print-env", "", "Print the environment the scripts of `PACKAGE` run in and exit")
 	pflag.BoolVar(&f.clean, "clean", false, "Clean package builds instead of building them")
 	pflag.BoolVarP(&f.alwaysMake, "always-make", "B", false, "Clean then build packages (force rebuild)")
 	pflag.BoolVarP(&f.alwaysInstall, "always-install", "I", false, "Always reinstall packages ignoring cache")
+	pflag.BoolVar(&f.buildOnly, "build-only", false, "Build packages without installing them")
+	pflag.BoolVar(&f.installOnly, "install-only", false, "Install the previous builds of packages without building them")
+	pflag.BoolVar(&f.only, "only", false, "Build only the named packages, not their dependencies")
+	pflag.StringSliceVar(&f.exclude, "exclude", nil, "Leave `PACKAGE` and the packages that depend on it out of the build (repeatable)")
+	pflag.StringSliceVar(&f.inheritEnv, "inherit-env", nil, "Pass the host variable `VAR` through to package scripts (repeatable)")
+	pflag.BoolVar(&f.keepSource, "keep-source", true, "Keep package sources after a successful build and install (default)")
+	pflag.BoolVar(&f.discardSource, "discard-source", false, "Remove package sources and archives after a successful build and install")
+	pflag.BoolVar(&f.trackSource, "track-source", false, "Rebuild packages whose source directory was modified since the last build")
+	pflag.BoolVar(&f.ccache, "ccache", false, "Compile C and C++ through ccache, caching objects in the build directory")
+	pflag.StringVar(&f.sourceDateEpoch, "source-date-epoch", "", "Build every package with SOURCE_DATE_EPOCH set to `SECONDS` instead of the date of its source")
+	pflag.BoolVar(&f.strict, "strict", false, "Fail packages on suspicious conditions such as undefined variables or failed cache writes instead of warning")
+	pflag.BoolVar(&f.strict, "warnings-as-errors", false, "Same as --strict")
+	pflag.CommandLine.MarkHidden("warnings-as-errors")
+	pflag.BoolVar(&f.continueBuild, "continue", false, "Skip packages that succeeded in the previous build and retry the rest")
+	pflag.StringVar(&f.logDir, "log-dir", "", "Write package script logs under `PATH` instead of the build directory")
+	pflag.StringVar(&f.logFile, "log-file", "", "Also append makepkg's own messages, timestamped, to `FILE`")
+	pflag.StringVar(&f.logFormat, "log-format", string(logger.FormatText), "Write makepkg's own messages to the terminal in `FORMAT` text or json")
+	pflag.StringVar(&f.reportFile, "report-file", "", "Write a JSON report of the build results to `FILE`")
+	pflag.BoolVarP(&f.assumeYes, "yes", "y", false, "Install to / without asking when no sysroot is given")
+	pflag.BoolVar(&f.assumeYes, "assume-yes", false, "Same as --yes")
+	pflag.CommandLine.MarkHidden("assume-yes")
+	pflag.BoolVar(&f.assertClean, "assert-clean", false, "Fail if any package still needs a rebuild or reinstall after building")
+	pflag.BoolVar(&f.ascii, "ascii", false, "Use plain ASCII markers in the build summary")
+	pflag.StringVar(&f.color, "color", string(logger.ColorAuto), "Color warnings, errors and the build summary `WHEN` auto, always or never")
+	pflag.StringVar(&f.downloadCache, "download-cache", "", "Share downloaded archives across build directories in `DIR`")
+	pflag.Lookup("download-cache").NoOptDefVal = download.DefaultCacheDir()
+	pflag.BoolVar(&f.offline, "offline", false, "Fail packages whose sources are not already downloaded instead of fetching them")
+	pflag.BoolVar(&f.offline, "no-network", false, "Same as --offline")
+	pflag.CommandLine.MarkHidden("no-network")
+	pflag.BoolVar(&f.streamDownloads, "stream-downloads", false, "Extract tar archives while downloading them instead of saving them first")
+	pflag.BoolVar(&f.keepArchives, "keep-archives", true, "Keep downloaded archives after extracting them (default)")
+	pflag.BoolVar(&f.deleteArchives, "delete-archives", false, "Remove downloaded archives once they have been extracted")
+	pflag.IntVar(&f.downloadRetries, "download-retries", 3, "The number of attempts `N` for each download")
+	pflag.IntVar(&f.buildRetries, "build-retries", 0, "Retry a failed package build `N` times from a clean source")
+	pflag.DurationVar(&f.downloadTimeout, "download-timeout", 5*time.Minute, "The timeout `DURATION` for each download attempt")
 	pflag.BoolVarP(&f.showVersion, "version", "V", false, "Show version information")
+	pflag.StringVar(&f.completion, "completion", "", "Write a completion script for `SHELL` (bash, zsh or fish) and exit")
+	pflag.CommandLine.MarkHidden("completion")
 
 	pflag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [package...]\n\n", os.Args[0])
@@ -66,6 +171,133 @@ func parseFlags() *flags {
 	return f
 }
 
+// jobsValue is an int flag that also accepts "auto" (or 0) to mean the
+// number of CPUs.
+type jobsValue int
+
+func (j *jobsValue) String() string {
+	return strconv.Itoa(int(*j))
+}
+
+func (j *jobsValue) Set(s string) error {
+	if s == "auto" {
+		*j = jobsValue(runtime.NumCPU())
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a non-negative number or auto")
+	}
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	*j = jobsValue(n)
+	return nil
+}
+
+func (j *jobsValue) Type() string {
+	return "int"
+}
+
+// validate checks for conflicting or invalid flag combinations.
+func (f *flags) validate() error {
+	if pflag.CommandLine.Changed("keep-source") {
+		if f.keepSource && f.discardSource {
+			return fmt.Errorf("--keep-source and --discard-source are mutually exclusive")
+		}
+		if !f.keepSource {
+			f.discardSource = true
+		}
+	}
+	if pflag.CommandLine.Changed("keep-archives") {
+		if f.keepArchives && f.deleteArchives {
+			return fmt.Errorf("--keep-archives and --delete-archives are mutually exclusive")
+		}
+		if !f.keepArchives {
+			f.deleteArchives = true
+		}
+	}
+	if f.only && pflag.NArg() == 0 {
+		return fmt.Errorf("--only requires at least one package name")
+	}
+	if f.buildRetries < 0 {
+		return fmt.Errorf("--build-retries must not be negative")
+	}
+	if f.downloadRetries < 1 {
+		return fmt.Errorf("--download-retries must be at least 1")
+	}
+	if f.downloadTimeout <= 0 {
+		return fmt.Errorf("--download-timeout must be positive")
+	}
+	if f.prune != "" {
+		if !slices.Contains(build.PruneModes, build.PruneMode(f.prune)) {
+			return fmt.Errorf("invalid --prune mode %q (expected stale, archives or sources)", f.prune)
+		}
+		if f.clean || f.alwaysMake || pflag.NArg() > 0 {
+			return fmt.Errorf("--prune cannot be combined with --clean, --always-make or package names")
+		}
+	}
+	if f.logFormat != string(logger.FormatText) && f.logFormat != string(logger.FormatJSON) {
+		return fmt.Errorf("invalid --log-format %q (expected text or json)", f.logFormat)
+	}
+	switch logger.ColorMode(f.color) {
+	case logger.ColorAuto, logger.ColorAlways, logger.ColorNever:
+	default:
+		return fmt.Errorf("invalid --color %q (expected auto, always or never)", f.color)
+	}
+	if f.printEnv != "" && pflag.NArg() > 0 {
+		return fmt.Errorf("--print-env cannot be combined with package names")
+	}
+	if f.requiredBy != "" && pflag.NArg() > 0 {
+		return fmt.Errorf("--required-by cannot be combined with package names")
+	}
+	if f.sysrootTemplate != "" && f.sysrootTemplate != build.FHSTemplate {
+		if info, err := os.Stat(f.sysrootTemplate); err != nil || !info.IsDir() {
+			return fmt.Errorf("--sysroot-template %s is not a directory", f.sysrootTemplate)
+		}
+	}
+	if f.artifactsDir != "" {
+		if info, err := os.Stat(f.artifactsDir); err == nil && !info.IsDir() {
+			return fmt.Errorf("--artifacts-dir %s is not a directory", f.artifactsDir)
+		} else if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("--artifacts-dir %s: %w", f.artifactsDir, err)
+		}
+	}
+	if f.sourceDateEpoch != "" {
+		if seconds, err := strconv.ParseInt(f.sourceDateEpoch, 10, 64); err != nil || seconds < 0 {
+			return fmt.Errorf("invalid --source-date-epoch %q (expected seconds since the epoch)", f.sourceDateEpoch)
+		}
+	}
+	if f.offline && config.IsRemote(f.configFile) {
+		return fmt.Errorf("--offline cannot be combined with a remote configuration file")
+	}
+	if f.listArtifacts != "" && pflag.NArg() > 0 {
+		return fmt.Errorf("--list-artifacts cannot be combined with package names")
+	}
+	if f.why != "" && pflag.NArg() > 0 {
+		return fmt.Errorf("--why cannot be combined with package names")
+	}
+	if f.graphLevels && f.graph == "" {
+		return fmt.Errorf("--graph-levels requires --graph")
+	}
+	if f.buildOnly && f.installOnly {
+		return fmt.Errorf("--build-only and --install-only are mutually exclusive")
+	}
+	if f.buildOnly && (f.alwaysInstall || f.discardSource) {
+		return fmt.Errorf("--build-only cannot be combined with --always-install or --discard-source")
+	}
+	if f.installOnly && (f.clean || f.alwaysMake) {
+		return fmt.Errorf("--install-only cannot be combined with --clean or --always-make")
+	}
+	if f.continueBuild && (f.clean || f.alwaysMake) {
+		return fmt.Errorf("--continue cannot be combined with --clean or --always-make")
+	}
+	if f.assertClean && f.dryRun {
+		return fmt.Errorf("--assert-clean cannot be used with --dry-run")
+	}
+	return nil
+}
+
 func (f *flags) MakepkgCommand(cfg *config.Config) (string, error) {
 	// Get the absolute path to the makepkg executable
 	exePath, err := os.Executable()
@@ -82,15 +314,33 @@ func (f *flags) MakepkgCommand(cfg *config.Config) (string, error) {
 
 	parts = append(parts, fmt.Sprintf("--file=%s", cfg.FilePath))
 	parts = append(parts, fmt.Sprintf("--toolchain=%s", cfg.Toolchain.FilePath))
+	if f.toolchainName != "" {
+		parts = append(parts, fmt.Sprintf("--toolchain-name=%s", f.toolchainName))
+	}
+
+	if f.profileFile != "" {
+		parts = append(parts, fmt.Sprintf("--profile=%s", f.profileFile))
+	}
 
 	if f.sysroot != "" {
 		parts = append(parts, fmt.Sprintf("--sysroot=%s", f.sysroot))
+	} else {
+		// Installing to / was already confirmed by the outer invocation
+		parts = append(parts, "--yes")
+	}
+
+	if f.destdir != "" {
+		parts = append(parts, fmt.Sprintf("--destdir=%s", f.destdir))
 	}
 
 	if f.builddir != "" {
 		parts = append(parts, fmt.Sprintf("--builddir=%s", f.builddir))
 	}
 
+	if f.artifactsDir != "" {
+		parts = append(parts, fmt.Sprintf("--artifacts-dir=%s", f.artifactsDir))
+	}
+
 	if f.arch != "" {
 		parts = append(parts, fmt.Sprintf("--arch=%s", f.arch))
 	}
@@ -119,11 +369,92 @@ func (f *flags) MakepkgCommand(cfg *config.Config) (string, error) {
 		parts = append(parts, "--verbose")
 	}
 
+	if f.discardSource {
+		parts = append(parts, "--discard-source")
+	}
+
+	if len(f.inheritEnv) > 0 {
+		parts = append(parts, fmt.Sprintf("--inherit-env=%s", strings.Join(f.inheritEnv, ",")))
+	}
+
+	if f.trackSource {
+		parts = append(parts, "--track-source")
+	}
+
+	if f.ccache {
+		parts = append(parts, "--ccache")
+	}
+
+	if f.strict {
+		parts = append(parts, "--strict")
+	}
+
+	if f.sourceDateEpoch != "" {
+		parts = append(parts, fmt.Sprintf("--source-date-epoch=%s", f.sourceDateEpoch))
+	}
+
+	if f.logDir != "" {
+		parts = append(parts, fmt.Sprintf("--log-dir=%s", f.logDir))
+	}
+
+	if f.logFile != "" {
+		parts = append(parts, fmt.Sprintf("--log-file=%s", f.logFile))
+	}
+
+	if pflag.CommandLine.Changed("log-format") {
+		parts = append(parts, fmt.Sprintf("--log-format=%s", f.logFormat))
+	}
+
+	if pflag.CommandLine.Changed("color") {
+		parts = append(parts, fmt.Sprintf("--color=%s", f.color))
+	}
+
+	if f.downloadCache != "" {
+		parts = append(parts, fmt.Sprintf("--download-cache=%s", f.downloadCache))
+	}
+
+	if f.streamDownloads {
+		parts = append(parts, "--stream-downloads")
+	}
+
+	if f.offline {
+		parts = append(parts, "--offline")
+	}
+
+	if f.deleteArchives {
+		parts = append(parts, "--delete-archives")
+	}
+
+	if pflag.CommandLine.Changed("download-retries") {
+		parts = append(parts, fmt.Sprintf("--download-retries=%d", f.downloadRetries))
+	}
+
+	if f.buildRetries > 0 {
+		parts = append(parts, fmt.Sprintf("--build-retries=%d", f.buildRetries))
+	}
+
+	if pflag.CommandLine.Changed("download-timeout") {
+		parts = append(parts, fmt.Sprintf("--download-timeout=%s", f.downloadTimeout))
+	}
+
 	// Note: We intentionally exclude:
 	//   package targets
 	//   --dry-run
 	//   --always-make
 	//   --always-install
+	//   --only
+	//   --exclude
+	//   --set (passed through MAKEPKG_OVERRIDES, since values may contain spaces)
+	//   --report-file
 	//   --clean
+	//   --prune
+	//   --graph
+	//   --required-by
+	//   --list-artifacts
+	//   --sysroot-template (the parent has already initialized the sysroot)
+	//   --check
+	//   --print-env
+	//   --why
+	//   --completion
 	return strings.Join(parts, " "), nil
 }
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -14,7 +16,9 @@ import (
 
 	"github.com/aar10n/makepkg/pkg/build"
 	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/download"
 	"github.com/aar10n/makepkg/pkg/logger"
+	"github.com/aar10n/makepkg/pkg/term"
 )
 
 var (
@@ -26,6 +30,31 @@ var (
 
 func main() {
 	f := parseFlags()
+	if err := f.validate(); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	logger.SetFormat(logger.Format(f.logFormat))
+	logger.SetColorMode(logger.ColorMode(f.color))
+
+	if f.logFile != "" {
+		// Nested invocations through $MAKEPKG run elsewhere and append to the same file
+		if absPath, err := filepath.Abs(f.logFile); err == nil {
+			f.logFile = absPath
+		}
+		if err := logger.SetLogFile(f.logFile); err != nil {
+			logger.Errorf("opening log file: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if f.completion != "" {
+		if err := writeCompletion(os.Stdout, f.completion); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	if f.showVersion {
 		fmt.Printf("makepkg %s\n", version)
@@ -41,7 +70,39 @@ func main() {
 	configPath := f.configFile
 	packageFilter := pflag.Args()
 
-	if configPath != "" {
+	// Invocations nested through $MAKEPKG apply their parent's overrides
+	// before their own
+	if value := os.Getenv(config.OverridesEnvVar); value != "" {
+		overrides, err := config.DecodeOverrides(value)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		f.overrides = append(overrides, f.overrides...)
+	}
+
+	var profile *config.Profile
+	if f.profileFile != "" {
+		var err error
+		profile, err = config.LoadProfile(f.profileFile)
+		if err != nil {
+			logger.Errorf("loading profile: %v", err)
+			os.Exit(1)
+		}
+		f.profileFile = profile.FilePath
+
+		if configPath == "" {
+			configPath = profile.Config
+		}
+		if f.sysroot == "" {
+			f.sysroot = profile.Sysroot
+		}
+		if len(packageFilter) == 0 {
+			packageFilter = profile.Packages
+		}
+	}
+
+	if configPath != "" && !config.IsRemote(configPath) {
 		if _, err := os.Stat(configPath); os.IsNotExist(err) {
 			logger.Errorf("configuration file %s not found", configPath)
 			os.Exit(1)
@@ -68,6 +129,33 @@ func main() {
 		sysrootPath = absPath
 	}
 
+	if f.destdir != "" && !filepath.IsAbs(f.destdir) {
+		absPath, err := filepath.Abs(f.destdir)
+		if err != nil {
+			logger.Errorf("resolving destdir: %v", err)
+			os.Exit(1)
+		}
+		f.destdir = absPath
+	}
+
+	if f.artifactsDir != "" && !filepath.IsAbs(f.artifactsDir) {
+		absPath, err := filepath.Abs(f.artifactsDir)
+		if err != nil {
+			logger.Errorf("resolving artifacts directory: %v", err)
+			os.Exit(1)
+		}
+		f.artifactsDir = absPath
+	}
+
+	if f.sysrootTemplate != "" && f.sysrootTemplate != build.FHSTemplate {
+		absPath, err := filepath.Abs(f.sysrootTemplate)
+		if err != nil {
+			logger.Errorf("resolving sysroot template: %v", err)
+			os.Exit(1)
+		}
+		f.sysrootTemplate = absPath
+	}
+
 	if err := os.MkdirAll(buildDir, 0755); err != nil {
 		logger.Errorf("creating build directory: %v", err)
 		os.Exit(1)
@@ -76,14 +164,28 @@ func main() {
 	f.builddir = buildDir
 	f.sysroot = sysrootPath
 
+	if config.IsRemote(configPath) {
+		dlCfg := download.DownloaderConfig{Retries: f.downloadRetries, Timeout: f.downloadTimeout}
+		localPath, err := config.FetchRemoteConfig(context.Background(), configPath, buildDir, dlCfg)
+		if err != nil {
+			logger.Errorf("loading configuration: %v", err)
+			os.Exit(1)
+		}
+		configPath = localPath
+	}
+
 	logger.SetVerbose(f.verbose)
+	if f.check {
+		os.Exit(runCheck(f, configPath, profile))
+	}
+
 	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		logger.Errorf("loading configuration: %v", err)
 		os.Exit(1)
 	}
 
-	toolchainCfg, _, err := config.LoadToolchainConfig(f.toolchainFile)
+	toolchainCfg, _, err := config.LoadToolchainConfig(f.toolchainFile, f.toolchainName)
 	if err != nil {
 		logger.Errorf("loading toolchain configuration: %v", err)
 		os.Exit(1)
@@ -93,6 +195,20 @@ func main() {
 		cfg.Toolchain = config.MergeToolchainConfig(&cfg.Toolchain, toolchainCfg)
 	}
 
+	if profile != nil {
+		if err := profile.Apply(cfg); err != nil {
+			logger.Errorf("applying profile: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(f.overrides) > 0 {
+		if err := applyOverrides(cfg, f.overrides); err != nil {
+			logger.Errorf("applying --set: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	if f.list {
 		for _, pkg := range cfg.Packages {
 			fmt.Println(pkg.Name)
@@ -100,21 +216,64 @@ func main() {
 		os.Exit(0)
 	}
 
-	if f.sysroot == "" {
-		logger.Warn("No sysroot specified. Packages will be installed to system root (/).")
-		fmt.Print("This may modify your system. Continue? [y/N]: ")
+	if f.graph != "" {
+		if err := writeGraph(cfg, f.graph, f.graphLevels); err != nil {
+			logger.Errorf("writing dependency graph: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-		reader := bufio.NewReader(os.Stdin)
-		response, err := reader.ReadString('\n')
+	if f.requiredBy != "" {
+		dependents, err := build.RequiredBy(cfg, f.requiredBy)
 		if err != nil {
-			logger.Errorf("reading input: %v", err)
+			logger.Errorf("%v", err)
 			os.Exit(1)
 		}
+		for _, name := range dependents {
+			fmt.Println(name)
+		}
+		os.Exit(0)
+	}
 
-		response = strings.TrimSpace(strings.ToLower(response))
-		if response != "y" && response != "yes" {
-			logger.Info("Aborted.")
-			os.Exit(0)
+	if f.listArtifacts != "" {
+		if cfg.GetPackageByName(f.listArtifacts) == nil {
+			logger.Errorf("package '%s' not found in configuration", f.listArtifacts)
+			os.Exit(1)
+		}
+		artifacts, err := build.Artifacts(cmp.Or(f.artifactsDir, build.DefaultArtifactsDir(f.builddir)), f.listArtifacts)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		for _, artifact := range artifacts {
+			fmt.Println(artifact.Path)
+		}
+		os.Exit(0)
+	}
+
+	if f.sysroot == "" && f.destdir == "" && f.prune == "" && f.printEnv == "" && f.why == "" {
+		logger.Warn("No sysroot specified. Packages will be installed to system root (/).")
+		if !f.assumeYes {
+			// Nobody can answer the prompt without a terminal
+			if !term.IsTerminal(os.Stdin) {
+				logger.Errorf("refusing to install to / without a terminal to confirm (pass --yes or --sysroot)")
+				os.Exit(1)
+			}
+			fmt.Print("This may modify your system. Continue? [y/N]: ")
+
+			reader := bufio.NewReader(os.Stdin)
+			response, err := reader.ReadString('\n')
+			if err != nil {
+				logger.Errorf("reading input: %v", err)
+				os.Exit(1)
+			}
+
+			response = strings.TrimSpace(strings.ToLower(response))
+			if response != "y" && response != "yes" {
+				logger.Info("Aborted.")
+				os.Exit(0)
+			}
 		}
 	}
 
@@ -122,26 +281,52 @@ func main() {
 	if archValue == "" && cfg.Toolchain.Arch != "" {
 		archValue = cfg.Toolchain.Arch
 	}
+	cfg.Toolchain.Arch = archValue
 	hostValue := f.host
 	if hostValue == "" && cfg.Toolchain.Host != "" {
 		hostValue = cfg.Toolchain.Host
 	}
 
+	if f.printEnv != "" {
+		os.Exit(runPrintEnv(f, cfg, hostValue))
+	}
+	if f.why != "" {
+		os.Exit(runWhy(f, cfg, hostValue))
+	}
+
 	if len(packageFilter) > 0 {
 		for _, pkgName := range packageFilter {
-			if cfg.GetPackageByName(pkgName) == nil {
+			pkg := cfg.GetPackageByName(pkgName)
+			if pkg == nil {
 				logger.Errorf("package '%s' not found in configuration", pkgName)
 				os.Exit(1)
 			}
+			if !pkg.IsEnabled() {
+				logger.Errorf("package '%s' is disabled", pkgName)
+				os.Exit(1)
+			}
 		}
 		logger.Info("Loaded %d packages from %s (filtered to %d)", len(cfg.Packages), cfg.FilePath, len(packageFilter))
 	} else {
 		logger.Info("Loaded %d packages from %s", len(cfg.Packages), cfg.FilePath)
 	}
+	for _, pkgName := range f.exclude {
+		if cfg.GetPackageByName(pkgName) == nil {
+			logger.Errorf("package '%s' not found in configuration", pkgName)
+			os.Exit(1)
+		}
+	}
 	if sysrootPath != "" {
 		logger.Info("Using sysroot: %s", sysrootPath)
 	}
+	if f.destdir != "" {
+		logger.Info("Installing to: %s", f.destdir)
+	}
 	logger.Info("Concurrency: %d", f.jobs)
+	if cpus := runtime.NumCPU(); f.jobs*f.makeJobs > 2*cpus {
+		logger.Warn("--jobs=%d with --make-jobs=%d may run up to %d jobs at once on %d CPUs",
+			f.jobs, f.makeJobs, f.jobs*f.makeJobs, cpus)
+	}
 	logger.Info("")
 
 	makepkgCmd, err := f.MakepkgCommand(cfg)
@@ -151,13 +336,37 @@ func main() {
 	}
 
 	builderCfg := build.BuilderConfig{
-		Quiet:          f.quiet,
-		Verbose:        f.verbose,
-		FailFast:       f.failFast,
-		DryRun:         f.dryRun,
-		AlwaysInstall:  f.alwaysInstall,
-		MaxConcurrency: f.jobs,
-		MakeJobs:       f.makeJobs,
+		Quiet:           f.quiet,
+		Verbose:         f.verbose,
+		FailFast:        f.failFast,
+		DryRun:          f.dryRun,
+		AlwaysInstall:   f.alwaysInstall,
+		BuildOnly:       f.buildOnly,
+		InstallOnly:     f.installOnly,
+		Only:            f.only,
+		Exclude:         f.exclude,
+		Overrides:       f.overrides,
+		InheritEnv:      f.inheritEnv,
+		DiscardSource:   f.discardSource,
+		TrackSource:     f.trackSource,
+		CCache:          f.ccache,
+		Strict:          f.strict,
+		Offline:         f.offline,
+		Continue:        f.continueBuild,
+		ASCII:           f.ascii,
+		LogDir:          f.logDir,
+		DestDir:         f.destdir,
+		ArtifactsDir:    f.artifactsDir,
+		SysrootTemplate: f.sysrootTemplate,
+		SourceDateEpoch: f.sourceDateEpoch,
+		DownloadCache:   f.downloadCache,
+		StreamDownloads: f.streamDownloads,
+		DeleteArchives:  f.deleteArchives,
+		DownloadRetries: f.downloadRetries,
+		BuildRetries:    f.buildRetries,
+		DownloadTimeout: f.downloadTimeout,
+		MaxConcurrency:  f.jobs,
+		MakeJobs:        f.makeJobs,
 	}
 
 	builder, err := build.NewBuilder(builderCfg, cfg, buildDir, sysrootPath, hostValue, makepkgCmd)
@@ -166,6 +375,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if f.prune != "" {
+		err := builder.Prune(build.PruneMode(f.prune))
+		builder.Close()
+		if err != nil {
+			logger.Errorf("Prune process encountered errors: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	ctx := context.Background()
 	ctx = setupSignalHandler(ctx)
 	if f.alwaysMake {
@@ -188,6 +407,190 @@ func main() {
 
 		builder.PrintSummary()
 	}
+
+	builder.Close()
+
+	if f.reportFile != "" && !f.clean {
+		if err := writeReportFile(builder, f.reportFile); err != nil {
+			logger.Errorf("writing report: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if f.assertClean && !f.clean {
+		if err := builder.AssertClean(); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runCheck loads and validates the configuration without building anything,
+// reports every problem found, and returns the exit status.
+func runCheck(f *flags, configPath string, profile *config.Profile) int {
+	var problems []error
+	addProblem := func(context string, err error) {
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %w", context, err))
+		}
+	}
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		addProblem("loading configuration", err)
+	}
+	toolchainCfg, _, err := config.LoadToolchainConfig(f.toolchainFile, f.toolchainName)
+	if err != nil {
+		addProblem("loading toolchain configuration", err)
+	}
+
+	if cfg != nil {
+		if toolchainCfg != nil {
+			cfg.Toolchain = config.MergeToolchainConfig(&cfg.Toolchain, toolchainCfg)
+		}
+		if profile != nil {
+			if err := profile.Apply(cfg); err != nil {
+				addProblem("applying profile", err)
+			}
+		}
+		if len(f.overrides) > 0 {
+			if err := applyOverrides(cfg, f.overrides); err != nil {
+				addProblem("applying --set", err)
+			}
+		}
+		if _, err := build.GetBuildOrder(cfg); err != nil {
+			addProblem("resolving dependencies", err)
+		}
+
+		hostValue := f.host
+		if hostValue == "" {
+			hostValue = cfg.Toolchain.Host
+		}
+		makepkgCmd, err := f.MakepkgCommand(cfg)
+		if err != nil {
+			addProblem("building makepkg command", err)
+		}
+		builder, err := build.NewBuilder(build.BuilderConfig{DryRun: true}, cfg, f.builddir, f.sysroot, hostValue, makepkgCmd)
+		if err != nil {
+			addProblem("creating builder", err)
+		} else {
+			problems = append(problems, builder.CheckVariables()...)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Errorf("%v", problem)
+		}
+		logger.Errorf("found %d problem(s) in the configuration", len(problems))
+		return 1
+	}
+	logger.Info("configuration OK")
+	return 0
+}
+
+// runPrintEnv prints the environment the scripts of the --print-env package
+// would run in, one NAME=VALUE per line, and returns the exit status.
+func runPrintEnv(f *flags, cfg *config.Config, host string) int {
+	makepkgCmd, err := f.MakepkgCommand(cfg)
+	if err != nil {
+		logger.Errorf("building makepkg command: %v", err)
+		return 1
+	}
+	builderCfg := build.BuilderConfig{
+		DryRun:          true,
+		Overrides:       f.overrides,
+		InheritEnv:      f.inheritEnv,
+		CCache:          f.ccache,
+		MakeJobs:        f.makeJobs,
+		DestDir:         f.destdir,
+		ArtifactsDir:    f.artifactsDir,
+		SourceDateEpoch: f.sourceDateEpoch,
+	}
+	builder, err := build.NewBuilder(builderCfg, cfg, f.builddir, f.sysroot, host, makepkgCmd)
+	if err != nil {
+		logger.Errorf("creating builder: %v", err)
+		return 1
+	}
+	environ, err := builder.Environment(f.printEnv)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	for _, e := range environ {
+		fmt.Println(e)
+	}
+	return 0
+}
+
+// runWhy prints whether and why the --why package would be rebuilt or
+// reinstalled, and returns the exit status.
+func runWhy(f *flags, cfg *config.Config, host string) int {
+	builderCfg := build.BuilderConfig{
+		DryRun:          true,
+		AlwaysInstall:   f.alwaysInstall,
+		TrackSource:     f.trackSource,
+		DestDir:         f.destdir,
+		SourceDateEpoch: f.sourceDateEpoch,
+	}
+	builder, err := build.NewBuilder(builderCfg, cfg, f.builddir, f.sysroot, host, "")
+	if err != nil {
+		logger.Errorf("creating builder: %v", err)
+		return 1
+	}
+	explanation, err := builder.Why(f.why)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	fmt.Println(explanation)
+	return 0
+}
+
+func writeReportFile(builder *build.Builder, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := builder.WriteReport(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// applyOverrides applies the --set overrides to cfg in order and checks
+// that the result is still a valid configuration.
+func applyOverrides(cfg *config.Config, overrides []string) error {
+	for _, s := range overrides {
+		override, err := config.ParseOverride(s)
+		if err != nil {
+			return err
+		}
+		if err := override.Apply(cfg); err != nil {
+			return err
+		}
+	}
+	return cfg.Validate()
+}
+
+func writeGraph(cfg *config.Config, path string, rankByLevel bool) error {
+	if path == "-" {
+		return build.WriteGraph(os.Stdout, cfg, rankByLevel)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := build.WriteGraph(file, cfg, rankByLevel); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
 func setupSignalHandler(ctx context.Context) context.Context {
@@ -0,0 +1,116 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+// artifactManifestName is the name of the manifest written to each package's
+// artifacts directory. It is not itself listed as an artifact.
+const artifactManifestName = ".manifest.json"
+
+// Artifact describes a file a package wrote to its artifacts directory.
+type Artifact struct {
+	// Path is relative to the package's artifacts directory, as passed to
+	// mkpkg::get_artifact.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArtifactManifest lists the artifacts of a package after it was installed.
+type ArtifactManifest struct {
+	Package   string     `json:"package"`
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// DefaultArtifactsDir returns the directory build artifacts are kept in
+// unless BuilderConfig.ArtifactsDir is set.
+func DefaultArtifactsDir(buildDir string) string {
+	return filepath.Join(buildDir, "artifacts")
+}
+
+// Artifacts returns the artifacts the named package wrote to its directory
+// in artifactsDir, sorted by path. A package that wrote none has no
+// artifacts.
+func Artifacts(artifactsDir, pkgName string) ([]Artifact, error) {
+	dir := filepath.Join(artifactsDir, pkgName)
+	artifacts := []Artifact{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || path == filepath.Join(dir, artifactManifestName) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := artifactSum(path)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, Artifact{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifacts of %s: %w", pkgName, err)
+	}
+	return artifacts, nil
+}
+
+func artifactSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeArtifactManifest records the package's artifacts in the manifest in
+// its artifacts directory, if it wrote any.
+func (b *Builder) writeArtifactManifest(pkg *config.Package) error {
+	artifacts, err := Artifacts(b.buildArtifactsDir, pkg.Name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.buildArtifactsDir, pkg.Name, artifactManifestName)
+	if len(artifacts) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove artifact manifest of %s: %w", pkg.Name, err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ArtifactManifest{Package: pkg.Name, Artifacts: artifacts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write artifact manifest of %s: %w", pkg.Name, err)
+	}
+	return nil
+}
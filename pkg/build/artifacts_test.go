@@ -0,0 +1,71 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+func TestArtifacts(t *testing.T) {
+	artifactsDir := t.TempDir()
+	if artifacts, err := Artifacts(artifactsDir, "foo"); err != nil || len(artifacts) != 0 {
+		t.Fatalf("Expected no artifacts for a package that wrote none, got %v (%v)", artifacts, err)
+	}
+
+	dir := filepath.Join(artifactsDir, "foo")
+	files := map[string]string{
+		"mytool":             "#!/bin/sh\n",
+		"lib/libfoo.a":       "!<arch>\n",
+		artifactManifestName: "{}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	artifacts, err := Artifacts(artifactsDir, "foo")
+	if err != nil {
+		t.Fatalf("Artifacts failed: %v", err)
+	}
+	if len(artifacts) != 2 || artifacts[0].Path != "lib/libfoo.a" || artifacts[1].Path != "mytool" {
+		t.Fatalf("Expected lib/libfoo.a and mytool without the manifest, got %+v", artifacts)
+	}
+	if artifacts[1].Size != 10 || artifacts[1].SHA256 == "" {
+		t.Errorf("Expected the size and sum of mytool, got %+v", artifacts[1])
+	}
+}
+
+func TestNewBuilder_ArtifactsDir(t *testing.T) {
+	buildDir := t.TempDir()
+	artifactsDir := filepath.Join(t.TempDir(), "artifacts")
+	cfg := &config.Config{
+		Packages: []config.Package{{Name: "foo", URL: "http://foo", Build: "make", Install: "make install"}},
+	}
+	builder, err := NewBuilder(BuilderConfig{ArtifactsDir: artifactsDir}, cfg, buildDir, t.TempDir(), "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	if _, err := os.Stat(filepath.Join(artifactsDir, cmakeToolchainFileName)); err != nil {
+		t.Errorf("Expected the CMake toolchain file in the artifacts directory: %v", err)
+	}
+	if _, err := os.Stat(DefaultArtifactsDir(buildDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected no artifacts directory in the build directory, got %v", err)
+	}
+	environ, err := builder.Environment("foo")
+	if err != nil {
+		t.Fatalf("Environment failed: %v", err)
+	}
+	if !slices.Contains(environ, "BUILD_ARTIFACTS="+artifactsDir) {
+		t.Errorf("Expected BUILD_ARTIFACTS=%s", artifactsDir)
+	}
+}
@@ -2,39 +2,125 @@ package build
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aar10n/makepkg/pkg/cache"
 	"github.com/aar10n/makepkg/pkg/config"
 	"github.com/aar10n/makepkg/pkg/download"
 	"github.com/aar10n/makepkg/pkg/env"
 	"github.com/aar10n/makepkg/pkg/logger"
+	"github.com/aar10n/makepkg/pkg/term"
+)
+
+const (
+	defaultSummaryWidth = 60
+
+	// ccacheDirName is the directory under the build directory that holds
+	// the ccache cache. Like other dot directories it survives cleans and
+	// prunes.
+	ccacheDirName = ".ccache"
+
+	// killGracePeriod is how long a canceled script's process group has to
+	// exit after SIGTERM before it is killed.
+	killGracePeriod = 5 * time.Second
+)
+
+// Action describes what was done for a package during a build.
+type Action string
+
+const (
+	ActionBuilt       Action = "built"
+	ActionReinstalled Action = "reinstalled"
+	ActionSkipped     Action = "skipped"
 )
 
 // Result represents the result of building a package.
 type Result struct {
-	Package string
-	Success bool
-	Error   error
-	Output  string
+	Package  string
+	Success  bool
+	Action   Action
+	Duration time.Duration
+	Error    error
+	Output   string
+	// Reason explains why a package was skipped without being checked.
+	Reason string
 }
 
 // BuilderConfig holds configuration options for the builder.
 type BuilderConfig struct {
-	Quiet          bool
-	Verbose        bool
-	FailFast       bool
-	DryRun         bool
-	AlwaysInstall  bool
-	MaxConcurrency int
-	MakeJobs       int
+	Quiet           bool
+	Verbose         bool
+	FailFast        bool
+	DryRun          bool
+	AlwaysInstall   bool
+	BuildOnly       bool
+	InstallOnly     bool
+	Only            bool
+	DiscardSource   bool
+	TrackSource     bool
+	CCache          bool
+	Continue        bool
+	ASCII           bool
+	Strict          bool
+	Offline         bool
+	LogDir          string
+	DownloadCache   string
+	StreamDownloads bool
+	DeleteArchives  bool
+	DownloadRetries int
+	BuildRetries    int
+	DownloadTimeout time.Duration
+	MaxConcurrency  int
+	MakeJobs        int
+
+	// Overrides are the --set overrides applied to the configuration, which
+	// are passed on to nested invocations through config.OverridesEnvVar.
+	Overrides []string
+
+	// InheritEnv names host variables passed through to package scripts,
+	// which otherwise only inherit the host's PATH.
+	InheritEnv []string
+
+	// DestDir, if set, is the directory packages are installed into
+	// instead of the sysroot they are built against.
+	DestDir string
+
+	// ArtifactsDir, if set, is the directory build artifacts are kept in
+	// instead of DefaultArtifactsDir of the build directory.
+	ArtifactsDir string
+
+	// SourceDateEpoch, if set, is the SOURCE_DATE_EPOCH of every package,
+	// instead of one derived from the package's source.
+	SourceDateEpoch string
+
+	// SysrootTemplate, if set, is a directory copied into the directory
+	// packages are installed into before the build, or FHSTemplate to
+	// create the sysroot skeleton directories instead.
+	SysrootTemplate string
+
+	// Exclude names packages that are left out of the build, together with
+	// the packages that depend on them.
+	Exclude []string
+
+	// OnEvent, if set, is called as each package moves through the phases
+	// of its build.
+	OnEvent func(PackageEvent)
 }
 
 // Builder orchestrates the building of packages.
@@ -48,6 +134,9 @@ type Builder struct {
 	buildDir   string
 	sysroot    string
 	host       string
+	preamble   string
+	lock       *buildLock
+	nestedLock *buildLock
 
 	cache             cache.Cache
 	downloader        download.Downloader
@@ -61,24 +150,99 @@ type Builder struct {
 	requiredBy        map[string][]string
 	rebuiltPackages   map[string]bool
 	rebuiltMutex      sync.Mutex
+	eventMutex        sync.Mutex
+	succeeded         map[string]bool
+	strictErrs        map[string]error
+	total             int
+	started           atomic.Int32
+	buildStart        time.Time
+	buildEnd          time.Time
 }
 
-// NewBuilder creates a new Builder instance.
+// NewBuilder creates a new Builder instance for cfg, as loaded by
+// config.LoadConfig with any toolchain file merged in. buildDir and sysroot should be
+// absolute paths, and host may be empty for native builds. makepkgCmd is
+// exposed to package scripts as $MAKEPKG for nested invocations and may be
+// empty if no script uses it. Unless the build is a dry run, NewBuilder
+// locks buildDir; call Close to release it.
 func NewBuilder(builderCfg BuilderConfig, cfg *config.Config, buildDir, sysroot, host, makepkgCmd string) (*Builder, error) {
 	envManager := env.NewManager()
+	envManager.Inherit(builderCfg.InheritEnv...)
 	envManager.Set("PKGS_ROOT", filepath.Dir(cfg.FilePath))
 	envManager.Set("PKGS_ARCH", cfg.Toolchain.Arch)
 	envManager.Set("BUILD_DIR", envManager.Subst(buildDir))
 	envManager.Set("SYS_ROOT", envManager.Subst(sysroot))
+	if builderCfg.DestDir != "" {
+		envManager.Set("INSTALL_ROOT", envManager.Subst(builderCfg.DestDir))
+	} else {
+		envManager.Set("INSTALL_ROOT", envManager.Subst(sysroot))
+	}
 	envManager.Set("MAKEPKG", makepkgCmd)
+	if len(builderCfg.Overrides) > 0 {
+		envManager.Set(config.OverridesEnvVar, config.EncodeOverrides(builderCfg.Overrides))
+	}
 	if host != "" {
 		envManager.Set("PKGS_HOST", envManager.Subst(host))
 	}
+	if build := buildTriple(); build != "" {
+		envManager.Set("PKGS_BUILD", build)
+	}
+
+	if builderCfg.CCache {
+		if _, err := exec.LookPath("ccache"); err != nil {
+			if builderCfg.Strict {
+				return nil, fmt.Errorf("ccache not found in PATH")
+			}
+			logger.Warn("ccache not found in PATH, building without it")
+			builderCfg.CCache = false
+		}
+	}
+
+	// Read the user's script preamble, resolved against the configuration
+	// directory like patches are.
+	var preamble string
+	if cfg.ScriptPreamble != "" {
+		path := envManager.Subst(cfg.ScriptPreamble)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(cfg.FilePath), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read script preamble: %w", err)
+		}
+		preamble = string(data)
+	}
+
+	// Lock the build directory against concurrent runs. Nested invocations
+	// through $MAKEPKG run while their parent holds the lock, so they skip it
+	// and instead wait for each other, unless one is nested in another.
+	var lock, nestedLock *buildLock
+	lockPath := filepath.Join(buildDir, lockFileName)
+	nestedLockPath := filepath.Join(buildDir, nestedLockFileName)
+	if !builderCfg.DryRun && os.Getenv(lockEnvVar) != lockPath {
+		var err error
+		if lock, err = acquireLock(buildDir); err != nil {
+			return nil, err
+		}
+	} else if !builderCfg.DryRun && os.Getenv(nestedLockEnvVar) != nestedLockPath {
+		var err error
+		if nestedLock, err = waitForNestedLock(buildDir); err != nil {
+			return nil, err
+		}
+		envManager.Set(nestedLockEnvVar, nestedLockPath)
+	}
+	envManager.Set(lockEnvVar, lockPath)
 
 	// Set up build artifacts directory
-	buildArtifactsDir := filepath.Join(buildDir, "artifacts")
+	buildArtifactsDir := cmp.Or(builderCfg.ArtifactsDir, DefaultArtifactsDir(buildDir))
 	if !builderCfg.DryRun {
 		if err := os.MkdirAll(buildArtifactsDir, 0755); err != nil {
+			if lock != nil {
+				lock.Release()
+			}
+			if nestedLock != nil {
+				nestedLock.Release()
+			}
 			return nil, fmt.Errorf("failed to create build artifacts directory: %w", err)
 		}
 	}
@@ -90,8 +254,39 @@ func NewBuilder(builderCfg BuilderConfig, cfg *config.Config, buildDir, sysroot,
 	toolEnv := env.NewManager()
 	cfg.Toolchain.AddToEnv(toolEnv)
 
-	cacheInst := cache.NewCache(buildDir)
-	downloader := download.NewDownloader(buildDir)
+	// Describe the toolchain to CMake-based packages
+	cmakeToolchainPath := filepath.Join(buildArtifactsDir, cmakeToolchainFileName)
+	if !builderCfg.DryRun {
+		if err := writeCMakeToolchain(cmakeToolchainPath, &cfg.Toolchain, toolEnv, envManager.Subst(host), sysroot); err != nil {
+			if lock != nil {
+				lock.Release()
+			}
+			if nestedLock != nil {
+				nestedLock.Release()
+			}
+			return nil, fmt.Errorf("failed to write CMake toolchain file: %w", err)
+		}
+	}
+	toolEnv.Set(cmakeToolchainEnvVar, cmakeToolchainPath)
+
+	cacheInst := cache.NewCache(buildDir, cache.Config{
+		TrackSource: builderCfg.TrackSource,
+		Toolchain:   cfg.Toolchain.Fingerprint(),
+		Env:         cfg.Env,
+		Preamble:    preambleDigest(preamble),
+		DestDir:     builderCfg.DestDir,
+
+		SourceDateEpoch: builderCfg.SourceDateEpoch,
+	})
+	downloader := download.NewDownloader(buildDir, download.DownloaderConfig{
+		CacheDir: builderCfg.DownloadCache,
+		Stream:   builderCfg.StreamDownloads,
+		Delete:   builderCfg.DeleteArchives,
+		Retries:  builderCfg.DownloadRetries,
+		Timeout:  builderCfg.DownloadTimeout,
+		Quiet:    builderCfg.Quiet,
+		Offline:  builderCfg.Offline,
+	})
 
 	builderLogger := logger.Default().Clone()
 	if builderCfg.DryRun {
@@ -108,6 +303,9 @@ func NewBuilder(builderCfg BuilderConfig, cfg *config.Config, buildDir, sysroot,
 		buildDir:   buildDir,
 		sysroot:    sysroot,
 		host:       host,
+		preamble:   preamble,
+		lock:       lock,
+		nestedLock: nestedLock,
 
 		cache:             cacheInst,
 		downloader:        downloader,
@@ -121,21 +319,105 @@ func NewBuilder(builderCfg BuilderConfig, cfg *config.Config, buildDir, sysroot,
 	}, nil
 }
 
+// Close releases the lock on the build directory.
+func (b *Builder) Close() error {
+	var err error
+	if b.nestedLock != nil {
+		err = b.nestedLock.Release()
+		b.nestedLock = nil
+	}
+	if b.lock != nil {
+		err = errors.Join(err, b.lock.Release())
+		b.lock = nil
+	}
+	return err
+}
+
 // Build builds all packages according to the dependency order.
 // If packageFilter is non-empty, only builds the specified packages (and their dependencies).
 func (b *Builder) Build(ctx context.Context, packageFilter []string) error {
 	b.Info("Starting build process...")
-	for i := range b.config.Packages {
-		b.config.Packages[i].Subst(b.envManager)
+	b.buildStart = time.Now()
+	defer func() { b.buildEnd = time.Now() }()
+
+	if b.builderCfg.Continue {
+		state, err := readState(b.buildDir)
+		if err != nil {
+			return err
+		}
+		if len(state.Packages) == 0 {
+			b.Warn("no previous build state in %s, building all packages", b.buildDir)
+		}
+		b.succeeded = state.Packages
+	}
+
+	// Only the invocation holding the lock saves the state; nested
+	// invocations through $MAKEPKG build just a few packages.
+	if b.lock != nil {
+		defer func() {
+			if err := writeState(b.buildDir, b.results); err != nil {
+				b.Warn("%v", err)
+			}
+		}()
 	}
 
+	// Packages failing strict checks are failed when their turn comes, so
+	// that the rest of the build goes ahead.
+	b.strictErrs = make(map[string]error)
+	for i := range b.config.Packages {
+		pkg := &b.config.Packages[i]
+		pkg.Subst(b.envManager)
+		if !pkg.IsEnabled() {
+			continue
+		}
+		if undefined := b.undefinedScriptVariables(pkg); len(undefined) > 0 {
+			if err := b.strictWarn("package %s references undefined variables: %s", pkg.Name, strings.Join(undefined, ", ")); err != nil {
+				b.strictErrs[pkg.Name] = err
+			}
+		}
+		if cross := b.crossDependencies(pkg); len(cross) > 0 {
+			b.Warn("native package %s depends on cross compiled packages it cannot link against: %s", pkg.Name, strings.Join(cross, ", "))
+		}
+	}
 	if !b.builderCfg.DryRun {
-		if err := os.MkdirAll(b.sysroot, 0o755); err != nil {
-			return fmt.Errorf("failed to create sysroot directory: %w", err)
+		// Without a sysroot, packages are built against and installed to /
+		if b.sysroot != "" {
+			if err := os.MkdirAll(b.sysroot, 0o755); err != nil {
+				return fmt.Errorf("failed to create sysroot directory: %w", err)
+			}
+		}
+		if b.builderCfg.DestDir != "" {
+			if err := os.MkdirAll(b.builderCfg.DestDir, 0o755); err != nil {
+				return fmt.Errorf("failed to create destdir: %w", err)
+			}
+		}
+		if b.builderCfg.SysrootTemplate != "" {
+			if err := b.initSysroot(cmp.Or(b.builderCfg.DestDir, b.sysroot, "/")); err != nil {
+				return err
+			}
+		}
+	} else if b.preamble != "" {
+		b.Info("Would prepend script preamble to package scripts:")
+		for _, line := range strings.Split(strings.TrimRight(b.preamble, "\n"), "\n") {
+			b.Info("    %s", line)
+		}
+	}
+
+	arch := b.config.Toolchain.Arch
+	unsupported := make(map[string]bool)
+	for _, pkg := range b.config.Packages {
+		if pkg.IsEnabled() && !pkg.SupportsArch(arch) {
+			unsupported[pkg.Name] = true
 		}
 	}
 
-	buildOrder, err := GetBuildOrder(b.config)
+	excluded := b.excludedPackages()
+	leftOut := maps.Clone(unsupported)
+	for name := range excluded {
+		leftOut[name] = true
+	}
+
+	buildOrder, err := GetBuildOrder(excludePackages(b.config, leftOut))
 	if err != nil {
 		return fmt.Errorf("failed to resolve dependencies: %w", err)
 	}
@@ -143,38 +425,67 @@ func (b *Builder) Build(ctx context.Context, packageFilter []string) error {
 	filterSet := make(map[string]bool)
 	if len(packageFilter) > 0 {
 		for _, pkgName := range packageFilter {
+			if reason, ok := excluded[pkgName]; ok {
+				return fmt.Errorf("cannot build %s: %s", pkgName, reason)
+			}
 			filterSet[pkgName] = true
 			b.requestedPackages[pkgName] = true
 		}
 
-		for _, pkgName := range packageFilter {
-			b.addDependenciesToFilter(pkgName, filterSet)
+		if b.builderCfg.Only {
+			if err := b.checkDependenciesBuilt(packageFilter, filterSet); err != nil {
+				return err
+			}
+		} else {
+			for _, pkgName := range packageFilter {
+				deps := make(map[string]bool)
+				b.addDependenciesToFilter(pkgName, deps)
+				for _, name := range b.builderCfg.Exclude {
+					if deps[name] {
+						return fmt.Errorf("cannot build %s: it depends on excluded package %s", pkgName, name)
+					}
+				}
+				maps.Copy(filterSet, deps)
+			}
 		}
 	}
 
 	b.buildRequiredByMap(filterSet)
 
-	for _, level := range buildOrder {
-		if b.isStopped() {
-			b.Error("\nBuild stopped due to error (fail-fast mode)")
-			return fmt.Errorf("build stopped early")
+	for _, pkg := range b.config.Packages {
+		if unsupported[pkg.Name] && (len(filterSet) == 0 || filterSet[pkg.Name]) {
+			b.Info("Skipping %s: not built for arch %s", pkg.Name, arch)
+			b.recordSkipped(pkg.Name, fmt.Sprintf("not built for arch %s", arch), true)
+		} else if reason, ok := excluded[pkg.Name]; ok && pkg.IsEnabled() && len(filterSet) == 0 {
+			b.Info("Skipping %s: %s", pkg.Name, reason)
+			b.recordSkipped(pkg.Name, reason, true)
 		}
+	}
 
-		filteredLevel := level
+	var packageNames []string
+	for _, level := range buildOrder {
 		if len(filterSet) > 0 {
-			filteredLevel = b.filterPackages(level, filterSet)
+			level = b.filterPackages(level, filterSet)
 		}
-
-		if len(filteredLevel) == 0 {
-			continue
+		packageNames = append(packageNames, level...)
+	}
+	b.total = len(packageNames)
+	b.started.Store(0)
+
+	// The download cache already shares archives between packages
+	if b.builderCfg.DownloadCache == "" {
+		for _, names := range b.config.DuplicateURLs(packageNames) {
+			b.Warn("packages %s share the URL %s; it will be downloaded separately for each package",
+				strings.Join(names, ", "), b.config.GetPackageByName(names[0]).URL)
 		}
+	}
 
-		if err := b.buildLevel(ctx, filteredLevel); err != nil {
-			if b.builderCfg.FailFast {
-				return err
-			}
-			b.Warn("errors occurred in build level: %v", err)
+	if err := b.buildPackages(ctx, packageNames); err != nil {
+		if b.builderCfg.FailFast {
+			b.Error("Build stopped due to error (fail-fast mode)")
+			return err
 		}
+		b.Warn("errors occurred during build: %v", err)
 	}
 
 	return nil
@@ -182,6 +493,7 @@ func (b *Builder) Build(ctx context.Context, packageFilter []string) error {
 
 // Clean cleans all packages or the specified packages.
 // If packageFilter is non-empty, only cleans the specified packages.
+// Packages left out of the build by the Exclude option are not cleaned.
 func (b *Builder) Clean(packageFilter []string) error {
 	b.Info("Cleaning packages...")
 	b.Info("")
@@ -193,34 +505,66 @@ func (b *Builder) Clean(packageFilter []string) error {
 		}
 	}
 
+	excluded := b.excludedPackages()
 	pool := NewWorkerPool(b.builderCfg.MaxConcurrency)
 
+	var errs []error
+	var errsMutex sync.Mutex
 	for i := range b.config.Packages {
 		if len(filterSet) > 0 && !filterSet[b.config.Packages[i].Name] {
 			continue
 		}
+		if _, ok := excluded[b.config.Packages[i].Name]; ok {
+			continue
+		}
 
 		pkg := &b.config.Packages[i]
 		pool.Submit(func() {
 			if err := b.cleanPackage(pkg); err != nil {
-				b.Warn("failed to clean %s: %v", pkg.Name, err)
+				if err := b.strictWarn("failed to clean %s: %v", pkg.Name, err); err != nil {
+					errsMutex.Lock()
+					errs = append(errs, err)
+					errsMutex.Unlock()
+				}
 			}
 		})
 	}
 
 	pool.Wait()
-	return nil
+	return errors.Join(errs...)
 }
 
-// PrintSummary prints a summary of the build results.
+// PrintSummary prints a summary of the build results. The separator lines
+// are left out of JSON output.
 func (b *Builder) PrintSummary() {
-	separator := strings.Repeat("=", 60)
-	b.Info("")
-	b.Info("%s", separator)
+	text := b.Format() != logger.FormatJSON
+	width, ok := term.Width(os.Stdout)
+	if !ok {
+		width = defaultSummaryWidth
+	}
+	// Leave room for the prefix of dry runs so that the lines do not wrap
+	separator := strings.Repeat("=", max(width-len(b.Prefix()), 1))
+	printSeparator := func() {
+		if text {
+			b.Info("%s", separator)
+		}
+	}
+
+	successMark, reusedMark, failMark := "✓", "↺", "✗"
+	if b.builderCfg.ASCII {
+		successMark, reusedMark, failMark = "[OK]", "[REUSED]", "[FAIL]"
+	}
+
+	if text {
+		b.Info("")
+	}
+	printSeparator()
 	b.Info("Build Summary")
-	b.Info("%s", separator)
+	printSeparator()
 
-	successCount := 0
+	builtCount := 0
+	reusedCount := 0
+	skippedCount := 0
 	failCount := 0
 
 	resultMap := make(map[string]Result)
@@ -236,19 +580,147 @@ func (b *Builder) PrintSummary() {
 				dependencyLabel = " (dependency)"
 			}
 
-			if result.Success {
-				successCount++
-				b.Info("✓ %s%s", result.Package, dependencyLabel)
+			duration := formatDuration(result.Duration)
+			if result.Reason != "" && result.Success {
+				skippedCount++
+				b.InfoColor(logger.ColorYellow, "%s %s%s (skipped: %s)", successMark, result.Package, dependencyLabel, result.Reason)
+			} else if result.Reason != "" {
+				failCount++
+				b.InfoColor(logger.ColorRed, "%s %s%s (skipped: %s)", failMark, result.Package, dependencyLabel, result.Reason)
+			} else if result.Success && result.Action == ActionSkipped {
+				reusedCount++
+				b.InfoColor(logger.ColorYellow, "%s %s%s (up to date)", reusedMark, result.Package, dependencyLabel)
+			} else if result.Success {
+				builtCount++
+				b.InfoColor(logger.ColorGreen, "%s %s%s (%s)", successMark, result.Package, dependencyLabel, duration)
 			} else {
 				failCount++
-				b.Info("✗ %s%s: %v", result.Package, dependencyLabel, result.Error)
+				b.InfoColor(logger.ColorRed, "%s %s%s (%s): %v", failMark, result.Package, dependencyLabel, duration, result.Error)
 			}
 		}
 	}
 
-	b.Info("%s", separator)
-	b.Info("Total: %d | Success: %d | Failed: %d", len(b.results), successCount, failCount)
-	b.Info("%s", separator)
+	printSeparator()
+	b.Info("Total: %d | Built: %d | Reused: %d | Skipped: %d | Failed: %d | Time: %s", len(b.results), builtCount, reusedCount,
+		skippedCount, failCount, formatDuration(b.elapsed()))
+	printSeparator()
+}
+
+// Results returns the result of each package of the last build, in
+// configuration order.
+func (b *Builder) Results() []Result {
+	b.resultsMutex.Lock()
+	defer b.resultsMutex.Unlock()
+
+	resultMap := make(map[string]Result)
+	for _, result := range b.results {
+		resultMap[result.Package] = result
+	}
+
+	var results []Result
+	for _, pkg := range b.config.Packages {
+		if result, ok := resultMap[pkg.Name]; ok {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+type reportPackage struct {
+	Name       string  `json:"name"`
+	Success    bool    `json:"success"`
+	Action     Action  `json:"action"`
+	Dependency bool    `json:"dependency"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+type report struct {
+	Packages []reportPackage `json:"packages"`
+	Total    int             `json:"total"`
+	Success  int             `json:"success"`
+	Failed   int             `json:"failed"`
+	Duration float64         `json:"duration_seconds"`
+}
+
+// WriteReport writes the build results to w as JSON, in configuration order.
+func (b *Builder) WriteReport(w io.Writer) error {
+	resultMap := make(map[string]Result)
+	for _, result := range b.results {
+		resultMap[result.Package] = result
+	}
+
+	r := report{Packages: []reportPackage{}, Duration: b.elapsed().Seconds()}
+	for _, pkg := range b.config.Packages {
+		result, ok := resultMap[pkg.Name]
+		if !ok {
+			continue
+		}
+
+		entry := reportPackage{
+			Name:       result.Package,
+			Success:    result.Success,
+			Action:     result.Action,
+			Dependency: len(b.requestedPackages) > 0 && !b.requestedPackages[pkg.Name],
+			Duration:   result.Duration.Seconds(),
+			Reason:     result.Reason,
+		}
+		if result.Error != nil {
+			entry.Error = result.Error.Error()
+		}
+
+		r.Packages = append(r.Packages, entry)
+		r.Total++
+		if result.Success {
+			r.Success++
+		} else {
+			r.Failed++
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// AssertClean re-checks the cache for every package that was built successfully
+// and returns an error listing any that would still be rebuilt or reinstalled.
+// A non-empty result after a build indicates nondeterministic build inputs.
+// Packages skipped without being checked are left out, as is the step that
+// --build-only or --install-only left out.
+func (b *Builder) AssertClean() error {
+	var dirty []string
+	for _, result := range b.results {
+		if !result.Success || result.Reason != "" {
+			continue
+		}
+
+		pkg := b.config.GetPackageByName(result.Package)
+		if pkg == nil {
+			continue
+		}
+
+		needsRebuild, err := b.cache.NeedsRebuild(pkg, b.sysroot, b.host)
+		if err != nil {
+			return fmt.Errorf("failed to check cache for %s: %w", pkg.Name, err)
+		}
+		needsReinstall, err := b.cache.NeedsReinstall(pkg, b.sysroot, b.host)
+		if err != nil {
+			return fmt.Errorf("failed to check reinstall cache for %s: %w", pkg.Name, err)
+		}
+
+		if needsRebuild && !b.builderCfg.InstallOnly {
+			dirty = append(dirty, pkg.Name+" (needs rebuild)")
+		} else if needsReinstall && !b.builderCfg.BuildOnly {
+			dirty = append(dirty, pkg.Name+" (needs reinstall)")
+		}
+	}
+
+	if len(dirty) > 0 {
+		return fmt.Errorf("cache is not clean after build: %s", strings.Join(dirty, ", "))
+	}
+	return nil
 }
 
 func (b *Builder) cleanPackage(pkg *config.Package) error {
@@ -258,29 +730,34 @@ func (b *Builder) cleanPackage(pkg *config.Package) error {
 
 	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
 		b.Info("  No source directory found for %s, skipping", pkg.Name)
+		b.cache.Invalidate(pkg.Name)
 		return nil
 	}
 
-	cleanEnv := b.envManager.EnvironmentForPackage(pkg.Name, pkg.Env, b.sysroot, b.builderCfg.MakeJobs)
+	cleanEnv := b.envManager.EnvironmentForPackage(pkg.Name, pkg.Version, b.config.Env, pkg.Env, b.sysroot, b.makeJobs(pkg))
 	if pkg.Clean != "" {
 		b.Info("  Running custom clean script for %s...", pkg.Name)
-		_, err := b.runScript(pkg.Name, ScriptTypeClean, pkg.Clean, cleanEnv.ToSlice())
+		_, err := b.runScript(context.Background(), pkg, ScriptTypeClean, pkg.Clean, cleanEnv.ToSlice())
 		if err == nil {
 			b.cache.Invalidate(pkg.Name)
 			b.Info("  %s cleaned successfully", pkg.Name)
 			return nil
 		}
-		b.Warn("Custom clean script failed, trying make clean...")
+		if err := b.strictWarn("custom clean script failed for %s: %v", pkg.Name, err); err != nil {
+			return err
+		}
 	}
 
 	b.Info("  Running 'make clean' for %s...", pkg.Name)
-	_, err := b.runScript(pkg.Name, ScriptTypeClean, "make clean", cleanEnv.ToSlice())
+	_, err := b.runScript(context.Background(), pkg, ScriptTypeClean, "make clean", cleanEnv.ToSlice())
 	if err == nil {
 		b.cache.Invalidate(pkg.Name)
 		b.Info("  %s cleaned successfully", pkg.Name)
 		return nil
 	}
-	b.Warn("'make clean' failed, removing source directory...")
+	if err := b.strictWarn("'make clean' failed for %s: %v", pkg.Name, err); err != nil {
+		return err
+	}
 
 	b.Info("  Removing source directory for %s...", pkg.Name)
 	if err := os.RemoveAll(sourceDir); err != nil {
@@ -292,30 +769,43 @@ func (b *Builder) cleanPackage(pkg *config.Package) error {
 	return nil
 }
 
-func (b *Builder) buildLevel(ctx context.Context, packageNames []string) error {
-	pool := NewWorkerPool(b.builderCfg.MaxConcurrency)
+// buildPackages builds packageNames, which must be in dependency order.
+// Each package starts as soon as the dependencies it shares with
+// packageNames have finished, whether or not they succeeded.
+func (b *Builder) buildPackages(ctx context.Context, packageNames []string) error {
+	pool := NewWorkerPoolWithContext(ctx, b.builderCfg.MaxConcurrency)
 	errors := make([]error, 0)
 	var errorsMutex sync.Mutex
 
+	done := make(map[string]chan struct{}, len(packageNames))
 	for _, pkgName := range packageNames {
-		if b.isStopped() {
-			break
-		}
+		done[pkgName] = make(chan struct{})
+	}
 
+	for _, pkgName := range packageNames {
 		name := pkgName
-		pool.SubmitWithStop(func() {
-			if b.isStopped() {
-				return
+		pkg := b.config.GetPackageByName(name)
+		if pkg == nil {
+			errorsMutex.Lock()
+			errors = append(errors, fmt.Errorf("package %s not found", name))
+			errorsMutex.Unlock()
+			close(done[name])
+			if b.builderCfg.FailFast {
+				b.stop()
 			}
+			continue
+		}
 
-			pkg := b.config.GetPackageByName(name)
-			if pkg == nil {
-				errorsMutex.Lock()
-				errors = append(errors, fmt.Errorf("package %s not found", name))
-				errorsMutex.Unlock()
-				if b.builderCfg.FailFast {
-					b.stop()
-				}
+		var deps []<-chan struct{}
+		for _, dep := range pkg.BuildDependencies() {
+			if ch, ok := done[dep]; ok {
+				deps = append(deps, ch)
+			}
+		}
+
+		pool.SubmitAfter(deps, func() {
+			defer close(done[name])
+			if b.isStopped() {
 				return
 			}
 
@@ -339,28 +829,80 @@ func (b *Builder) buildLevel(ctx context.Context, packageNames []string) error {
 }
 
 func (b *Builder) buildPackage(ctx context.Context, pkg *config.Package) error {
+	// Packages are counted as they start, so that every package of the
+	// build, skipped or not, gets its own number.
+	progress := fmt.Sprintf("[%d/%d]", b.started.Add(1), b.total)
+
+	if b.succeeded[pkg.Name] && !b.dependencyBuilt(pkg) {
+		b.Info("%s Skipping %s: succeeded in the previous build", progress, pkg.Name)
+		b.recordSkipped(pkg.Name, "succeeded in the previous build", true)
+		return nil
+	}
+
+	if dep := b.failedDependency(pkg); dep != "" {
+		b.Info("%s Skipping %s: dependency %s failed", progress, pkg.Name, dep)
+		b.recordSkipped(pkg.Name, fmt.Sprintf("dependency %s failed", dep), false)
+		return fmt.Errorf("skipped %s: dependency %s failed", pkg.Name, dep)
+	}
+
+	start := time.Now()
 	requiredBy := b.requiredBy[pkg.Name]
-	b.Info("Building %s%s...", pkg.Name, formatRequiredBy(requiredBy))
+	b.Info("%s Building %s%s...", progress, pkg.Name, formatRequiredBy(requiredBy))
+	b.emit(PackageEvent{Package: pkg.Name, Phase: PhaseStarted})
+
+	if err := b.strictErrs[pkg.Name]; err != nil {
+		b.recordResult(pkg.Name, ActionBuilt, start, err, "")
+		return err
+	}
 
-	needsRebuild, err := b.cache.NeedsRebuild(pkg, b.sysroot, b.host)
+	needsRebuild, rebuildReason, err := b.cache.NeedsRebuildWithReason(pkg, b.sysroot, b.host)
 	if err != nil {
 		return fmt.Errorf("failed to check cache for %s: %w", pkg.Name, err)
 	}
 
-	needsReinstall := b.builderCfg.AlwaysInstall
+	needsReinstall, reinstallReason := b.builderCfg.AlwaysInstall, "--always-install was given"
 	if !needsReinstall {
-		needsReinstall, err = b.cache.NeedsReinstall(pkg, b.sysroot, b.host)
+		needsReinstall, reinstallReason, err = b.cache.NeedsReinstallWithReason(pkg, b.sysroot, b.host)
 		if err != nil {
 			return fmt.Errorf("failed to check reinstall cache for %s: %w", pkg.Name, err)
 		}
 	}
 
+	if b.builderCfg.BuildOnly {
+		needsReinstall = false
+	}
+	if b.builderCfg.InstallOnly {
+		if err := b.checkInstallable(pkg); err != nil {
+			b.recordResult(pkg.Name, ActionReinstalled, start, err, "")
+			return err
+		}
+		if needsRebuild {
+			b.Info("  %s is out of date, installing its previous build", pkg.Name)
+			needsRebuild, needsReinstall = false, true
+		}
+	}
+
 	if !needsRebuild && !needsReinstall {
 		b.Info("  %s is up to date, skipping", pkg.Name)
-		b.recordResult(pkg.Name, true, nil, "")
+		b.recordResult(pkg.Name, ActionSkipped, start, nil, "")
 		return nil
 	}
 
+	// Dry runs of packages built before show what changed rather than
+	// every script that would run.
+	var cached *cache.Info
+	if b.builderCfg.DryRun {
+		cached, _ = b.cache.Read(pkg.Name)
+		if cached != nil {
+			if needsRebuild {
+				b.Info("  [DRY RUN] Would rebuild %s: %s", pkg.Name, rebuildReason)
+			} else {
+				b.Info("  [DRY RUN] Would reinstall %s: %s", pkg.Name, reinstallReason)
+			}
+			b.printChanges(pkg, cached)
+		}
+	}
+
 	// Clean up package-specific build artifacts directory
 	pkgArtifactsDir := filepath.Join(b.buildArtifactsDir, pkg.Name)
 	if !b.builderCfg.DryRun {
@@ -379,121 +921,559 @@ func (b *Builder) buildPackage(ctx context.Context, pkg *config.Package) error {
 	var installOutput string
 	sourceDir := filepath.Join(b.buildDir, pkg.Name, "source")
 
-	pkgEnv := b.envManager.EnvironmentForPackage(pkg.Name, pkg.Env, b.sysroot, b.builderCfg.MakeJobs)
-	if !pkg.Native {
-		b.toolEnv.AddToEnv(pkgEnv)
+	if !needsRebuild {
+		if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
+			b.Info("  Source for %s was discarded, rebuilding to reinstall", pkg.Name)
+			needsRebuild = true
+		}
 	}
+
+	action := ActionReinstalled
+	if needsRebuild {
+		action = ActionBuilt
+	}
+
+	pkgEnv := b.packageEnv(pkg)
 	if needsRebuild {
 		info, _ := b.cache.Read(pkg.Name)
-		if info != nil && info.URL != pkg.URL {
-			b.Info("  URL changed for %s, cleaning old build", pkg.Name)
-			if !b.builderCfg.DryRun {
-				if err := b.cache.Clean(pkg.Name); err != nil {
-					return fmt.Errorf("failed to clean info for %s: %w", pkg.Name, err)
+		if info != nil {
+			if change := info.SourceChange(pkg); change != "" {
+				b.Info("  Source %s changed for %s, cleaning old build", change, pkg.Name)
+				if !b.builderCfg.DryRun {
+					if err := b.cache.Clean(pkg.Name); err != nil {
+						return fmt.Errorf("failed to clean info for %s: %w", pkg.Name, err)
+					}
+				} else {
+					b.Info("Would clean old build for %s due to %s change", pkg.Name, change)
 				}
-			} else {
-				b.Info("Would clean old build for %s due to URL change", pkg.Name)
 			}
 		}
 
+		haveSource := true
 		if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
+			haveSource = false
+		} else if !b.downloader.SourceComplete(pkg.Name) {
+			b.Info("  Source of %s was not fully extracted, fetching it again", pkg.Name)
 			if !b.builderCfg.DryRun {
-				b.Info("  Downloading %s...", pkg.Name)
-				if err := b.downloader.Download(ctx, pkg.Name, pkg.URL); err != nil {
-					b.recordResult(pkg.Name, false, err, "")
-					return fmt.Errorf("failed to download %s: %w", pkg.Name, err)
+				if err := os.RemoveAll(sourceDir); err != nil {
+					b.recordResult(pkg.Name, action, start, err, "")
+					return fmt.Errorf("failed to clean source for %s: %w", pkg.Name, err)
 				}
-				if err := b.downloader.Extract(pkg.Name, pkg.URL); err != nil {
-					b.recordResult(pkg.Name, false, err, "")
-					return fmt.Errorf("failed to extract %s: %w", pkg.Name, err)
+			}
+			haveSource = false
+		} else if pkg.SourceCopy {
+			// Copy source_dir again, since it may be what changed.
+			if !b.builderCfg.DryRun {
+				if err := os.RemoveAll(sourceDir); err != nil {
+					b.recordResult(pkg.Name, action, start, err, "")
+					return fmt.Errorf("failed to clean source for %s: %w", pkg.Name, err)
+				}
+			}
+			haveSource = false
+		}
+		if !haveSource {
+			if !b.builderCfg.DryRun {
+				if output, err := b.prepareSource(ctx, pkg, sourceDir); err != nil {
+					b.recordResult(pkg.Name, action, start, err, output)
+					return err
 				}
 			} else {
-				b.Info("  [DRY RUN] Would download and extract %s", pkg.Name)
+				if pkg.SourceDir != "" {
+					b.Info("  [DRY RUN] Would use source directory %s", pkg.SourceDir)
+				} else {
+					b.Info("  [DRY RUN] Would download and extract %s", pkg.Name)
+				}
 			}
 		}
+		b.setSourceDateEpoch(pkg, pkgEnv)
+		b.setArchiveEnv(pkg, pkgEnv)
 
 		b.Info("  Compiling %s...", pkg.Name)
+		b.emit(PackageEvent{Package: pkg.Name, Phase: PhaseCompiling})
 		b.Debug("=== Build environment for %s ===", pkg.Name)
 		logEnvironment(pkgEnv.ToSlice())
 		if !b.builderCfg.DryRun {
-			buildOutputTmp, err := b.runScript(pkg.Name, ScriptTypeBuild, pkg.Build, pkgEnv.ToSlice())
+			buildOutput, err = b.compile(ctx, pkg, pkgEnv.ToSlice())
+			for attempt := 1; err != nil && attempt <= b.builderCfg.BuildRetries; attempt++ {
+				if ctx.Err() != nil || b.isStopped() {
+					break
+				}
+				b.Warn("%v; retrying from a clean source (%d/%d)", err, attempt, b.builderCfg.BuildRetries)
+				if err := os.RemoveAll(sourceDir); err != nil {
+					b.recordResult(pkg.Name, action, start, err, buildOutput)
+					return fmt.Errorf("failed to clean source for %s: %w", pkg.Name, err)
+				}
+				if output, err := b.prepareSource(ctx, pkg, sourceDir); err != nil {
+					b.recordResult(pkg.Name, action, start, err, output)
+					return err
+				}
+				buildOutput, err = b.compile(ctx, pkg, pkgEnv.ToSlice())
+			}
 			if err != nil {
-				b.recordResult(pkg.Name, false, err, buildOutputTmp)
-				return fmt.Errorf("failed to build %s: %w", pkg.Name, err)
+				// Record the script's own error, as for install failures
+				b.recordResult(pkg.Name, action, start, errors.Unwrap(err), buildOutput)
+				return err
 			}
-			buildOutput = buildOutputTmp
+
 			if err := b.cache.WriteBuild(pkg.Name, b.sysroot, b.host, pkg); err != nil {
-				b.Warn("failed to write build info for %s: %v", pkg.Name, err)
+				if err := b.strictWarn("failed to write build info for %s: %v", pkg.Name, err); err != nil {
+					b.recordResult(pkg.Name, action, start, err, buildOutput)
+					return err
+				}
 			}
 
 			if err := b.cache.InvalidateDependents(pkg.Name, b.config); err != nil {
-				b.Warn("failed to invalidate dependents for %s: %v", pkg.Name, err)
+				if err := b.strictWarn("failed to invalidate dependents for %s: %v", pkg.Name, err); err != nil {
+					b.recordResult(pkg.Name, action, start, err, buildOutput)
+					return err
+				}
+			}
+		} else if cached == nil {
+			if pkg.PreBuild != "" {
+				b.Info("  [DRY RUN] Would run pre-build commands:")
+				for _, line := range strings.Split(pkg.PreBuild, "\n") {
+					if strings.TrimSpace(line) != "" {
+						b.Info("    %s", line)
+					}
+				}
 			}
-		} else {
 			b.Info("  [DRY RUN] Would run build commands:")
 			for _, line := range strings.Split(pkg.Build, "\n") {
 				if strings.TrimSpace(line) != "" {
 					b.Info("    %s", line)
 				}
 			}
+			if pkg.PostBuild != "" {
+				b.Info("  [DRY RUN] Would run post-build commands:")
+				for _, line := range strings.Split(pkg.PostBuild, "\n") {
+					if strings.TrimSpace(line) != "" {
+						b.Info("    %s", line)
+					}
+				}
+			}
 			b.rebuiltMutex.Lock()
 			b.rebuiltPackages[pkg.Name] = true
 			b.rebuiltMutex.Unlock()
 		}
 	} else {
 		b.Info("  %s is already built, reinstalling to new sysroot...", pkg.Name)
+		b.setSourceDateEpoch(pkg, pkgEnv)
+	}
+
+	if b.builderCfg.BuildOnly {
+		b.recordResult(pkg.Name, action, start, nil, buildOutput)
+		b.Info("  %s built, not installing", pkg.Name)
+		return nil
 	}
 
 	b.Info("  Installing %s...", pkg.Name)
+	b.emit(PackageEvent{Package: pkg.Name, Phase: PhaseInstalling})
 	b.Debug("=== Install environment for %s ===", pkg.Name)
 	logEnvironment(pkgEnv.ToSlice())
 	if !b.builderCfg.DryRun {
-		installOutput, err = b.runScript(pkg.Name, ScriptTypeInstall, pkg.Install, pkgEnv.ToSlice())
+		installOutput, err = b.runScript(ctx, pkg, ScriptTypeInstall, pkg.Install, pkgEnv.ToSlice())
 		if err != nil {
-			b.recordResult(pkg.Name, false, err, buildOutput+"\n"+installOutput)
+			b.recordResult(pkg.Name, action, start, err, buildOutput+"\n"+installOutput)
 			return fmt.Errorf("failed to install %s: %w", pkg.Name, err)
 		}
 
+		if pkg.PostInstall != "" {
+			b.Info("  Running post-install script for %s...", pkg.Name)
+			postInstallOutput, err := b.runScript(ctx, pkg, ScriptTypePostInstall, pkg.PostInstall, pkgEnv.ToSlice())
+			installOutput += "\n" + postInstallOutput
+			if err != nil {
+				b.recordResult(pkg.Name, action, start, err, buildOutput+"\n"+installOutput)
+				return fmt.Errorf("failed to run post-install script for %s: %w", pkg.Name, err)
+			}
+		}
+
 		if err := b.cache.WriteInstall(pkg.Name, b.sysroot, b.host, pkg); err != nil {
-			b.Warn("failed to write install cache for %s: %v", pkg.Name, err)
+			if err := b.strictWarn("failed to write install cache for %s: %v", pkg.Name, err); err != nil {
+				b.recordResult(pkg.Name, action, start, err, buildOutput+"\n"+installOutput)
+				return err
+			}
 		}
-	} else {
+
+		if err := b.writeArtifactManifest(pkg); err != nil {
+			if err := b.strictWarn("%v", err); err != nil {
+				b.recordResult(pkg.Name, action, start, err, buildOutput+"\n"+installOutput)
+				return err
+			}
+		}
+	} else if cached == nil {
 		b.Info("  [DRY RUN] Would run install commands:")
 		for _, line := range strings.Split(pkg.Install, "\n") {
 			if strings.TrimSpace(line) != "" {
 				b.Info("    %s", line)
 			}
 		}
+		if pkg.PostInstall != "" {
+			b.Info("  [DRY RUN] Would run post-install commands:")
+			for _, line := range strings.Split(pkg.PostInstall, "\n") {
+				if strings.TrimSpace(line) != "" {
+					b.Info("    %s", line)
+				}
+			}
+		}
+	}
+
+	if b.builderCfg.DiscardSource {
+		if !b.builderCfg.DryRun {
+			b.Debug("  Discarding source for %s", pkg.Name)
+			if err := b.cache.Clean(pkg.Name); err != nil {
+				b.Warn("failed to discard source for %s: %v", pkg.Name, err)
+			} else if err := b.cache.MarkSourceDiscarded(pkg.Name); err != nil {
+				if err := b.strictWarn("failed to write cache for %s: %v", pkg.Name, err); err != nil {
+					b.recordResult(pkg.Name, action, start, err, buildOutput+"\n"+installOutput)
+					return err
+				}
+			}
+		} else {
+			b.Info("  [DRY RUN] Would discard source for %s", pkg.Name)
+		}
 	}
 
 	fullOutput := buildOutput + "\n" + installOutput
-	b.recordResult(pkg.Name, true, nil, fullOutput)
+	b.recordResult(pkg.Name, action, start, nil, fullOutput)
 	b.Info("  %s built successfully", pkg.Name)
 	return nil
 }
 
-func (b *Builder) runScript(pkgName string, scriptType ScriptType, script string, env []string) (string, error) {
+// applyPatches applies the package's patches in order with patch -p1 in
+// sourceDir. On failure it returns the output of the failing patch.
+func (b *Builder) applyPatches(ctx context.Context, pkg *config.Package, sourceDir string) (string, error) {
+	for _, patch := range pkg.Patches {
+		b.Info("  Applying patch %s...", filepath.Base(patch))
+		cmd := exec.CommandContext(ctx, "patch", "-p1", "--forward", "-i", patch)
+		cmd.Dir = sourceDir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return string(output), fmt.Errorf("failed to apply patch %s to %s: %w\n%s",
+				patch, pkg.Name, err, strings.TrimSpace(string(output)))
+		}
+		b.Debug("%s", strings.TrimSpace(string(output)))
+	}
+	return "", nil
+}
+
+// checkInstallable returns an error if pkg has no previous build to install
+// without building it.
+func (b *Builder) checkInstallable(pkg *config.Package) error {
+	info, err := b.cache.Read(pkg.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read cache for %s: %w", pkg.Name, err)
+	}
+	if info == nil {
+		return fmt.Errorf("%s has never been built (build it first or omit --install-only)", pkg.Name)
+	}
+	if _, err := os.Stat(filepath.Join(b.buildDir, pkg.Name, "source")); os.IsNotExist(err) {
+		return fmt.Errorf("source of %s was discarded (rebuild it first or omit --install-only)", pkg.Name)
+	}
+	return nil
+}
+
+// packageEnv returns the environment the build and install scripts of pkg
+// run in. Native packages are built with the host compiler, so the sysroot's
+// headers and libraries are not added to their search paths.
+func (b *Builder) packageEnv(pkg *config.Package) env.Env {
+	sysroot := b.sysroot
+	if pkg.Native {
+		sysroot = ""
+	}
+	pkgEnv := b.envManager.EnvironmentForPackage(pkg.Name, pkg.Version, b.config.Env, pkg.Env, sysroot, b.makeJobs(pkg))
+	if pkg.Native {
+		pkgEnv.Set("PKG_NATIVE", "1")
+	} else {
+		pkgEnv.Set("PKG_NATIVE", "0")
+		b.toolEnv.AddToEnv(pkgEnv)
+	}
+	if b.builderCfg.CCache {
+		env.UseCCache(pkgEnv, filepath.Join(b.buildDir, ccacheDirName))
+	}
+	pkgEnv.Set("PKG_SOURCE_DIR", filepath.Join(b.buildDir, pkg.Name, "source"))
+	b.setArchiveEnv(pkg, pkgEnv)
+	if epoch := cmp.Or(b.builderCfg.SourceDateEpoch, pkg.SourceDateEpoch); epoch != "" {
+		pkgEnv.Set("SOURCE_DATE_EPOCH", epoch)
+	}
+	for _, dep := range pkg.OptionalDepends {
+		have := "0"
+		if depPkg := b.config.GetPackageByName(dep); depPkg != nil && depPkg.IsEnabled() && depPkg.SupportsArch(b.config.Toolchain.Arch) {
+			have = "1"
+		}
+		pkgEnv.Set(haveEnvVar(dep), have)
+	}
+	return pkgEnv
+}
+
+// makeJobs returns the number of make jobs for pkg: its make_jobs if set,
+// otherwise the number for every package.
+func (b *Builder) makeJobs(pkg *config.Package) int {
+	return cmp.Or(pkg.MakeJobs, b.builderCfg.MakeJobs)
+}
+
+// setSourceDateEpoch sets SOURCE_DATE_EPOCH in pkgEnv once the source of
+// pkg is in place. Unless it is fixed, it is the date of the source fetched
+// during this run, or else the date recorded by the previous build, so that
+// it stays the same as long as the source does.
+func (b *Builder) setSourceDateEpoch(pkg *config.Package, pkgEnv env.Env) {
+	if b.builderCfg.SourceDateEpoch != "" {
+		pkg.SourceDateEpoch = b.builderCfg.SourceDateEpoch
+	} else if pkg.SourceDateEpoch == "" {
+		if info, err := b.cache.Read(pkg.Name); err == nil && info != nil && info.SourceDateEpoch != "" {
+			pkg.SourceDateEpoch = info.SourceDateEpoch
+		} else if date := b.downloader.SourceDate(pkg.Name, pkg.URL, primarySource(pkg)); !date.IsZero() {
+			pkg.SourceDateEpoch = strconv.FormatInt(date.Unix(), 10)
+		}
+	}
+	if pkg.SourceDateEpoch != "" {
+		pkgEnv.Set("SOURCE_DATE_EPOCH", pkg.SourceDateEpoch)
+	}
+}
+
+// setArchiveEnv sets PKG_ARCHIVE in pkgEnv to the archive the source of pkg
+// was extracted from, if there is one.
+func (b *Builder) setArchiveEnv(pkg *config.Package, pkgEnv env.Env) {
+	url := pkg.SourceURL
+	if url == "" {
+		if info, err := b.cache.Read(pkg.Name); err == nil && info != nil && pkg.HasURL(info.URL) {
+			url = info.URL
+		}
+	}
+	if archive := b.downloader.ArchivePath(pkg.Name, cmp.Or(url, pkg.URL), primarySource(pkg)); archive != "" {
+		pkgEnv.Set("PKG_ARCHIVE", archive)
+	}
+}
+
+// Environment returns the sorted NAME=VALUE environment the build and install
+// scripts of the named package would run in, without building anything.
+func (b *Builder) Environment(pkgName string) ([]string, error) {
+	pkg := b.config.GetPackageByName(pkgName)
+	if pkg == nil {
+		return nil, fmt.Errorf("package '%s' not found in configuration", pkgName)
+	}
+	pkg.Subst(b.envManager)
+
+	environ := b.packageEnv(pkg).ToSlice()
+	slices.Sort(environ)
+	return environ, nil
+}
+
+// crossDependencies returns the build dependencies of a native package that
+// are built with the cross toolchain. Their headers and libraries are
+// installed into the sysroot, which native packages do not search.
+func (b *Builder) crossDependencies(pkg *config.Package) []string {
+	if !pkg.Native || b.config.Toolchain.CrossPrefix == "" {
+		return nil
+	}
+	var cross []string
+	for _, dep := range pkg.BuildDependencies() {
+		if depPkg := b.config.GetPackageByName(dep); depPkg != nil && !depPkg.Native {
+			cross = append(cross, dep)
+		}
+	}
+	return cross
+}
+
+// buildTriple returns the triple of the machine makepkg runs on, as reported
+// by the host C compiler, or "" if there is none.
+func buildTriple() string {
+	out, err := exec.Command("cc", "-dumpmachine").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// haveEnvVar returns the name of the variable that tells the scripts of a
+// package whether its optional dependency pkgName is available.
+func haveEnvVar(pkgName string) string {
+	return "HAVE_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, pkgName)
+}
+
+// prepareSource downloads and extracts the sources of pkg into sourceDir and
+// applies its patches, returning the output of the patch scripts.
+func (b *Builder) prepareSource(ctx context.Context, pkg *config.Package, sourceDir string) (string, error) {
+	if pkg.SourceDir != "" {
+		b.Info("  Using source directory %s...", pkg.SourceDir)
+	} else {
+		b.Info("  Downloading %s...", pkg.Name)
+	}
+	b.emit(PackageEvent{Package: pkg.Name, Phase: PhaseDownloading})
+	if err := b.fetchSources(ctx, pkg, sourceDir); err != nil {
+		return "", err
+	}
+	output, err := b.applyPatches(ctx, pkg, sourceDir)
+	if err != nil {
+		// Start from a fresh extraction next time rather than a partially patched tree.
+		os.RemoveAll(sourceDir)
+	}
+	return output, err
+}
+
+// compile runs the pre-build, build and post-build scripts of pkg, returning
+// their combined output.
+func (b *Builder) compile(ctx context.Context, pkg *config.Package, env []string) (string, error) {
+	var buildOutput string
+	if pkg.PreBuild != "" {
+		b.Info("  Running pre-build script for %s...", pkg.Name)
+		preBuildOutput, err := b.runScript(ctx, pkg, ScriptTypePreBuild, pkg.PreBuild, env)
+		if err != nil {
+			return preBuildOutput, fmt.Errorf("failed to run pre-build script for %s: %w", pkg.Name, err)
+		}
+		buildOutput = preBuildOutput + "\n"
+	}
+
+	output, err := b.runScript(ctx, pkg, ScriptTypeBuild, pkg.Build, env)
+	buildOutput += output
+	if err != nil {
+		return buildOutput, fmt.Errorf("failed to build %s: %w", pkg.Name, err)
+	}
+
+	if pkg.PostBuild != "" {
+		b.Info("  Running post-build script for %s...", pkg.Name)
+		postBuildOutput, err := b.runScript(ctx, pkg, ScriptTypePostBuild, pkg.PostBuild, env)
+		buildOutput += "\n" + postBuildOutput
+		if err != nil {
+			return buildOutput, fmt.Errorf("failed to run post-build script for %s: %w", pkg.Name, err)
+		}
+	}
+	return buildOutput, nil
+}
+
+// primarySource returns the package's source, without its additional sources.
+func primarySource(pkg *config.Package) download.Source {
+	return download.Source{
+		URL:             pkg.URL,
+		Mirrors:         pkg.Mirrors,
+		VCS:             pkg.VCS,
+		GitRef:          pkg.GitRef,
+		GitCommit:       pkg.GitCommit,
+		GitSubmodules:   pkg.GitSubmodules,
+		Headers:         pkg.HTTPHeaders,
+		StripComponents: pkg.Strip(),
+		Filename:        pkg.Filename,
+		Dir:             pkg.SourceDir,
+		Copy:            pkg.SourceCopy,
+	}
+}
+
+// fetchSources downloads and extracts the package's primary source into
+// sourceDir, followed by any additional sources into their destinations.
+func (b *Builder) fetchSources(ctx context.Context, pkg *config.Package, sourceDir string) error {
+	src := primarySource(pkg)
+	if info, err := b.cache.Read(pkg.Name); err == nil && info != nil && pkg.HasURL(info.URL) {
+		src.ArchiveSum = info.ArchiveSum
+	}
+	sourceURL, err := b.downloader.Download(ctx, pkg.Name, src)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", pkg.Name, err)
+	}
+	pkg.SourceURL = sourceURL
+	pkg.ArchiveSum = b.downloader.ArchiveSum(pkg.Name, sourceURL, src)
+	if date := b.downloader.SourceDate(pkg.Name, sourceURL, src); !date.IsZero() {
+		pkg.SourceDateEpoch = strconv.FormatInt(date.Unix(), 10)
+	}
+	if src.IsGit(sourceURL) {
+		commit, err := download.GitHead(sourceDir)
+		if err != nil {
+			if err := b.strictWarn("failed to resolve commit for %s: %v", pkg.Name, err); err != nil {
+				return err
+			}
+		}
+		pkg.SourceCommit = commit
+	}
+	if err := b.downloader.Extract(pkg.Name, sourceURL, src); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", pkg.Name, err)
+	}
+
+	for _, extra := range pkg.Sources {
+		src := download.Source{
+			URL:             extra.URL,
+			Headers:         pkg.HTTPHeaders,
+			Dest:            extra.Dest,
+			StripComponents: pkg.Strip(),
+		}
+		url, err := b.downloader.Download(ctx, pkg.Name, src)
+		if err != nil {
+			return fmt.Errorf("failed to download %s for %s: %w", extra.URL, pkg.Name, err)
+		}
+		if err := b.downloader.Extract(pkg.Name, url, src); err != nil {
+			return fmt.Errorf("failed to extract %s for %s: %w", extra.URL, pkg.Name, err)
+		}
+	}
+	return nil
+}
+
+// runScript runs a package script in the package's source directory. The
+// script runs in its own process group, which is terminated when ctx is
+// canceled so that no grandchildren are left behind.
+func (b *Builder) runScript(ctx context.Context, pkg *config.Package, scriptType ScriptType, script string, env []string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	pkgName := pkg.Name
+	shell := pkg.ScriptShell()
 	sourceDir := filepath.Join(b.buildDir, pkgName, "source")
 	b.Debug("Running script in directory: %s", sourceDir)
 	b.Debug("Script content:\n%s", script)
 
-	fullScript := GetScriptPreamble(scriptType) + script
-	cmd := exec.Command("bash", "-c", fullScript)
+	fullScript := GetScriptPreamble(scriptType, shell, b.preamble) + script
+	cmd := exec.Command(shell, "-c", fullScript)
 	cmd.Dir = sourceDir
 	cmd.Env = env
 
 	var outputBuf bytes.Buffer
-	var combinedOutput io.Writer = &outputBuf
+	writers := []io.Writer{&outputBuf}
+
+	if logFile, err := b.openLog(pkgName, scriptType); err != nil {
+		b.Warn("failed to open log file for %s: %v", pkgName, err)
+	} else {
+		defer logFile.Close()
+		writers = append(writers, logFile)
+	}
 
 	if !b.builderCfg.Quiet {
-		combinedOutput = io.MultiWriter(&outputBuf, os.Stdout)
+		writers = append(writers, os.Stdout)
 	}
+	combinedOutput := io.MultiWriter(writers...)
 
 	cmd.Stdout = combinedOutput
 	cmd.Stderr = combinedOutput
 
-	b.Debug("Executing command: bash -c <script>")
-	err := cmd.Run()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	b.Debug("Executing command: %s -c <script>", shell)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Debug("Terminating process group %d for %s", cmd.Process.Pid, pkgName)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			select {
+			case <-done:
+			case <-time.After(killGracePeriod):
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			}
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	close(done)
 	if err != nil {
 		b.Debug("Command failed with error: %v", err)
 	} else {
@@ -502,16 +1482,134 @@ func (b *Builder) runScript(pkgName string, scriptType ScriptType, script string
 	return outputBuf.String(), err
 }
 
-func (b *Builder) recordResult(pkgName string, success bool, err error, output string) {
+// openLog opens the log file for a package script. Logs are created fresh on
+// each run, except that post-build and post-install output is appended to the
+// build and install logs.
+func (b *Builder) openLog(pkgName string, scriptType ScriptType) (*os.File, error) {
+	logDir := b.builderCfg.LogDir
+	if logDir == "" {
+		logDir = b.buildDir
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	name := string(scriptType)
+	switch scriptType {
+	case ScriptTypePostBuild:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		name = string(ScriptTypeBuild)
+	case ScriptTypePostInstall:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		name = string(ScriptTypeInstall)
+	}
+
+	path := filepath.Join(logDir, pkgName, name+".log")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flags, 0644)
+}
+
+// dependencyBuilt reports whether any dependency of pkg was built or
+// reinstalled in this build.
+func (b *Builder) dependencyBuilt(pkg *config.Package) bool {
 	b.resultsMutex.Lock()
 	defer b.resultsMutex.Unlock()
 
+	for _, result := range b.results {
+		if result.Success && result.Action != ActionSkipped && slices.Contains(pkg.BuildDependencies(), result.Package) {
+			return true
+		}
+	}
+	return false
+}
+
+// failedDependency returns the first build dependency of pkg that failed or
+// was skipped because its own dependencies failed, or "" if there is none.
+func (b *Builder) failedDependency(pkg *config.Package) string {
+	b.resultsMutex.Lock()
+	defer b.resultsMutex.Unlock()
+
+	for _, dep := range pkg.BuildDependencies() {
+		for _, result := range b.results {
+			if result.Package == dep && !result.Success {
+				return dep
+			}
+		}
+	}
+	return ""
+}
+
+// strictWarn reports a recoverable but suspicious condition. It logs a
+// warning and returns nil, or in strict mode returns the message as an error
+// for the caller to fail with instead.
+func (b *Builder) strictWarn(format string, args ...any) error {
+	if b.builderCfg.Strict {
+		return fmt.Errorf(format, args...)
+	}
+	b.Warn(format, args...)
+	return nil
+}
+
+// recordSkipped records a package that was left out of the build for reason.
+// Packages skipped because they could not be built are recorded as failed.
+func (b *Builder) recordSkipped(pkgName, reason string, success bool) {
+	b.resultsMutex.Lock()
+
 	b.results = append(b.results, Result{
 		Package: pkgName,
 		Success: success,
-		Error:   err,
-		Output:  output,
+		Action:  ActionSkipped,
+		Reason:  reason,
 	})
+	b.resultsMutex.Unlock()
+
+	if success {
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseSkipped, Reason: reason})
+	} else {
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseFailed, Reason: reason, Error: errors.New(reason)})
+	}
+}
+
+func (b *Builder) recordResult(pkgName string, action Action, start time.Time, err error, output string) {
+	var duration time.Duration
+	if !b.dryRun {
+		duration = time.Since(start)
+	}
+
+	b.resultsMutex.Lock()
+	b.results = append(b.results, Result{
+		Package:  pkgName,
+		Success:  err == nil,
+		Action:   action,
+		Duration: duration,
+		Error:    err,
+		Output:   output,
+	})
+	b.resultsMutex.Unlock()
+
+	switch {
+	case err != nil:
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseFailed, Error: err})
+	case action == ActionSkipped:
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseSkipped, Reason: "up to date"})
+	case b.builderCfg.BuildOnly:
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseBuilt})
+	default:
+		b.emit(PackageEvent{Package: pkgName, Phase: PhaseInstalled})
+	}
+}
+
+// elapsed returns the wall-clock time of the last build, or zero in dry-run
+// mode.
+func (b *Builder) elapsed() time.Duration {
+	if b.dryRun || b.buildStart.IsZero() {
+		return 0
+	}
+	end := b.buildEnd
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(b.buildStart)
 }
 
 func (b *Builder) stop() {
@@ -536,7 +1634,7 @@ func (b *Builder) addDependenciesToFilter(pkgName string, filterSet map[string]b
 		return
 	}
 
-	for _, dep := range pkg.DependsOn {
+	for _, dep := range pkg.Dependencies() {
 		if !filterSet[dep] {
 			filterSet[dep] = true
 			b.addDependenciesToFilter(dep, filterSet)
@@ -544,6 +1642,54 @@ func (b *Builder) addDependenciesToFilter(pkgName string, filterSet map[string]b
 	}
 }
 
+// checkDependenciesBuilt verifies that every dependency of the named packages
+// that is not itself being built has already been built and cached.
+func (b *Builder) checkDependenciesBuilt(packageNames []string, filterSet map[string]bool) error {
+	for _, pkgName := range packageNames {
+		pkg := b.config.GetPackageByName(pkgName)
+		if pkg == nil {
+			continue
+		}
+
+		for _, dep := range pkg.BuildDependencies() {
+			if filterSet[dep] {
+				continue
+			}
+			if depPkg := b.config.GetPackageByName(dep); depPkg != nil && !depPkg.SupportsArch(b.config.Toolchain.Arch) {
+				continue
+			}
+			info, err := b.cache.Read(dep)
+			if err != nil {
+				return fmt.Errorf("failed to read cache for %s: %w", dep, err)
+			}
+			if info == nil {
+				return fmt.Errorf("%s depends on %s, which has not been built (build it first or omit --only)", pkgName, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// excludedPackages returns the packages named by the Exclude option and the
+// enabled packages that depend on them, mapped to the reason each is left
+// out of the build.
+func (b *Builder) excludedPackages() map[string]string {
+	excluded := make(map[string]string)
+	for _, name := range b.builderCfg.Exclude {
+		excluded[name] = "excluded"
+	}
+	for _, name := range b.builderCfg.Exclude {
+		for _, dependent := range b.config.Dependents(name) {
+			pkg := b.config.GetPackageByName(dependent)
+			if _, ok := excluded[dependent]; ok || !pkg.IsEnabled() || !pkg.SupportsArch(b.config.Toolchain.Arch) {
+				continue
+			}
+			excluded[dependent] = fmt.Sprintf("depends on excluded package %s", name)
+		}
+	}
+	return excluded
+}
+
 func (b *Builder) filterPackages(packages []string, filterSet map[string]bool) []string {
 	filtered := make([]string, 0, len(packages))
 	for _, pkgName := range packages {
@@ -560,7 +1706,7 @@ func (b *Builder) buildRequiredByMap(filterSet map[string]bool) {
 			continue
 		}
 
-		for _, dep := range pkg.DependsOn {
+		for _, dep := range pkg.Dependencies() {
 			if len(filterSet) == 0 || filterSet[dep] {
 				b.requiredBy[dep] = append(b.requiredBy[dep], pkg.Name)
 			}
@@ -580,12 +1726,20 @@ func formatRequiredBy(requiredBy []string) string {
 	return fmt.Sprintf(" (required by %s)", strings.Join(requiredBy, ", "))
 }
 
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
 func logEnvironment(env []string) {
 	importantVars := []string{
 		"PATH", "CC", "CXX", "AR", "LD", "AS", "NM", "RANLIB", "STRIP",
 		"CFLAGS", "CXXFLAGS", "LDFLAGS", "CPPFLAGS",
 		"PKG_CONFIG_PATH", "PKG_CONFIG_SYSROOT_DIR",
-		"SYS_ROOT", "INSTALL_ROOT", "PKGS_HOST",
+		"SYS_ROOT", "INSTALL_ROOT", "PKGS_HOST", "PKGS_BUILD", "PKG_NATIVE",
+		"PKG_SOURCE_DIR", "PKG_ARCHIVE", "SOURCE_DATE_EPOCH",
 		"LIBRARY_PATH", "LD_LIBRARY_PATH",
 		"BUILD_ARTIFACTS", "MAKEPKG",
 	}
@@ -0,0 +1,391 @@
+package build
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+func TestBuilder_Exclude(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"b"}},
+			{Name: "d", URL: "http://d", Build: "make", Install: "make install"},
+			{Name: "e", URL: "http://e", Build: "make", Install: "make install", RuntimeDepends: []string{"a"}},
+		},
+	}
+
+	newBuilder := func() *Builder {
+		t.Helper()
+		dir := t.TempDir()
+		builderCfg := BuilderConfig{DryRun: true, Exclude: []string{"a"}}
+		builder, err := NewBuilder(builderCfg, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+		if err != nil {
+			t.Fatalf("NewBuilder failed: %v", err)
+		}
+		t.Cleanup(func() { builder.Close() })
+		return builder
+	}
+
+	builder := newBuilder()
+	if err := builder.Build(context.Background(), nil); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"a": "excluded",
+		"b": "depends on excluded package a",
+		"c": "depends on excluded package a",
+	}
+	results := make(map[string]Result)
+	for _, result := range builder.results {
+		results[result.Package] = result
+	}
+	for name, reason := range expected {
+		result := results[name]
+		if result.Action != ActionSkipped || !result.Success || result.Reason != reason {
+			t.Errorf("Expected %s to be skipped because it %s, got %+v", name, reason, result)
+		}
+	}
+	for _, name := range []string{"d", "e"} {
+		if result := results[name]; result.Action != ActionBuilt || !result.Success {
+			t.Errorf("Expected %s to be built, got %+v", name, result)
+		}
+	}
+
+	if err := newBuilder().Build(context.Background(), []string{"c"}); err == nil {
+		t.Error("Expected an error when requesting a package that depends on an excluded package")
+	}
+	if err := newBuilder().Build(context.Background(), []string{"e"}); err == nil {
+		t.Error("Expected an error when requesting a package that needs an excluded package at runtime")
+	}
+	if err := newBuilder().Build(context.Background(), []string{"d"}); err != nil {
+		t.Errorf("Expected a package unrelated to the excluded one to build, got %v", err)
+	}
+}
+
+func TestBuilder_NativeEnv(t *testing.T) {
+	cfg := &config.Config{
+		Toolchain: config.Toolchain{CrossPrefix: "aarch64-linux-gnu-"},
+		Packages: []config.Package{
+			{Name: "zlib", URL: "http://zlib", Build: "make", Install: "make install"},
+			{Name: "tool", URL: "http://tool", Build: "make", Install: "make install", Native: true, DependsOn: []string{"zlib"}},
+		},
+	}
+	dir := t.TempDir()
+	sysroot := filepath.Join(dir, "sysroot")
+	builder, err := NewBuilder(BuilderConfig{DryRun: true}, cfg, filepath.Join(dir, "build"), sysroot, "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	for _, tt := range []struct {
+		pkg          string
+		native       string
+		searchesRoot bool
+	}{
+		{"zlib", "0", true},
+		{"tool", "1", false},
+	} {
+		environ, err := builder.Environment(tt.pkg)
+		if err != nil {
+			t.Fatalf("Environment(%s) failed: %v", tt.pkg, err)
+		}
+		if !slices.Contains(environ, "PKG_NATIVE="+tt.native) {
+			t.Errorf("Expected PKG_NATIVE=%s for %s", tt.native, tt.pkg)
+		}
+		searchesRoot := slices.ContainsFunc(environ, func(e string) bool {
+			return strings.HasPrefix(e, "CFLAGS=") && strings.Contains(e, "-I"+sysroot)
+		})
+		if searchesRoot != tt.searchesRoot {
+			t.Errorf("Expected CFLAGS of %s to search the sysroot: %v, got %v", tt.pkg, tt.searchesRoot, searchesRoot)
+		}
+	}
+
+	if cross := builder.crossDependencies(cfg.GetPackageByName("tool")); !slices.Equal(cross, []string{"zlib"}) {
+		t.Errorf("Expected tool to depend on cross compiled zlib, got %v", cross)
+	}
+	if cross := builder.crossDependencies(cfg.GetPackageByName("zlib")); cross != nil {
+		t.Errorf("Expected no cross dependencies for a package that is not native, got %v", cross)
+	}
+}
+
+func TestBuilder_SourceEnv(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "foo", URL: "http://example.com/foo-1.0.tar.gz", Build: "make", Install: "make install"},
+			{Name: "bar", URL: "https://example.com/bar.git", Build: "make", Install: "make install"},
+		},
+	}
+	buildDir := t.TempDir()
+	builder, err := NewBuilder(BuilderConfig{DryRun: true}, cfg, buildDir, t.TempDir(), "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	archive := filepath.Join(buildDir, "foo", "foo-1.0.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		pkg     string
+		archive string
+	}{
+		{"foo", archive},
+		{"bar", ""},
+	} {
+		environ, err := builder.Environment(tt.pkg)
+		if err != nil {
+			t.Fatalf("Environment(%s) failed: %v", tt.pkg, err)
+		}
+		if sourceDir := filepath.Join(buildDir, tt.pkg, "source"); !slices.Contains(environ, "PKG_SOURCE_DIR="+sourceDir) {
+			t.Errorf("Expected PKG_SOURCE_DIR=%s for %s", sourceDir, tt.pkg)
+		}
+		i := slices.IndexFunc(environ, func(e string) bool { return strings.HasPrefix(e, "PKG_ARCHIVE=") })
+		if tt.archive == "" && i >= 0 {
+			t.Errorf("Expected no PKG_ARCHIVE for %s, got %s", tt.pkg, environ[i])
+		} else if tt.archive != "" && (i < 0 || environ[i] != "PKG_ARCHIVE="+tt.archive) {
+			t.Errorf("Expected PKG_ARCHIVE=%s for %s", tt.archive, tt.pkg)
+		}
+	}
+}
+
+func TestBuilder_MakeJobs(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "foo", URL: "http://foo", Build: "make", Install: "make install"},
+			{Name: "racy", URL: "http://racy", Build: "make", Install: "make install", MakeJobs: 1},
+		},
+	}
+	builder, err := NewBuilder(BuilderConfig{DryRun: true, MakeJobs: 4}, cfg, t.TempDir(), t.TempDir(), "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	for pkg, makeflags := range map[string]string{"foo": "-j4", "racy": "-j1"} {
+		environ, err := builder.Environment(pkg)
+		if err != nil {
+			t.Fatalf("Environment(%s) failed: %v", pkg, err)
+		}
+		if !slices.Contains(environ, "MAKEFLAGS="+makeflags) {
+			t.Errorf("Expected MAKEFLAGS=%s for %s", makeflags, pkg)
+		}
+	}
+}
+
+func TestBuilder_AssertClean(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Toolchain: config.Toolchain{Arch: "x86_64"},
+		Packages: []config.Package{
+			{Name: "foo", SourceDir: t.TempDir(), Build: "true", Install: "true"},
+			{Name: "armonly", SourceDir: t.TempDir(), Build: "true", Install: "true", OnlyArch: []string{"aarch64"}},
+			{Name: "excluded", SourceDir: t.TempDir(), Build: "true", Install: "true"},
+		},
+	}
+	buildDir, sysroot := t.TempDir(), t.TempDir()
+
+	for _, builderCfg := range []BuilderConfig{
+		{BuildOnly: true, Exclude: []string{"excluded"}},
+		{Exclude: []string{"excluded"}},
+	} {
+		builder, err := NewBuilder(builderCfg, cfg, buildDir, sysroot, "", "")
+		if err != nil {
+			t.Fatalf("NewBuilder failed: %v", err)
+		}
+		if err := builder.Build(context.Background(), nil); err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+		if err := builder.AssertClean(); err != nil {
+			t.Errorf("Expected a clean cache with %+v, got %v", builderCfg, err)
+		}
+		builder.Close()
+	}
+}
+
+func TestBuilder_Strict(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make ${UNDEFINED_FLAGS}", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install"},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+		},
+	}
+
+	for _, strict := range []bool{false, true} {
+		dir := t.TempDir()
+		builder, err := NewBuilder(BuilderConfig{DryRun: true, Strict: strict}, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+		if err != nil {
+			t.Fatalf("NewBuilder failed: %v", err)
+		}
+		defer builder.Close()
+
+		err = builder.Build(context.Background(), nil)
+		if !strict {
+			if err != nil {
+				t.Errorf("Expected undefined variables to only warn, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected a strict build to fail only the affected package, got %v", err)
+		}
+		results := make(map[string]Result)
+		for _, result := range builder.results {
+			results[result.Package] = result
+		}
+		if result := results["a"]; result.Success || result.Error == nil || !strings.Contains(result.Error.Error(), "UNDEFINED_FLAGS") {
+			t.Errorf("Expected a to fail on undefined variables, got %+v", result)
+		}
+		if result := results["b"]; !result.Success || result.Action != ActionBuilt {
+			t.Errorf("Expected b to be built, got %+v", result)
+		}
+		if result := results["c"]; result.Success || result.Reason != "dependency a failed" {
+			t.Errorf("Expected c to be skipped because a failed, got %+v", result)
+		}
+	}
+}
+
+func TestBuilder_DestDirWithoutSysroot(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "foo", SourceDir: t.TempDir(), Build: "true", Install: `touch "$INSTALL_ROOT/usr/bin/foo"`},
+		},
+	}
+	destDir := filepath.Join(t.TempDir(), "dest")
+
+	builderCfg := BuilderConfig{DestDir: destDir, SysrootTemplate: FHSTemplate}
+	builder, err := NewBuilder(builderCfg, cfg, t.TempDir(), "", "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	if err := builder.Build(context.Background(), nil); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "usr", "bin", "foo")); err != nil {
+		t.Errorf("Expected foo to be installed into the destdir: %v", err)
+	}
+}
+
+func TestBuilder_DuplicateURLWarning(t *testing.T) {
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Toolchain: config.Toolchain{Arch: "x86_64"},
+		Packages: []config.Package{
+			{Name: "a", URL: "http://example.com/foo.tar.gz", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://example.com/foo.tar.gz", Build: "make", Install: "make install", OnlyArch: []string{"aarch64"}},
+			{Name: "c", URL: "http://example.com/bar.tar.gz", Build: "make", Install: "make install"},
+			{Name: "d", URL: "http://example.com/bar.tar.gz", Build: "make", Install: "make install"},
+		},
+	}
+
+	for _, downloadCache := range []string{"", t.TempDir()} {
+		var output strings.Builder
+		logger.SetOutput(io.Discard)
+		logger.SetErrorOutput(&output)
+
+		dir := t.TempDir()
+		builderCfg := BuilderConfig{DryRun: true, DownloadCache: downloadCache}
+		builder, err := NewBuilder(builderCfg, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+		if err != nil {
+			t.Fatalf("NewBuilder failed: %v", err)
+		}
+		if err := builder.Build(context.Background(), nil); err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+		builder.Close()
+
+		if strings.Contains(output.String(), "packages a, b share") {
+			t.Errorf("Expected no warning for a package not built for the arch, got %q", output.String())
+		}
+		warned := strings.Contains(output.String(), "packages c, d share")
+		if downloadCache == "" && !warned {
+			t.Errorf("Expected a warning for c and d without a download cache, got %q", output.String())
+		} else if downloadCache != "" && warned {
+			t.Errorf("Expected no warning with a download cache, got %q", output.String())
+		}
+	}
+}
+
+func TestBuilder_PrintSummary(t *testing.T) {
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+	defer logger.SetFormat(logger.FormatText)
+	t.Setenv("COLUMNS", "40")
+
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+		},
+	}
+
+	for _, format := range []logger.Format{logger.FormatText, logger.FormatJSON} {
+		var output strings.Builder
+		logger.SetOutput(io.Discard)
+		logger.SetInfoOutput(&output)
+		logger.SetFormat(format)
+
+		dir := t.TempDir()
+		builder, err := NewBuilder(BuilderConfig{DryRun: true}, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+		if err != nil {
+			t.Fatalf("NewBuilder failed: %v", err)
+		}
+		if err := builder.Build(context.Background(), nil); err != nil {
+			t.Fatalf("Build failed: %v", err)
+		}
+		output.Reset()
+		builder.PrintSummary()
+		builder.Close()
+
+		lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+		if format == logger.FormatJSON {
+			if strings.Contains(output.String(), "===") {
+				t.Errorf("Expected no separators in JSON output, got %q", output.String())
+			}
+			continue
+		}
+		for _, line := range lines {
+			if strings.Contains(line, "===") && len(line) > 40 {
+				t.Errorf("Expected separators to fit in 40 columns, got %q", line)
+			}
+		}
+		if !slices.Contains(lines, "[DRY RUN] "+strings.Repeat("=", 30)) {
+			t.Errorf("Expected a separator filling the line after the prefix, got %q", lines)
+		}
+	}
+}
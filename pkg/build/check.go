@@ -0,0 +1,111 @@
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+var (
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// shellAssignment matches the names a script assigns to itself, which
+	// are defined by the time they are referenced.
+	shellAssignment = regexp.MustCompile(`(?:^|[\s;&|(])(?:(?:local|export|readonly|declare)\s+(?:-\w+\s+)*)?([A-Za-z_][A-Za-z0-9_]*)\+?=|\bfor\s+([A-Za-z_][A-Za-z0-9_]*)\s+in\b|\bread\s+(?:-\w+\s+)*([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// shellVariables are set by bash itself.
+var shellVariables = []string{
+	"BASH", "BASHPID", "BASH_SOURCE", "BASH_VERSION", "EUID", "FUNCNAME",
+	"HOSTNAME", "HOSTTYPE", "IFS", "LINENO", "MACHTYPE", "OLDPWD", "OPTARG",
+	"OPTIND", "OSTYPE", "PIPESTATUS", "PPID", "PWD", "RANDOM", "REPLY",
+	"SECONDS", "SHLVL", "UID",
+}
+
+// CheckVariables substitutes the configuration as Build would and returns an
+// error for each reference to an undefined variable in the toolchain or in a
+// package's source fields and env values. Scripts are not checked, since
+// they may refer to shell variables defined at run time.
+func (b *Builder) CheckVariables() []error {
+	var problems []error
+	check := func(field, value string) {
+		// Substitution leaves undefined references in place, so anything
+		// still referenced after substitution is undefined.
+		_, undefined := b.envManager.SubstWarnUndefined(value)
+		for _, name := range undefined {
+			problems = append(problems, fmt.Errorf("%s references undefined variable %s", field, name))
+		}
+	}
+
+	toolchain := b.config.Toolchain
+	check("toolchain arch", toolchain.Arch)
+	check("toolchain bin", toolchain.Bin)
+	check("toolchain cross_prefix", toolchain.CrossPrefix)
+	for _, prog := range toolchain.ExtraPrograms {
+		check("toolchain extra_programs", prog)
+	}
+
+	for i := range b.config.Packages {
+		pkg := &b.config.Packages[i]
+		pkg.Subst(b.envManager)
+
+		prefix := "package " + pkg.Name + " "
+		for _, url := range pkg.URLs() {
+			check(prefix+"url", url)
+		}
+		check(prefix+"version", pkg.Version)
+		check(prefix+"filename", pkg.Filename)
+		check(prefix+"source_dir", pkg.SourceDir)
+		check(prefix+"git_ref", pkg.GitRef)
+		check(prefix+"git_commit", pkg.GitCommit)
+		for _, src := range pkg.Sources {
+			check(prefix+"source url", src.URL)
+			check(prefix+"source dest", src.Dest)
+		}
+		for _, patch := range pkg.Patches {
+			check(prefix+"patches", patch)
+		}
+		for _, e := range pkg.Env {
+			check(prefix+"env", e)
+		}
+	}
+
+	return problems
+}
+
+// undefinedScriptVariables returns the sorted names of the ${VAR} references
+// in the substituted scripts and env entries of pkg that are not defined in
+// the environment its scripts run in, nor assigned by the scripts or the
+// script preamble themselves.
+func (b *Builder) undefinedScriptVariables(pkg *config.Package) []string {
+	scripts := []string{pkg.PreBuild, pkg.Build, pkg.PostBuild, pkg.Install, pkg.PostInstall, pkg.Clean}
+
+	defined := make(map[string]bool)
+	for _, name := range shellVariables {
+		defined[name] = true
+	}
+	for _, script := range append(scripts, b.preamble) {
+		for _, match := range shellAssignment.FindAllStringSubmatch(script, -1) {
+			for _, name := range match[1:] {
+				if name != "" {
+					defined[name] = true
+				}
+			}
+		}
+	}
+
+	pkgEnv := b.packageEnv(pkg)
+	var undefined []string
+	for _, value := range append(scripts, pkg.Env...) {
+		_, names := pkgEnv.SubstWarnUndefined(value)
+		for _, name := range names {
+			if variableName.MatchString(name) && !defined[name] && !slices.Contains(undefined, name) {
+				undefined = append(undefined, name)
+			}
+		}
+	}
+	slices.Sort(undefined)
+	return undefined
+}
@@ -0,0 +1,92 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/env"
+)
+
+const (
+	cmakeToolchainFileName = "toolchain.cmake"
+
+	// cmakeToolchainEnvVar holds the path of the generated CMake toolchain
+	// file. CMake 3.21 and later also read it from the environment, so
+	// cmake picks it up even without -DCMAKE_TOOLCHAIN_FILE.
+	cmakeToolchainEnvVar = "CMAKE_TOOLCHAIN_FILE"
+)
+
+// cmakeSystemNames maps host triple components to CMAKE_SYSTEM_NAME values.
+var cmakeSystemNames = []struct {
+	component string
+	name      string
+}{
+	{"linux", "Linux"},
+	{"darwin", "Darwin"},
+	{"apple", "Darwin"},
+	{"freebsd", "FreeBSD"},
+	{"netbsd", "NetBSD"},
+	{"openbsd", "OpenBSD"},
+	{"mingw", "Windows"},
+	{"windows", "Windows"},
+	{"elf", "Generic"},
+	{"none", "Generic"},
+}
+
+// cmakeSystemName returns the CMAKE_SYSTEM_NAME for a host triple,
+// defaulting to Linux.
+func cmakeSystemName(host string) string {
+	components := strings.Split(host, "-")
+	for _, system := range cmakeSystemNames {
+		for _, component := range components {
+			if strings.HasPrefix(component, system.component) {
+				return system.name
+			}
+		}
+	}
+	return "Linux"
+}
+
+// writeCMakeToolchain writes a CMake toolchain file to path that builds for
+// host with the programs in toolEnv, searching sysroot for libraries, headers
+// and packages but the build machine for programs.
+func writeCMakeToolchain(path string, toolchain *config.Toolchain, toolEnv env.Env, host, sysroot string) error {
+	var sb strings.Builder
+	set := func(name, value string) {
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		fmt.Fprintf(&sb, "set(%s \"%s\")\n", name, value)
+	}
+
+	sb.WriteString("# Generated by makepkg. Do not edit.\n")
+	set("CMAKE_SYSTEM_NAME", cmakeSystemName(host))
+	if toolchain.Arch != "" {
+		set("CMAKE_SYSTEM_PROCESSOR", toolchain.Arch)
+	}
+
+	for _, tool := range []struct{ variable, envVar string }{
+		{"CMAKE_C_COMPILER", "CC"},
+		{"CMAKE_CXX_COMPILER", "CXX"},
+		{"CMAKE_AR", "AR"},
+		{"CMAKE_RANLIB", "RANLIB"},
+		{"CMAKE_STRIP", "STRIP"},
+		{"CMAKE_NM", "NM"},
+		{"CMAKE_OBJCOPY", "OBJCOPY"},
+		{"CMAKE_OBJDUMP", "OBJDUMP"},
+	} {
+		if value, ok := toolEnv.Get(tool.envVar); ok {
+			set(tool.variable, value)
+		}
+	}
+
+	if sysroot != "" {
+		set("CMAKE_FIND_ROOT_PATH", sysroot)
+		set("CMAKE_FIND_ROOT_PATH_MODE_PROGRAM", "NEVER")
+		set("CMAKE_FIND_ROOT_PATH_MODE_LIBRARY", "ONLY")
+		set("CMAKE_FIND_ROOT_PATH_MODE_INCLUDE", "ONLY")
+		set("CMAKE_FIND_ROOT_PATH_MODE_PACKAGE", "ONLY")
+	}
+
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,24 @@
+package build
+
+import "testing"
+
+func TestCMakeSystemName(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"x86_64-linux-musl", "Linux"},
+		{"arm-none-linux-gnueabihf", "Linux"},
+		{"aarch64-apple-darwin", "Darwin"},
+		{"x86_64-w64-mingw32", "Windows"},
+		{"x86_64-unknown-freebsd14", "FreeBSD"},
+		{"arm-none-eabi", "Generic"},
+		{"", "Linux"},
+	}
+
+	for _, tt := range tests {
+		if got := cmakeSystemName(tt.host); got != tt.expected {
+			t.Errorf("cmakeSystemName(%q): expected %q, got %q", tt.host, tt.expected, got)
+		}
+	}
+}
@@ -2,20 +2,27 @@ package build
 
 import (
 	"fmt"
+	"io"
+	"slices"
 
 	"github.com/aar10n/makepkg/pkg/config"
 )
 
 // GetBuildOrder resolves the dependency graph and returns packages in build order.
+// Only build dependencies order the build, and optional dependencies only if
+// they exist. Disabled packages are left out. Each level is sorted by name,
+// so the order is the same on every run.
 // Returns an error if there are circular dependencies or missing dependencies.
 func GetBuildOrder(cfg *config.Config) ([][]string, error) {
+	cfg = excludePackages(cfg, disabledPackages(cfg))
+
 	pkgMap := make(map[string]*config.Package)
 	for i := range cfg.Packages {
 		pkgMap[cfg.Packages[i].Name] = &cfg.Packages[i]
 	}
 
 	for _, pkg := range cfg.Packages {
-		for _, dep := range pkg.DependsOn {
+		for _, dep := range pkg.Dependencies() {
 			if _, exists := pkgMap[dep]; !exists {
 				return nil, fmt.Errorf("package %s depends on non-existent package %s", pkg.Name, dep)
 			}
@@ -25,8 +32,11 @@ func GetBuildOrder(cfg *config.Config) ([][]string, error) {
 	reverseGraph := make(map[string][]string)
 	reverseInDegree := make(map[string]int)
 	for _, pkg := range cfg.Packages {
-		reverseInDegree[pkg.Name] = len(pkg.DependsOn)
-		for _, dep := range pkg.DependsOn {
+		deps := slices.DeleteFunc(pkg.BuildDependencies(), func(dep string) bool {
+			return pkgMap[dep] == nil
+		})
+		reverseInDegree[pkg.Name] = len(deps)
+		for _, dep := range deps {
 			reverseGraph[dep] = append(reverseGraph[dep], pkg.Name)
 		}
 	}
@@ -42,8 +52,8 @@ func GetBuildOrder(cfg *config.Config) ([][]string, error) {
 
 	processed := 0
 	for len(queue) > 0 {
-		level := make([]string, len(queue))
-		copy(level, queue)
+		level := slices.Clone(queue)
+		slices.Sort(level)
 		result = append(result, level)
 
 		newQueue := []string{}
@@ -65,3 +75,107 @@ func GetBuildOrder(cfg *config.Config) ([][]string, error) {
 
 	return result, nil
 }
+
+// RequiredBy returns the enabled packages that depend on the named package,
+// directly or transitively, in build order. These are the packages that are
+// rebuilt when it is. It fails on the same conditions as GetBuildOrder.
+func RequiredBy(cfg *config.Config, pkgName string) ([]string, error) {
+	if cfg.GetPackageByName(pkgName) == nil {
+		return nil, fmt.Errorf("package '%s' not found in configuration", pkgName)
+	}
+	buildOrder, err := GetBuildOrder(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dependents := cfg.Dependents(pkgName)
+	var result []string
+	for _, level := range buildOrder {
+		for _, name := range level {
+			if slices.Contains(dependents, name) {
+				result = append(result, name)
+			}
+		}
+	}
+	return result, nil
+}
+
+// excludePackages returns a copy of cfg without the packages in exclude and
+// without any dependencies on them, so that they can be left out of the build
+// order without failing dependency resolution.
+func excludePackages(cfg *config.Config, exclude map[string]bool) *config.Config {
+	if len(exclude) == 0 {
+		return cfg
+	}
+
+	result := *cfg
+	result.Packages = nil
+	for _, pkg := range cfg.Packages {
+		if exclude[pkg.Name] {
+			continue
+		}
+		excluded := func(dep string) bool { return exclude[dep] }
+		pkg.DependsOn = slices.DeleteFunc(slices.Clone(pkg.DependsOn), excluded)
+		pkg.BuildDepends = slices.DeleteFunc(slices.Clone(pkg.BuildDepends), excluded)
+		pkg.RuntimeDepends = slices.DeleteFunc(slices.Clone(pkg.RuntimeDepends), excluded)
+		pkg.OptionalDepends = slices.DeleteFunc(slices.Clone(pkg.OptionalDepends), excluded)
+		result.Packages = append(result.Packages, pkg)
+	}
+	return &result
+}
+
+// disabledPackages returns the names of the disabled packages in cfg.
+func disabledPackages(cfg *config.Config) map[string]bool {
+	disabled := make(map[string]bool)
+	for _, pkg := range cfg.Packages {
+		if !pkg.IsEnabled() {
+			disabled[pkg.Name] = true
+		}
+	}
+	return disabled
+}
+
+// WriteGraph writes the dependency graph of cfg to w as a Graphviz DOT
+// digraph, with an edge from each package to each of its dependencies.
+// Edges to runtime dependencies are dashed, and edges to optional
+// dependencies that exist are dotted. If rankByLevel is set, packages in the same build level share a rank.
+// Disabled packages are left out. It fails on the same conditions as
+// GetBuildOrder.
+func WriteGraph(w io.Writer, cfg *config.Config, rankByLevel bool) error {
+	cfg = excludePackages(cfg, disabledPackages(cfg))
+	buildOrder, err := GetBuildOrder(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "digraph packages {")
+	fmt.Fprintln(w, "\trankdir=BT;")
+	for _, pkg := range cfg.Packages {
+		fmt.Fprintf(w, "\t%q;\n", pkg.Name)
+	}
+	for _, pkg := range cfg.Packages {
+		for _, dep := range pkg.Dependencies() {
+			if slices.Contains(pkg.RuntimeDepends, dep) && !slices.Contains(pkg.BuildDependencies(), dep) {
+				fmt.Fprintf(w, "\t%q -> %q [style=dashed];\n", pkg.Name, dep)
+			} else {
+				fmt.Fprintf(w, "\t%q -> %q;\n", pkg.Name, dep)
+			}
+		}
+		for _, dep := range pkg.OptionalDepends {
+			if cfg.GetPackageByName(dep) != nil && !slices.Contains(pkg.Dependencies(), dep) {
+				fmt.Fprintf(w, "\t%q -> %q [style=dotted];\n", pkg.Name, dep)
+			}
+		}
+	}
+	if rankByLevel {
+		for i, level := range buildOrder {
+			fmt.Fprintf(w, "\tsubgraph level%d {\n\t\trank=same;\n", i)
+			for _, name := range level {
+				fmt.Fprintf(w, "\t\t%q;\n", name)
+			}
+			fmt.Fprintln(w, "\t}")
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
@@ -1,6 +1,8 @@
 package build
 
 import (
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/aar10n/makepkg/pkg/config"
@@ -58,6 +60,30 @@ func TestBuildOrder_Parallel(t *testing.T) {
 	}
 }
 
+func TestBuildOrder_StableLevels(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "zlib", URL: "http://zlib", Build: "make", Install: "make install"},
+			{Name: "expat", URL: "http://expat", Build: "make", Install: "make install"},
+			{Name: "musl", URL: "http://musl", Build: "make", Install: "make install"},
+			{Name: "png", URL: "http://png", Build: "make", Install: "make install", DependsOn: []string{"zlib"}},
+			{Name: "curl", URL: "http://curl", Build: "make", Install: "make install", DependsOn: []string{"zlib"}},
+			{Name: "bzip2", URL: "http://bzip2", Build: "make", Install: "make install", DependsOn: []string{"musl"}},
+		},
+	}
+
+	expected := [][]string{{"expat", "musl", "zlib"}, {"bzip2", "curl", "png"}}
+	for range 20 {
+		order, err := GetBuildOrder(cfg)
+		if err != nil {
+			t.Fatalf("GetBuildOrder failed: %v", err)
+		}
+		if !slices.EqualFunc(order, expected, slices.Equal) {
+			t.Fatalf("Expected %v, got %v", expected, order)
+		}
+	}
+}
+
 func TestBuildOrder_MultipleDependencies(t *testing.T) {
 	cfg := &config.Config{
 		Packages: []config.Package{
@@ -176,3 +202,162 @@ func TestBuildOrder_ComplexGraph(t *testing.T) {
 		t.Errorf("Level 0 should be 'base', got %v", order[0])
 	}
 }
+
+func TestWriteGraph(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install"},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"a", "b"}},
+		},
+	}
+
+	var buf strings.Builder
+	if err := WriteGraph(&buf, cfg, true); err != nil {
+		t.Fatalf("WriteGraph failed: %v", err)
+	}
+
+	expected := `digraph packages {
+	rankdir=BT;
+	"a";
+	"b";
+	"c";
+	"c" -> "a";
+	"c" -> "b";
+	subgraph level0 {
+		rank=same;
+		"a";
+		"b";
+	}
+	subgraph level1 {
+		rank=same;
+		"c";
+	}
+}
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected graph output:\n%s", buf.String())
+	}
+}
+
+func TestWriteGraph_CircularDependency(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install", DependsOn: []string{"b"}},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+		},
+	}
+
+	var buf strings.Builder
+	if err := WriteGraph(&buf, cfg, false); err == nil {
+		t.Error("Expected error for circular dependency")
+	}
+}
+
+func TestBuildOrder_ExcludedPackages(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"a", "b"}},
+		},
+	}
+
+	order, err := GetBuildOrder(excludePackages(cfg, map[string]bool{"b": true}))
+	if err != nil {
+		t.Fatalf("GetBuildOrder failed: %v", err)
+	}
+
+	if len(order) != 2 || order[0][0] != "a" || order[1][0] != "c" || len(order[1]) != 1 {
+		t.Errorf("Expected [[a] [c]], got %v", order)
+	}
+	if len(cfg.Packages[2].DependsOn) != 2 {
+		t.Errorf("excludePackages modified the original config: %v", cfg.Packages[2].DependsOn)
+	}
+}
+
+func TestBuildOrder_RuntimeDependencies(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install", RuntimeDepends: []string{"b"}},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", BuildDepends: []string{"c"}, RuntimeDepends: []string{"a"}},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install"},
+		},
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Runtime dependency cycle should be valid: %v", err)
+	}
+
+	order, err := GetBuildOrder(cfg)
+	if err != nil {
+		t.Fatalf("GetBuildOrder failed: %v", err)
+	}
+	if len(order) != 2 || len(order[0]) != 2 || order[1][0] != "b" {
+		t.Errorf("Expected b to be built after a and c, got %v", order)
+	}
+
+	cfg.Packages[0].RuntimeDepends = []string{"missing"}
+	if _, err := GetBuildOrder(cfg); err == nil {
+		t.Error("Expected error for missing runtime dependency")
+	}
+}
+
+func TestBuildOrder_OptionalDependencies(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install", OptionalDepends: []string{"b", "missing"}},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install"},
+		},
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Missing optional dependency should be valid: %v", err)
+	}
+
+	order, err := GetBuildOrder(cfg)
+	if err != nil {
+		t.Fatalf("GetBuildOrder failed: %v", err)
+	}
+	if len(order) != 2 || order[0][0] != "b" || order[1][0] != "a" {
+		t.Errorf("Expected [[b] [a]], got %v", order)
+	}
+
+	order, err = GetBuildOrder(excludePackages(cfg, map[string]bool{"b": true}))
+	if err != nil {
+		t.Fatalf("GetBuildOrder failed: %v", err)
+	}
+	if len(order) != 1 || order[0][0] != "a" {
+		t.Errorf("Expected [[a]], got %v", order)
+	}
+}
+
+func TestRequiredBy(t *testing.T) {
+	disabled := false
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "app", URL: "http://app", Build: "make", Install: "make install", DependsOn: []string{"gui", "net"}},
+			{Name: "gui", URL: "http://gui", Build: "make", Install: "make install", DependsOn: []string{"zlib"}},
+			{Name: "net", URL: "http://net", Build: "make", Install: "make install", BuildDepends: []string{"zlib"}},
+			{Name: "zlib", URL: "http://zlib", Build: "make", Install: "make install"},
+			{Name: "tool", URL: "http://tool", Build: "make", Install: "make install", RuntimeDepends: []string{"zlib"}},
+			{Name: "old", URL: "http://old", Build: "make", Install: "make install", DependsOn: []string{"zlib"}, Enabled: &disabled},
+		},
+	}
+
+	dependents, err := RequiredBy(cfg, "zlib")
+	if err != nil {
+		t.Fatalf("RequiredBy failed: %v", err)
+	}
+	expected := []string{"gui", "net", "app"}
+	if !slices.Equal(dependents, expected) {
+		t.Errorf("Expected %v, got %v", expected, dependents)
+	}
+
+	if dependents, err := RequiredBy(cfg, "app"); err != nil || len(dependents) != 0 {
+		t.Errorf("Expected no dependents of app, got %v (%v)", dependents, err)
+	}
+	if _, err := RequiredBy(cfg, "missing"); err == nil {
+		t.Error("Expected an error for a missing package")
+	}
+}
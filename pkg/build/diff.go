@@ -0,0 +1,151 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aar10n/makepkg/pkg/cache"
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+// diffContext is the number of unchanged lines shown around each change in
+// a unified diff, as with diff -u.
+const diffContext = 3
+
+// printChanges prints a unified diff of each script and env list of pkg
+// that differs from the cached build info.
+func (b *Builder) printChanges(pkg *config.Package, info *cache.Info) {
+	changes := []struct {
+		name     string
+		old, new []string
+	}{
+		{"Pre-build script", scriptLines(info.PreBuild), scriptLines(pkg.PreBuild)},
+		{"Build script", scriptLines(info.Build), scriptLines(pkg.Build)},
+		{"Post-build script", scriptLines(info.PostBuild), scriptLines(pkg.PostBuild)},
+		{"Install script", scriptLines(info.Install), scriptLines(pkg.Install)},
+		{"Post-install script", scriptLines(info.PostInstall), scriptLines(pkg.PostInstall)},
+		{"Env", info.Env, pkg.Env},
+		{"Global env", info.GlobalEnv, b.config.Env},
+	}
+	for _, change := range changes {
+		diff := unifiedDiff(change.old, change.new)
+		if len(diff) == 0 {
+			continue
+		}
+		b.Info("  [DRY RUN] %s changed:", change.name)
+		for _, line := range diff {
+			b.Info("    %s", line)
+		}
+	}
+}
+
+// scriptLines splits a script into lines, ignoring a trailing newline.
+func scriptLines(script string) []string {
+	script = strings.TrimSuffix(script, "\n")
+	if script == "" {
+		return nil
+	}
+	return strings.Split(script, "\n")
+}
+
+// unifiedDiff returns the lines of a unified diff from old to new, without
+// file headers, or nil if they are equal. Lines are compared whole, using a
+// longest common subsequence, which is plenty for package scripts.
+func unifiedDiff(old, new []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of old[i:]
+	// and new[j:].
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && old[i] == new[j]:
+			edits = append(edits, edit{' ', old[i]})
+			i++
+			j++
+		case i < len(old) && (j == len(new) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', old[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', new[j]})
+			j++
+		}
+	}
+
+	var out []string
+	oldLine, newLine := 1, 1
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			oldLine++
+			newLine++
+			start++
+			continue
+		}
+
+		// Extend the hunk until the changes are more than twice the
+		// context apart, then add the context on either side.
+		end := start
+		for k := start; k < len(edits) && k-end <= 2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				end = k + 1
+			}
+		}
+		first := max(start-diffContext, 0)
+		last := min(end+diffContext, len(edits))
+
+		hunkOld, hunkNew := oldLine-(start-first), newLine-(start-first)
+		var oldCount, newCount int
+		var lines []string
+		for _, e := range edits[first:last] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+			lines = append(lines, string(e.op)+e.line)
+		}
+		out = append(out, fmt.Sprintf("@@ -%s +%s @@", hunkRange(hunkOld, oldCount), hunkRange(hunkNew, newCount)))
+		out = append(out, lines...)
+
+		for _, e := range edits[start:last] {
+			if e.op != '+' {
+				oldLine++
+			}
+			if e.op != '-' {
+				newLine++
+			}
+		}
+		start = last
+	}
+	return out
+}
+
+// hunkRange formats the start and length of one side of a hunk. An empty
+// side starts at the line before it, as in diff -u.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
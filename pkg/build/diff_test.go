@@ -0,0 +1,39 @@
+package build
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		old, new string
+		expected []string
+	}{
+		{"make", "make", nil},
+		{"make", "make -j4", []string{"@@ -1 +1 @@", "-make", "+make -j4"}},
+		{"", "make", []string{"@@ -0,0 +1 @@", "+make"}},
+		{
+			"./configure\nmake\nmake check",
+			"./configure --prefix=/usr\nmake\nmake check",
+			[]string{"@@ -1,3 +1,3 @@", "-./configure", "+./configure --prefix=/usr", " make", " make check"},
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12",
+			"1\n2\nX\n4\n5\n6\n7\n8\n9\n10\nY\n12",
+			[]string{
+				"@@ -1,6 +1,6 @@", " 1", " 2", "-3", "+X", " 4", " 5", " 6",
+				"@@ -8,5 +8,5 @@", " 8", " 9", " 10", "-11", "+Y", " 12",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := unifiedDiff(scriptLines(tt.old), scriptLines(tt.new))
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("unifiedDiff(%q, %q):\nexpected:\n%s\ngot:\n%s", tt.old, tt.new,
+				strings.Join(tt.expected, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
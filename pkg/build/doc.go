@@ -0,0 +1,30 @@
+// Package build builds and installs the packages of a configuration into a
+// sysroot.
+//
+// The makepkg command is a thin layer over this package, and other Go
+// programs can drive builds the same way:
+//
+//	cfg, err := config.LoadConfig("packages.yaml")
+//	if err != nil {
+//		return err
+//	}
+//
+//	builder, err := build.NewBuilder(build.BuilderConfig{MaxConcurrency: 4, MakeJobs: 4},
+//		cfg, "/abs/build", "/abs/sysroot", cfg.Toolchain.Host, "")
+//	if err != nil {
+//		return err
+//	}
+//	defer builder.Close()
+//
+//	if err := builder.Build(ctx, []string{"zlib"}); err != nil {
+//		return err
+//	}
+//	for _, result := range builder.Results() {
+//		...
+//	}
+//
+// LoadConfig validates the configuration. A toolchain file is loaded with config.LoadToolchainConfig and merged into
+// the configuration with config.MergeToolchainConfig before creating the
+// Builder. The Builder logs through a clone of logger.Default, so callers
+// control its output with logger.SetOutput and logger.SetVerbose.
+package build
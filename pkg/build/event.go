@@ -0,0 +1,47 @@
+package build
+
+import "time"
+
+// Phase is a step in the build of a package, reported through
+// BuilderConfig.OnEvent.
+type Phase string
+
+const (
+	PhaseStarted     Phase = "started"
+	PhaseDownloading Phase = "downloading"
+	PhaseCompiling   Phase = "compiling"
+	PhaseInstalling  Phase = "installing"
+
+	// PhaseInstalled, PhaseBuilt, PhaseSkipped and PhaseFailed are final:
+	// no further events are sent for the package. PhaseBuilt is only sent
+	// with BuilderConfig.BuildOnly.
+	PhaseInstalled Phase = "installed"
+	PhaseBuilt     Phase = "built"
+	PhaseSkipped   Phase = "skipped"
+	PhaseFailed    Phase = "failed"
+)
+
+// PackageEvent reports that a package entered a phase of its build.
+type PackageEvent struct {
+	Package string
+	Phase   Phase
+	Time    time.Time
+	// Reason explains why a package was skipped, if known.
+	Reason string
+	// Error is set for PhaseFailed.
+	Error error
+}
+
+// emit sends an event to the OnEvent callback, if any. Calls are serialized,
+// so the callback need not be safe for concurrent use, but it blocks the
+// build while it runs.
+func (b *Builder) emit(event PackageEvent) {
+	if b.builderCfg.OnEvent == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	b.eventMutex.Lock()
+	defer b.eventMutex.Unlock()
+	b.builderCfg.OnEvent(event)
+}
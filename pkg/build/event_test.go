@@ -0,0 +1,64 @@
+package build
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+func TestBuilder_OnEvent(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install"},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"a", "b"}},
+		},
+	}
+
+	// Not synchronized: the builder serializes calls to OnEvent.
+	phases := make(map[string][]Phase)
+	var order []string
+	builderCfg := BuilderConfig{
+		DryRun:         true,
+		MaxConcurrency: 2,
+		OnEvent: func(event PackageEvent) {
+			phases[event.Package] = append(phases[event.Package], event.Phase)
+			order = append(order, event.Package)
+		},
+	}
+
+	dir := t.TempDir()
+	builder, err := NewBuilder(builderCfg, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+	defer builder.Close()
+
+	if err := builder.Build(context.Background(), nil); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	expected := []Phase{PhaseStarted, PhaseCompiling, PhaseInstalling, PhaseInstalled}
+	for _, name := range []string{"a", "b", "c"} {
+		if !slices.Equal(phases[name], expected) {
+			t.Errorf("Package %s: expected phases %v, got %v", name, expected, phases[name])
+		}
+	}
+	firstC := slices.Index(order, "c")
+	for i, name := range order {
+		if name != "c" && i > firstC {
+			t.Errorf("Expected c's events after its dependencies', got %v", order)
+			break
+		}
+	}
+}
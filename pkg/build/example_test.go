@@ -0,0 +1,70 @@
+package build_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aar10n/makepkg/pkg/build"
+	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+const examplePackages = `packages:
+  - name: zlib
+    url: https://zlib.net/zlib-1.3.1.tar.gz
+    build: ./configure --prefix=/usr && make
+    install: make install DESTDIR=$SYS_ROOT
+  - name: libpng
+    url: https://download.sourceforge.net/libpng/libpng-1.6.43.tar.xz
+    depends_on: [zlib]
+    build: ./configure --host=$PKGS_HOST --prefix=/usr && make
+    install: make install DESTDIR=$SYS_ROOT
+  - name: curl
+    url: https://curl.se/download/curl-8.9.1.tar.xz
+    depends_on: [zlib]
+    build: ./configure --host=$PKGS_HOST --prefix=/usr && make
+    install: make install DESTDIR=$SYS_ROOT
+`
+
+// Example builds libpng and its dependencies as a dry run.
+func Example() {
+	dir, err := os.MkdirTemp("", "makepkg-example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "packages.yaml")
+	if err := os.WriteFile(configPath, []byte(examplePackages), 0644); err != nil {
+		panic(err)
+	}
+
+	logger.SetOutput(io.Discard)
+	defer logger.SetErrorOutput(os.Stderr)
+	defer logger.SetInfoOutput(os.Stdout)
+
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+
+	builderCfg := build.BuilderConfig{DryRun: true, MaxConcurrency: 2, MakeJobs: 1}
+	builder, err := build.NewBuilder(builderCfg, cfg, filepath.Join(dir, "build"), filepath.Join(dir, "sysroot"), "", "")
+	if err != nil {
+		panic(err)
+	}
+	defer builder.Close()
+
+	if err := builder.Build(context.Background(), []string{"libpng"}); err != nil {
+		panic(err)
+	}
+	for _, result := range builder.Results() {
+		fmt.Printf("%s: %s (success: %v)\n", result.Package, result.Action, result.Success)
+	}
+	// Output:
+	// zlib: built (success: true)
+	// libpng: built (success: true)
+}
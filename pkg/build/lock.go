@@ -0,0 +1,86 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	lockFileName = ".lock"
+
+	// lockEnvVar is passed to package scripts so that makepkg invocations
+	// nested through $MAKEPKG can tell that their parent already holds the
+	// lock on the build directory.
+	lockEnvVar = "MAKEPKG_LOCK"
+
+	// nestedLockFileName is locked by makepkg invocations nested through
+	// $MAKEPKG, such as the reinstall run by mkpkg::get_artifact, so that
+	// they run one at a time rather than racing on the same packages.
+	nestedLockFileName = ".lock-nested"
+
+	// nestedLockEnvVar is passed to the scripts run by a nested invocation,
+	// so that invocations nested within it do not wait on its lock.
+	nestedLockEnvVar = "MAKEPKG_NESTED_LOCK"
+)
+
+// buildLock is an exclusive lock on a build directory, held for as long as
+// the lock file stays open.
+type buildLock struct {
+	file *os.File
+}
+
+// acquireLock takes the lock on buildDir without blocking. If another
+// process holds it, the error names that process's PID when it is known.
+func acquireLock(buildDir string) (*buildLock, error) {
+	path := filepath.Join(buildDir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("failed to lock build directory: %w", err)
+		}
+		data, _ := os.ReadFile(path)
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return nil, fmt.Errorf("build directory %s is in use by another makepkg process (pid %d)", buildDir, pid)
+		}
+		return nil, fmt.Errorf("build directory %s is in use by another makepkg process", buildDir)
+	}
+
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return &buildLock{file: file}, nil
+}
+
+// waitForNestedLock takes the lock that serializes nested invocations on
+// buildDir, blocking until the invocation holding it finishes.
+func waitForNestedLock(buildDir string) (*buildLock, error) {
+	path := filepath.Join(buildDir, nestedLockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock build directory: %w", err)
+	}
+	return &buildLock{file: file}, nil
+}
+
+// Release unlocks the build directory.
+func (l *buildLock) Release() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
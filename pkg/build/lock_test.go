@@ -0,0 +1,59 @@
+package build
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+func TestNewBuilder_NestedLock(t *testing.T) {
+	buildDir, sysroot := t.TempDir(), t.TempDir()
+	cfg := &config.Config{}
+	newBuilder := func() *Builder {
+		builder, err := NewBuilder(BuilderConfig{}, cfg, buildDir, sysroot, "", "")
+		if err != nil {
+			t.Errorf("NewBuilder failed: %v", err)
+			return nil
+		}
+		return builder
+	}
+
+	parent := newBuilder()
+	if parent == nil {
+		t.FailNow()
+	}
+	defer parent.Close()
+	if parent.lock == nil || parent.nestedLock != nil {
+		t.Fatal("Expected the top-level invocation to take only the build directory lock")
+	}
+
+	// Invocations nested through $MAKEPKG wait for each other.
+	t.Setenv(lockEnvVar, filepath.Join(buildDir, lockFileName))
+	first := newBuilder()
+	if first == nil || first.nestedLock == nil {
+		t.Fatal("Expected a nested invocation to take the nested lock")
+	}
+	acquired := make(chan *Builder)
+	go func() { acquired <- newBuilder() }()
+	select {
+	case <-acquired:
+		t.Fatal("Expected a second nested invocation to wait for the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	second := <-acquired
+	if second == nil {
+		t.FailNow()
+	}
+	defer second.Close()
+
+	// Invocations nested within a nested invocation already hold its lock.
+	t.Setenv(nestedLockEnvVar, filepath.Join(buildDir, nestedLockFileName))
+	inner := newBuilder()
+	if inner == nil || inner.nestedLock != nil {
+		t.Fatal("Expected an invocation nested in a nested one not to wait for its lock")
+	}
+	inner.Close()
+}
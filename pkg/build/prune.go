@@ -0,0 +1,129 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aar10n/makepkg/pkg/download"
+)
+
+// PruneMode selects what Prune removes besides the build directories of
+// packages that are no longer in the configuration.
+type PruneMode string
+
+const (
+	// PruneStale removes only stale package directories.
+	PruneStale PruneMode = "stale"
+	// PruneArchives also removes downloaded archives of configured
+	// packages, keeping their extracted sources.
+	PruneArchives PruneMode = "archives"
+	// PruneSources also removes extracted sources of configured packages,
+	// keeping their downloaded archives.
+	PruneSources PruneMode = "sources"
+)
+
+// PruneModes lists the valid prune modes.
+var PruneModes = []PruneMode{PruneStale, PruneArchives, PruneSources}
+
+// Prune removes build directories of packages that are no longer in the
+// configuration and, depending on mode, the archives or sources of the
+// remaining packages. It reports the space reclaimed.
+func (b *Builder) Prune(mode PruneMode) error {
+	entries, err := os.ReadDir(b.buildDir)
+	if err != nil {
+		return fmt.Errorf("failed to read build directory: %w", err)
+	}
+
+	var reclaimed int64
+	var errs []error
+	remove := func(path string) {
+		if _, err := os.Lstat(path); err != nil {
+			return
+		}
+		size := diskUsage(path)
+		if b.builderCfg.DryRun {
+			b.Info("  Would remove %s (%s)", path, download.FormatBytes(size))
+			reclaimed += size
+			return
+		}
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		b.Info("  Removed %s (%s)", path, download.FormatBytes(size))
+		reclaimed += size
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		// The artifacts directory and dotfiles are owned by makepkg itself.
+		if !entry.IsDir() || name == "artifacts" || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		pkgDir := filepath.Join(b.buildDir, name)
+		if b.config.GetPackageByName(name) == nil {
+			b.Info("Pruning stale package %s...", name)
+			remove(pkgDir)
+			remove(filepath.Join(b.buildArtifactsDir, name))
+			continue
+		}
+
+		switch mode {
+		case PruneArchives:
+			files, err := os.ReadDir(pkgDir)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, file := range files {
+				if file.IsDir() || file.Name() == "makepkg.json" || file.Name() == download.SourceMarker || filepath.Ext(file.Name()) == ".log" {
+					continue
+				}
+				remove(filepath.Join(pkgDir, file.Name()))
+			}
+		case PruneSources:
+			sourceDir := filepath.Join(pkgDir, "source")
+			if _, err := os.Stat(sourceDir); err != nil {
+				continue
+			}
+			remove(sourceDir)
+			// Keep the package from being rebuilt just because its source is gone.
+			if !b.builderCfg.DryRun {
+				if err := b.cache.MarkSourceDiscarded(name); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	if b.builderCfg.DryRun {
+		b.Info("Would reclaim %s", download.FormatBytes(reclaimed))
+	} else {
+		b.Info("Reclaimed %s", download.FormatBytes(reclaimed))
+	}
+
+	return errors.Join(errs...)
+}
+
+// diskUsage returns the total size of the regular files under path, or 0 if
+// it does not exist.
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
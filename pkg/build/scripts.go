@@ -1,12 +1,22 @@
 package build
 
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
 // ScriptType represents the type of script being executed.
 type ScriptType string
 
 const (
-	ScriptTypeBuild   ScriptType = "build"
-	ScriptTypeInstall ScriptType = "install"
-	ScriptTypeClean   ScriptType = "clean"
+	ScriptTypePreBuild    ScriptType = "pre_build"
+	ScriptTypeBuild       ScriptType = "build"
+	ScriptTypePostBuild   ScriptType = "post_build"
+	ScriptTypeInstall     ScriptType = "install"
+	ScriptTypePostInstall ScriptType = "post_install"
+	ScriptTypeClean       ScriptType = "clean"
 )
 
 const commonFunctions = `
@@ -53,23 +63,69 @@ mkpkg::replace_in_file() {
 	fi
 	sed -i.bak "s|$pattern|$replacement|g" "$file"
 }
+
+# Download a file with curl, falling back to wget
+#   $1 - URL to download
+#   $2 - optional destination path (defaults to basename of URL)
+mkpkg::download() {
+	local url="$1"
+	local dest="${2:-$(basename "$url")}"
+	if [ -z "$url" ]; then
+		mkpkg::error "No URL given to download"
+	fi
+
+	mkpkg::info "Downloading $url to $dest"
+	mkdir -p "$(dirname "$dest")"
+	if mkpkg::has_command curl; then
+		curl -fsSL -o "$dest" "$url" || { rm -f "$dest"; mkpkg::error "Failed to download: $url"; }
+	elif mkpkg::has_command wget; then
+		wget -q -O "$dest" "$url" || { rm -f "$dest"; mkpkg::error "Failed to download: $url"; }
+	else
+		mkpkg::error "Neither curl nor wget is available to download $url"
+	fi
+}
 `
 
 const buildFunctions = `
 # Build-specific helper functions
 
-# Configure a package using the standard ./configure script
+# Configure a package using the standard ./configure script. --host is only
+# passed when cross compiling, so that autotools does not assume it is.
 mkpkg::configure() {
 	if [ ! -f "./configure" ]; then
 		mkpkg::error "configure script not found"
 	fi
 
+	set -- --prefix=/usr "$@"
+	if [ -n "$PKGS_BUILD" ]; then
+		set -- --build="$PKGS_BUILD" "$@"
+	fi
+	if [ "$PKG_NATIVE" != 1 ] && [ -n "$PKGS_HOST" ] && [ "$PKGS_HOST" != "$PKGS_BUILD" ]; then
+		set -- --host="$PKGS_HOST" "$@"
+	fi
+
 	mkpkg::info "Running configure..."
-	./configure \
-		--host=$PKGS_HOST \
-		--prefix=/usr \
+	./configure "$@"
+}
+
+# Configure a CMake package into the build subdirectory
+mkpkg::cmake_configure() {
+	if [ ! -f "./CMakeLists.txt" ]; then
+		mkpkg::error "CMakeLists.txt not found"
+	fi
+
+	mkpkg::info "Running cmake..."
+	cmake -S . -B build \
+		-DCMAKE_INSTALL_PREFIX=/usr \
+		${CMAKE_TOOLCHAIN_FILE:+"-DCMAKE_TOOLCHAIN_FILE=$CMAKE_TOOLCHAIN_FILE"} \
 		"$@"
 }
+
+# Run make with the jobs from MAKEFLAGS
+mkpkg::make() {
+	mkpkg::info "make $MAKEFLAGS $@"
+	make $MAKEFLAGS "$@"
+}
 `
 
 // installFunctions contains bash functions available to install scripts.
@@ -78,14 +134,14 @@ const installFunctions = `
 
 # Run make install with DESTDIR
 mkpkg::make_install() {
-	mkpkg::info "Running make install to $SYS_ROOT..."
-	mkpkg::info "make install $@ DESTDIR=$SYS_ROOT"
-	make install "$@" DESTDIR="$SYS_ROOT"
+	mkpkg::info "Running make install to $INSTALL_ROOT..."
+	mkpkg::info "make install $@ DESTDIR=$INSTALL_ROOT"
+	make install "$@" DESTDIR="$INSTALL_ROOT"
 }
 
 # Install a file to a specific location
 #   $1 - source file path
-#   $2 - destination path within SYS_ROOT
+#   $2 - destination path within INSTALL_ROOT
 #   $3 - optional file mode (defaults to 0644)
 mkpkg::install_file() {
 	local src="$1"
@@ -96,7 +152,7 @@ mkpkg::install_file() {
 		mkpkg::error "Source file not found: $src"
 	fi
 
-	local full_dst="$SYS_ROOT$dst"
+	local full_dst="$INSTALL_ROOT$dst"
 	mkpkg::info "Installing $src to $dst"
 
 	mkdir -p "$(dirname "$full_dst")"
@@ -155,21 +211,41 @@ mkpkg::get_artifact() {
 }
 `
 
-// GetScriptPreamble returns the bash functions to prepend to a script.
-func GetScriptPreamble(scriptType ScriptType) string {
-	preamble := "#!/bin/bash\nset -e\n\n"
-	preamble += commonFunctions + "\n"
-
-	switch scriptType {
-	case ScriptTypeBuild:
-		preamble += buildFunctions + "\n"
-	case ScriptTypeInstall:
-		preamble += installFunctions + "\n"
-	case ScriptTypeClean:
-		// Clean scripts only get common functions
-	default:
-		// Default to common only
+// GetScriptPreamble returns the shell options and helper functions to prepend
+// to a script run by shell, followed by the user's preamble. The helper
+// functions use bash syntax, so sh scripts only get the options and the
+// user's preamble.
+func GetScriptPreamble(scriptType ScriptType, shell, userPreamble string) string {
+	var preamble string
+	if shell == config.ShellSh {
+		preamble = "#!/bin/sh\nset -e\n\n"
+	} else {
+		preamble = "#!/bin/bash\nset -e\nset -o pipefail\n\n"
+		preamble += commonFunctions + "\n"
+
+		switch scriptType {
+		case ScriptTypePreBuild, ScriptTypeBuild, ScriptTypePostBuild:
+			preamble += buildFunctions + "\n"
+		case ScriptTypeInstall, ScriptTypePostInstall:
+			preamble += installFunctions + "\n"
+		case ScriptTypeClean:
+			// Clean scripts only get common functions
+		default:
+			// Default to common only
+		}
 	}
 
+	if userPreamble != "" {
+		preamble += "# User script preamble\n" + userPreamble + "\n"
+	}
 	return preamble
 }
+
+// preambleDigest returns a hash of the user's script preamble, or an empty
+// string if there is none.
+func preambleDigest(preamble string) string {
+	if preamble == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(preamble)))
+}
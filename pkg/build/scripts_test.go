@@ -0,0 +1,65 @@
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+func TestScriptPreamble_Pipefail(t *testing.T) {
+	script := GetScriptPreamble(ScriptTypeBuild, config.ShellBash, "") + "false | cat\necho reached\n"
+	output, err := exec.Command("bash", "-c", script).CombinedOutput()
+	if err == nil || strings.Contains(string(output), "reached") {
+		t.Errorf("Expected a failing pipeline to abort the script, got %q (err: %v)", output, err)
+	}
+}
+
+func TestScriptPreamble_Sh(t *testing.T) {
+	script := GetScriptPreamble(ScriptTypeBuild, config.ShellSh, "") + "false\necho reached\n"
+	output, err := exec.Command("sh", "-c", script).CombinedOutput()
+	if err == nil || strings.Contains(string(output), "reached") {
+		t.Errorf("Expected a failing command to abort the script, got %q (err: %v)", output, err)
+	}
+}
+
+func TestScriptPreamble_ShUserPreamble(t *testing.T) {
+	script := GetScriptPreamble(ScriptTypeBuild, config.ShellSh, "greet() { echo \"hello $1\"; }") + "greet sh\n"
+	output, err := exec.Command("sh", "-c", script).CombinedOutput()
+	if err != nil || strings.TrimSpace(string(output)) != "hello sh" {
+		t.Errorf("Expected sh scripts to get the user's preamble, got %q (err: %v)", output, err)
+	}
+}
+
+func TestConfigureHelper_Host(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "configure"), []byte("#!/bin/sh\necho \"args: $*\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		native, host, build string
+		expected            string
+	}{
+		{"0", "aarch64-linux-gnu", "x86_64-linux-gnu", "args: --host=aarch64-linux-gnu --build=x86_64-linux-gnu --prefix=/usr --enable-foo"},
+		{"0", "x86_64-linux-gnu", "x86_64-linux-gnu", "args: --build=x86_64-linux-gnu --prefix=/usr --enable-foo"},
+		{"1", "aarch64-linux-gnu", "x86_64-linux-gnu", "args: --build=x86_64-linux-gnu --prefix=/usr --enable-foo"},
+		{"0", "", "", "args: --prefix=/usr --enable-foo"},
+	}
+	for _, tt := range tests {
+		script := GetScriptPreamble(ScriptTypeBuild, config.ShellBash, "") + "mkpkg::configure --enable-foo\n"
+		cmd := exec.Command("bash", "-c", script)
+		cmd.Dir = dir
+		cmd.Env = []string{"PKG_NATIVE=" + tt.native, "PKGS_HOST=" + tt.host, "PKGS_BUILD=" + tt.build}
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("mkpkg::configure failed: %v\n%s", err, output)
+		}
+		if !strings.Contains(string(output), tt.expected+"\n") {
+			t.Errorf("native=%s host=%q build=%q: expected %q, got %q", tt.native, tt.host, tt.build, tt.expected, output)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const stateFileName = ".state.json"
+
+// buildState records whether each package of the last build succeeded, so
+// that a later build with BuilderConfig.Continue can skip the successful ones.
+type buildState struct {
+	Packages map[string]bool `json:"packages"`
+}
+
+// readState reads the state of the last build in buildDir. A missing state
+// file yields an empty state.
+func readState(buildDir string) (*buildState, error) {
+	state := &buildState{Packages: make(map[string]bool)}
+	data, err := os.ReadFile(filepath.Join(buildDir, stateFileName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read build state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse build state: %w", err)
+	}
+	if state.Packages == nil {
+		state.Packages = make(map[string]bool)
+	}
+	return state, nil
+}
+
+// writeState replaces the state in buildDir with the outcome of results.
+func writeState(buildDir string, results []Result) error {
+	state := buildState{Packages: make(map[string]bool, len(results))}
+	for _, result := range results {
+		state.Packages[result.Package] = result.Success
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal build state: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, stateFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write build state: %w", err)
+	}
+	return nil
+}
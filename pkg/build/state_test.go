@@ -0,0 +1,41 @@
+package build
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestState_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	state, err := readState(dir)
+	if err != nil {
+		t.Fatalf("readState with no state file: %v", err)
+	}
+	if len(state.Packages) != 0 {
+		t.Errorf("Expected an empty state, got %v", state.Packages)
+	}
+
+	results := []Result{
+		{Package: "a", Success: true, Action: ActionBuilt},
+		{Package: "b", Success: false, Action: ActionBuilt, Error: errors.New("failed")},
+		{Package: "c", Success: true, Action: ActionSkipped},
+	}
+	if err := writeState(dir, results); err != nil {
+		t.Fatalf("writeState: %v", err)
+	}
+
+	state, err = readState(dir)
+	if err != nil {
+		t.Fatalf("readState: %v", err)
+	}
+	expected := map[string]bool{"a": true, "b": false, "c": true}
+	if len(state.Packages) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, state.Packages)
+	}
+	for name, success := range expected {
+		if state.Packages[name] != success {
+			t.Errorf("Package %s: expected success %v, got %v", name, success, state.Packages[name])
+		}
+	}
+}
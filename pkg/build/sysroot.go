@@ -0,0 +1,52 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aar10n/makepkg/pkg/download"
+)
+
+// FHSTemplate is the SysrootTemplate that creates a skeleton of standard
+// directories instead of copying a template directory.
+const FHSTemplate = "fhs"
+
+// defaultSysrootSkeleton is the skeleton created by FHSTemplate when the
+// configuration does not set sysroot_skeleton.
+var defaultSysrootSkeleton = []string{
+	"etc",
+	"usr/bin",
+	"usr/include",
+	"usr/lib",
+	"usr/lib/pkgconfig",
+	"usr/sbin",
+	"usr/share",
+	"var",
+}
+
+// initSysroot prepares root, the directory packages are installed into,
+// from the SysrootTemplate option: either the skeleton directories, or the
+// contents of a template directory. Files already in root are kept.
+func (b *Builder) initSysroot(root string) error {
+	template := b.builderCfg.SysrootTemplate
+	if template == FHSTemplate {
+		skeleton := b.config.SysrootSkeleton
+		if len(skeleton) == 0 {
+			skeleton = defaultSysrootSkeleton
+		}
+		b.Debug("Creating sysroot skeleton in %s", root)
+		for _, dir := range skeleton {
+			if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+				return fmt.Errorf("failed to create sysroot skeleton: %w", err)
+			}
+		}
+		return nil
+	}
+
+	b.Debug("Copying sysroot template %s to %s", template, root)
+	if err := download.CopyTree(template, root, true); err != nil {
+		return fmt.Errorf("failed to copy sysroot template: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+func TestInitSysroot(t *testing.T) {
+	template := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(template, "etc", "profile.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"etc/os-release": "ID=test\n", "etc/hosts": "template\n"} {
+		if err := os.WriteFile(filepath.Join(template, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		template string
+		skeleton []string
+		expected []string
+	}{
+		{FHSTemplate, nil, []string{"usr/include", "usr/lib/pkgconfig", "etc"}},
+		{FHSTemplate, []string{"lib64", "usr/local/lib"}, []string{"lib64", "usr/local/lib"}},
+		{template, nil, []string{"etc/profile.d", "etc/os-release"}},
+	}
+	for _, tt := range tests {
+		sysroot := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(sysroot, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sysroot, "etc", "hosts"), []byte("existing\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &config.Config{SysrootSkeleton: tt.skeleton}
+		builder := &Builder{Logger: logger.Default(), builderCfg: BuilderConfig{SysrootTemplate: tt.template}, config: cfg}
+		if err := builder.initSysroot(sysroot); err != nil {
+			t.Fatalf("initSysroot(%s) failed: %v", tt.template, err)
+		}
+		for _, name := range tt.expected {
+			if _, err := os.Stat(filepath.Join(sysroot, name)); err != nil {
+				t.Errorf("Expected %s in the sysroot from %s: %v", name, tt.template, err)
+			}
+		}
+		if data, _ := os.ReadFile(filepath.Join(sysroot, "etc", "hosts")); string(data) != "existing\n" {
+			t.Errorf("Expected the template not to overwrite existing files, got %q", data)
+		}
+	}
+}
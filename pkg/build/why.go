@@ -0,0 +1,83 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Why explains whether Build would rebuild or reinstall the named package
+// for the current sysroot and host, and why, without building anything.
+func (b *Builder) Why(pkgName string) (string, error) {
+	pkg := b.config.GetPackageByName(pkgName)
+	if pkg == nil {
+		return "", fmt.Errorf("package '%s' not found in configuration", pkgName)
+	}
+	if !pkg.IsEnabled() {
+		return fmt.Sprintf("%s is disabled", pkg.Name), nil
+	}
+	if !pkg.SupportsArch(b.config.Toolchain.Arch) {
+		return fmt.Sprintf("%s is not built for %s", pkg.Name, b.config.Toolchain.Arch), nil
+	}
+
+	// The cache records the substituted package definitions
+	for i := range b.config.Packages {
+		b.config.Packages[i].Subst(b.envManager)
+	}
+
+	needsRebuild, reason, err := b.cache.NeedsRebuildWithReason(pkg, b.sysroot, b.host)
+	if err != nil {
+		return "", fmt.Errorf("failed to check cache for %s: %w", pkg.Name, err)
+	}
+	if needsRebuild {
+		return fmt.Sprintf("%s will be rebuilt: %s", pkg.Name, reason), nil
+	}
+
+	// Rebuilding a dependency invalidates the caches of its dependents
+	for _, dep := range b.buildDependencyClosure(pkg.Name) {
+		depPkg := b.config.GetPackageByName(dep)
+		needsRebuild, reason, err := b.cache.NeedsRebuildWithReason(depPkg, b.sysroot, b.host)
+		if err != nil {
+			return "", fmt.Errorf("failed to check cache for %s: %w", dep, err)
+		}
+		if needsRebuild {
+			return fmt.Sprintf("%s will be rebuilt: dependency %s will be rebuilt (%s)", pkg.Name, dep, reason), nil
+		}
+	}
+
+	needsReinstall, reason := b.builderCfg.AlwaysInstall, "--always-install was given"
+	if !needsReinstall {
+		needsReinstall, reason, err = b.cache.NeedsReinstallWithReason(pkg, b.sysroot, b.host)
+		if err != nil {
+			return "", fmt.Errorf("failed to check reinstall cache for %s: %w", pkg.Name, err)
+		}
+	}
+	if !needsReinstall {
+		return fmt.Sprintf("%s is up to date", pkg.Name), nil
+	}
+	if _, err := os.Stat(filepath.Join(b.buildDir, pkg.Name, "source")); os.IsNotExist(err) {
+		return fmt.Sprintf("%s will be rebuilt to reinstall it, since its source was discarded: %s", pkg.Name, reason), nil
+	}
+	return fmt.Sprintf("%s will be reinstalled: %s", pkg.Name, reason), nil
+}
+
+// buildDependencyClosure returns the enabled packages that pkgName depends
+// on through build dependencies, directly or transitively, nearest first.
+func (b *Builder) buildDependencyClosure(pkgName string) []string {
+	var result []string
+	queue := []string{pkgName}
+	for len(queue) > 0 {
+		pkg := b.config.GetPackageByName(queue[0])
+		queue = queue[1:]
+		for _, dep := range pkg.BuildDependencies() {
+			depPkg := b.config.GetPackageByName(dep)
+			if depPkg == nil || !depPkg.IsEnabled() || dep == pkgName || slices.Contains(result, dep) {
+				continue
+			}
+			result = append(result, dep)
+			queue = append(queue, dep)
+		}
+	}
+	return result
+}
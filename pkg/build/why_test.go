@@ -0,0 +1,63 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/config"
+)
+
+func TestBuilder_Why(t *testing.T) {
+	cfg := &config.Config{
+		Packages: []config.Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+		},
+	}
+
+	dir := t.TempDir()
+	buildDir, sysroot := filepath.Join(dir, "build"), filepath.Join(dir, "sysroot")
+	builder, err := NewBuilder(BuilderConfig{DryRun: true}, cfg, buildDir, sysroot, "", "")
+	if err != nil {
+		t.Fatalf("NewBuilder failed: %v", err)
+	}
+
+	why := func(pkgName, expected string) {
+		t.Helper()
+		explanation, err := builder.Why(pkgName)
+		if err != nil {
+			t.Fatalf("Why(%s) failed: %v", pkgName, err)
+		}
+		if explanation != expected {
+			t.Errorf("Why(%s): expected %q, got %q", pkgName, expected, explanation)
+		}
+	}
+
+	why("b", "b will be rebuilt: no cache exists")
+
+	for i := range cfg.Packages {
+		pkg := &cfg.Packages[i]
+		if err := os.MkdirAll(filepath.Join(buildDir, pkg.Name, "source"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.cache.WriteBuild(pkg.Name, sysroot, "", pkg); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.cache.WriteInstall(pkg.Name, sysroot, "", pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	why("b", "b is up to date")
+
+	cfg.Packages[1].Install = "make install-strip"
+	why("b", "b will be reinstalled: install script changed")
+
+	cfg.Packages[0].Build = "make all"
+	why("a", "a will be rebuilt: build script changed")
+	why("b", "b will be rebuilt: dependency a will be rebuilt (build script changed)")
+
+	if _, err := builder.Why("missing"); err == nil {
+		t.Error("Expected an error for a missing package")
+	}
+}
@@ -1,11 +1,13 @@
 package build
 
 import (
+	"context"
 	"sync"
 )
 
 // WorkerPool manages concurrent execution of tasks.
 type WorkerPool struct {
+	ctx        context.Context
 	maxWorkers int
 	sem        chan struct{}
 	wg         sync.WaitGroup
@@ -13,10 +15,18 @@ type WorkerPool struct {
 
 // NewWorkerPool creates a new worker pool with the specified number of workers.
 func NewWorkerPool(maxWorkers int) *WorkerPool {
+	return NewWorkerPoolWithContext(context.Background(), maxWorkers)
+}
+
+// NewWorkerPoolWithContext creates a worker pool whose tasks are dropped
+// once ctx is canceled, unless they have already started. Running tasks are
+// expected to watch ctx themselves.
+func NewWorkerPoolWithContext(ctx context.Context, maxWorkers int) *WorkerPool {
 	if maxWorkers <= 0 {
 		maxWorkers = 1
 	}
 	return &WorkerPool{
+		ctx:        ctx,
 		maxWorkers: maxWorkers,
 		sem:        make(chan struct{}, maxWorkers),
 	}
@@ -27,9 +37,16 @@ func (p *WorkerPool) Submit(task func()) {
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		p.sem <- struct{}{}
-		defer func() { <-p.sem }()
-		task()
+		select {
+		case p.sem <- struct{}{}:
+			defer func() { <-p.sem }()
+		case <-p.ctx.Done():
+			return
+		}
+
+		if p.ctx.Err() == nil {
+			task()
+		}
 	}()
 }
 
@@ -43,11 +60,52 @@ func (p *WorkerPool) SubmitWithStop(task func(), stopChan <-chan struct{}) {
 			defer func() { <-p.sem }()
 		case <-stopChan:
 			return
+		case <-p.ctx.Done():
+			return
 		}
 
 		select {
 		case <-stopChan:
 			return
+		case <-p.ctx.Done():
+			return
+		default:
+			task()
+		}
+	}()
+}
+
+// SubmitAfter submits a task that runs once every channel in deps has been
+// closed. The task does not occupy a worker while it waits, and it is
+// dropped if stopChan is closed first.
+func (p *WorkerPool) SubmitAfter(deps []<-chan struct{}, task func(), stopChan <-chan struct{}) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for _, dep := range deps {
+			select {
+			case <-dep:
+			case <-stopChan:
+				return
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case p.sem <- struct{}{}:
+			defer func() { <-p.sem }()
+		case <-stopChan:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+
+		select {
+		case <-stopChan:
+			return
+		case <-p.ctx.Done():
+			return
 		default:
 			task()
 		}
@@ -1,6 +1,7 @@
 package build
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -152,3 +153,106 @@ func TestWorkerPool_MultipleWaits(t *testing.T) {
 		t.Errorf("Expected counter to be 2 after second wait, got %d", counter)
 	}
 }
+
+func TestWorkerPool_SubmitAfter(t *testing.T) {
+	pool := NewWorkerPool(1)
+	stopChan := make(chan struct{})
+	dep := make(chan struct{})
+
+	var order []string
+	var mu sync.Mutex
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+	}
+
+	// The dependent is submitted first but must not take the only worker
+	// while it waits, or the dependency could never run.
+	pool.SubmitAfter([]<-chan struct{}{dep}, record("dependent"), stopChan)
+	pool.SubmitAfter(nil, func() {
+		record("dependency")()
+		close(dep)
+	}, stopChan)
+
+	pool.Wait()
+
+	if len(order) != 2 || order[0] != "dependency" || order[1] != "dependent" {
+		t.Errorf("Expected dependency before dependent, got %v", order)
+	}
+}
+
+func TestWorkerPool_SubmitAfter_Stopped(t *testing.T) {
+	pool := NewWorkerPool(2)
+	stopChan := make(chan struct{})
+	dep := make(chan struct{})
+	var executed int32
+
+	pool.SubmitAfter([]<-chan struct{}{dep}, func() {
+		atomic.AddInt32(&executed, 1)
+	}, stopChan)
+
+	close(stopChan)
+	pool.Wait()
+
+	if executed != 0 {
+		t.Error("Task waiting on a dependency should not run after stop")
+	}
+}
+
+func TestWorkerPool_ContextCanceledMidFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPoolWithContext(ctx, 1)
+	stopChan := make(chan struct{})
+	started := make(chan struct{})
+	var aborted, executed int32
+
+	pool.SubmitWithStop(func() {
+		close(started)
+		select {
+		case <-ctx.Done():
+			atomic.AddInt32(&aborted, 1)
+		case <-time.After(5 * time.Second):
+		}
+	}, stopChan)
+	<-started
+
+	for i := 0; i < 3; i++ {
+		pool.SubmitWithStop(func() {
+			atomic.AddInt32(&executed, 1)
+		}, stopChan)
+		pool.Submit(func() {
+			atomic.AddInt32(&executed, 1)
+		})
+	}
+
+	cancel()
+	pool.Wait()
+
+	if aborted != 1 {
+		t.Error("Expected the running task to observe the canceled context")
+	}
+	if executed != 0 {
+		t.Errorf("Expected queued tasks to be dropped after cancel, %d ran", executed)
+	}
+}
+
+func TestWorkerPool_SubmitAfter_ContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPoolWithContext(ctx, 2)
+	dep := make(chan struct{})
+	var executed int32
+
+	pool.SubmitAfter([]<-chan struct{}{dep}, func() {
+		atomic.AddInt32(&executed, 1)
+	}, make(chan struct{}))
+
+	cancel()
+	pool.Wait()
+
+	if executed != 0 {
+		t.Error("Task waiting on a dependency should not run after the context is canceled")
+	}
+}
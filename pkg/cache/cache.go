@@ -1,10 +1,13 @@
 package cache
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/aar10n/makepkg/pkg/config"
 	"github.com/aar10n/makepkg/pkg/logger"
@@ -13,16 +16,97 @@ import (
 const (
 	cacheFileName = "makepkg.json"
 	sourceDir     = "source"
+
+	// cacheVersion is the version of the Info format. It must be bumped
+	// whenever a field that affects rebuild decisions is added or changed,
+	// so that caches written by older versions are rebuilt rather than
+	// under-validated.
+	cacheVersion = 11
 )
 
 // Info stores the cached build information for a package.
 type Info struct {
-	URL     string   `json:"url"`
-	Build   string   `json:"build"`
-	Install string   `json:"install"`
-	Env     []string `json:"env"`
-	Host    string   `json:"host"`
-	Sysroot string   `json:"sysroot"`
+	Version         int             `json:"version"`
+	URL             string          `json:"url"`
+	PkgVersion      string          `json:"pkg_version,omitempty"`
+	SourceDir       string          `json:"source_dir,omitempty"`
+	SourceCopy      bool            `json:"source_copy,omitempty"`
+	GitRef          string          `json:"git_ref,omitempty"`
+	GitCommit       string          `json:"git_commit,omitempty"`
+	SourceCommit    string          `json:"source_commit,omitempty"`
+	ArchiveSum      string          `json:"archive_sum,omitempty"`
+	SourceDateEpoch string          `json:"source_date_epoch,omitempty"`
+	StripComponents *int            `json:"strip_components,omitempty"`
+	Sources         []config.Source `json:"sources,omitempty"`
+	Patches         []string        `json:"patches,omitempty"`
+	PreBuild        string          `json:"pre_build,omitempty"`
+	Build           string          `json:"build"`
+	PostBuild       string          `json:"post_build,omitempty"`
+	Shell           string          `json:"shell,omitempty"`
+	MakeJobs        int             `json:"make_jobs,omitempty"`
+	Preamble        string          `json:"preamble,omitempty"`
+	Install         string          `json:"install"`
+	PostInstall     string          `json:"post_install,omitempty"`
+	Env             []string        `json:"env"`
+	GlobalEnv       []string        `json:"global_env,omitempty"`
+	Host            string          `json:"host"`
+	Toolchain       string          `json:"toolchain,omitempty"`
+	Sysroot         string          `json:"sysroot"`
+	DestDir         string          `json:"destdir,omitempty"`
+
+	// SourceDigest fingerprints the source tree when source tracking is
+	// enabled or the source is a local directory, so that edits to the
+	// source trigger a rebuild.
+	SourceDigest string `json:"source_digest,omitempty"`
+
+	// SourceDiscarded is set when the package's source tree was removed
+	// after a successful build, so a missing source directory is expected.
+	SourceDiscarded bool `json:"source_discarded,omitempty"`
+}
+
+// SourceChange returns a description of the source setting that differs
+// between the cached build and pkg, or "" if the existing source tree can be
+// reused.
+func (i *Info) SourceChange(pkg *config.Package) string {
+	if !pkg.HasURL(i.URL) {
+		return "URL"
+	}
+	if i.SourceDir != pkg.SourceDir || i.SourceCopy != pkg.SourceCopy {
+		return "source_dir"
+	}
+	if i.GitRef != pkg.GitRef || i.GitCommit != pkg.GitCommit {
+		return "git ref"
+	}
+	strip := 1
+	if i.StripComponents != nil {
+		strip = *i.StripComponents
+	}
+	if strip != pkg.Strip() {
+		return "strip_components"
+	}
+	if !slices.Equal(i.Sources, pkg.Sources) {
+		return "additional sources"
+	}
+	if !stringSlicesEqual(i.Patches, patchSums(pkg)) {
+		return "patches"
+	}
+	return ""
+}
+
+// patchSums returns a "<sha256>  <path>" entry for each of the package's
+// patches, so that editing a patch file is detected like changing the list.
+func patchSums(pkg *config.Package) []string {
+	var sums []string
+	for _, patch := range pkg.Patches {
+		data, err := os.ReadFile(patch)
+		if err != nil {
+			logger.Debug("  failed to read patch %s: %v", patch, err)
+			sums = append(sums, "-  "+patch)
+			continue
+		}
+		sums = append(sums, fmt.Sprintf("%x  %s", sha256.Sum256(data), patch))
+	}
+	return sums
 }
 
 type Cache interface {
@@ -31,19 +115,52 @@ type Cache interface {
 	WriteInstall(pkgName, sysroot, host string, pkg *config.Package) error
 	NeedsRebuild(pkg *config.Package, sysroot, host string) (bool, error)
 	NeedsReinstall(pkg *config.Package, sysroot, host string) (bool, error)
+	NeedsRebuildWithReason(pkg *config.Package, sysroot, host string) (bool, string, error)
+	NeedsReinstallWithReason(pkg *config.Package, sysroot, host string) (bool, string, error)
+	MarkSourceDiscarded(pkgName string) error
 	Clean(pkgName string) error
 	Invalidate(pkgName string) error
 	InvalidateDependents(pkgName string, cfg *config.Config) error
 }
 
+// Config holds options for the build cache.
+type Config struct {
+	// TrackSource records a digest of each package's source tree after it
+	// is built and rebuilds the package if the tree is modified afterwards.
+	// The digest covers file paths, sizes, modes and modification times.
+	TrackSource bool
+
+	// Toolchain is the fingerprint of the toolchain used for cross-compiled
+	// packages. Changing it rebuilds every package that is not native.
+	Toolchain string
+
+	// Env is the global env applied to every package. Changing it rebuilds
+	// every package.
+	Env []string
+
+	// Preamble is a digest of the user's script preamble. Changing it
+	// rebuilds every package.
+	Preamble string
+
+	// DestDir is the directory packages are installed into when it differs
+	// from the sysroot. Changing it reinstalls every package.
+	DestDir string
+
+	// SourceDateEpoch is the fixed SOURCE_DATE_EPOCH packages are built
+	// with, if any. Changing it rebuilds every package.
+	SourceDateEpoch string
+}
+
 type cache struct {
 	buildDir string
+	cfg      Config
 }
 
 // NewCache creates a new cache instance.
-func NewCache(buildDir string) Cache {
+func NewCache(buildDir string, cfg Config) Cache {
 	return &cache{
 		buildDir: buildDir,
+		cfg:      cfg,
 	}
 }
 
@@ -78,11 +195,43 @@ func (c *cache) WriteBuild(pkgName, sysroot, host string, pkg *config.Package) e
 		cache = &Info{}
 	}
 
-	cache.URL = pkg.URL
+	if pkg.SourceURL != "" {
+		cache.URL = pkg.SourceURL
+	} else if !pkg.HasURL(cache.URL) {
+		cache.URL = pkg.URL
+	}
+	cache.PkgVersion = pkg.Version
+	cache.SourceDir = pkg.SourceDir
+	cache.SourceCopy = pkg.SourceCopy
+	cache.GitRef = pkg.GitRef
+	cache.GitCommit = pkg.GitCommit
+	cache.StripComponents = pkg.StripComponents
+	cache.Sources = pkg.Sources
+	cache.Patches = patchSums(pkg)
+	if pkg.SourceCommit != "" {
+		cache.SourceCommit = pkg.SourceCommit
+	}
+	if pkg.SourceURL != "" {
+		cache.ArchiveSum = pkg.ArchiveSum
+	}
+	cache.SourceDateEpoch = pkg.SourceDateEpoch
+	cache.Version = cacheVersion
+	cache.PreBuild = pkg.PreBuild
 	cache.Build = pkg.Build
+	cache.PostBuild = pkg.PostBuild
+	cache.Shell = pkg.ScriptShell()
+	cache.MakeJobs = pkg.MakeJobs
+	cache.Preamble = c.cfg.Preamble
 	cache.Env = pkg.Env
+	cache.GlobalEnv = c.cfg.Env
 	cache.Host = host
 	cache.Sysroot = sysroot
+	cache.Toolchain = ""
+	if !pkg.Native {
+		cache.Toolchain = c.cfg.Toolchain
+	}
+	cache.SourceDiscarded = false
+	c.updateSourceDigest(pkg, cache)
 
 	return c.write(pkgName, cache)
 }
@@ -98,25 +247,45 @@ func (c *cache) WriteInstall(pkgName, sysroot, host string, pkg *config.Package)
 	}
 
 	cache.Install = pkg.Install
+	cache.PostInstall = pkg.PostInstall
 	cache.Env = pkg.Env
+	cache.GlobalEnv = c.cfg.Env
 	cache.Host = host
 	cache.Sysroot = sysroot
+	cache.DestDir = c.cfg.DestDir
+	// Install scripts run in the source tree and may touch it as well.
+	c.updateSourceDigest(pkg, cache)
 
 	return c.write(pkgName, cache)
 }
 
 // NeedsRebuild determines if a package needs to be rebuilt based on cache.
 func (c *cache) NeedsRebuild(pkg *config.Package, sysroot, host string) (bool, error) {
-	needs, _, err := c.needsRebuildWithReason(pkg, sysroot, host)
+	needs, _, err := c.NeedsRebuildWithReason(pkg, sysroot, host)
 	return needs, err
 }
 
 // NeedsReinstall determines if a package needs to be reinstalled (but not rebuilt).
 func (c *cache) NeedsReinstall(pkg *config.Package, sysroot, host string) (bool, error) {
-	needs, _, err := c.needsReinstallWithReason(pkg, sysroot, host)
+	needs, _, err := c.NeedsReinstallWithReason(pkg, sysroot, host)
 	return needs, err
 }
 
+// MarkSourceDiscarded records that the source tree for a package was
+// intentionally removed after a successful build.
+func (c *cache) MarkSourceDiscarded(pkgName string) error {
+	cache, err := c.Read(pkgName)
+	if err != nil {
+		return fmt.Errorf("failed to read existing cache: %w", err)
+	}
+	if cache == nil {
+		return nil
+	}
+
+	cache.SourceDiscarded = true
+	return c.write(pkgName, cache)
+}
+
 // Clean removes the cache and source for a package.
 func (c *cache) Clean(pkgName string) error {
 	pkgDir := filepath.Join(c.buildDir, pkgName)
@@ -132,6 +301,10 @@ func (c *cache) Clean(pkgName string) error {
 	}
 
 	for _, entry := range entries {
+		// Script logs are kept so that the last build can still be inspected.
+		if filepath.Ext(entry.Name()) == ".log" {
+			continue
+		}
 		if !entry.IsDir() && entry.Name() != cacheFileName {
 			archivePath := filepath.Join(pkgDir, entry.Name())
 			if err := os.Remove(archivePath); err != nil {
@@ -155,7 +328,7 @@ func (c *cache) Invalidate(pkgName string) error {
 
 // InvalidateDependents invalidates the cache for all packages that depend on the given package.
 func (c *cache) InvalidateDependents(pkgName string, cfg *config.Config) error {
-	dependents := c.findDependents(pkgName, cfg)
+	dependents := cfg.Dependents(pkgName)
 
 	logger.Debug("Package %s was rebuilt, invalidating %d dependent package(s)", pkgName, len(dependents))
 
@@ -189,11 +362,73 @@ func (c *cache) write(pkgName string, cache *Info) error {
 	return nil
 }
 
+// tracksSource reports whether modifications to the source tree of pkg
+// trigger a rebuild. Local source directories are always tracked.
+func (c *cache) tracksSource(pkg *config.Package) bool {
+	return c.cfg.TrackSource || pkg.SourceDir != ""
+}
+
+// sourceRoot returns the source tree of pkg that is fingerprinted: the local
+// source directory if it has one, and the extracted source otherwise.
+func (c *cache) sourceRoot(pkg *config.Package) string {
+	if pkg.SourceDir != "" {
+		return pkg.SourceDir
+	}
+	return filepath.Join(c.buildDir, pkg.Name, sourceDir)
+}
+
+// updateSourceDigest records the current digest of the package's source
+// tree in cache when it is tracked.
+func (c *cache) updateSourceDigest(pkg *config.Package, cache *Info) {
+	if !c.tracksSource(pkg) {
+		return
+	}
+	digest, err := sourceDigest(c.sourceRoot(pkg))
+	if err != nil {
+		logger.Warn("failed to hash source directory for %s: %v", pkg.Name, err)
+		digest = ""
+	}
+	cache.SourceDigest = digest
+}
+
+// sourceDigest returns a hash of the paths, sizes, modes and modification
+// times of every entry under dir, or "" if dir does not exist.
+func sourceDigest(dir string) (string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", nil
+	}
+
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00%d\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 func (c *cache) checkCommonCacheChanges(cache *Info, pkg *config.Package, sysroot, host string) (bool, string) {
 	if !stringSlicesEqual(cache.Env, pkg.Env) {
 		return true, "env vars changed"
 	}
 
+	if !stringSlicesEqual(cache.GlobalEnv, c.cfg.Env) {
+		return true, "global env vars changed"
+	}
+
 	if cache.Host != host {
 		return true, fmt.Sprintf("host changed from %q to %q", cache.Host, host)
 	}
@@ -205,7 +440,9 @@ func (c *cache) checkCommonCacheChanges(cache *Info, pkg *config.Package, sysroo
 	return false, ""
 }
 
-func (c *cache) needsRebuildWithReason(pkg *config.Package, sysroot, host string) (bool, string, error) {
+// NeedsRebuildWithReason is like NeedsRebuild, but also describes why the
+// package needs to be rebuilt.
+func (c *cache) NeedsRebuildWithReason(pkg *config.Package, sysroot, host string) (bool, string, error) {
 	pkgDir := filepath.Join(c.buildDir, pkg.Name)
 
 	logger.Debug("Checking if %s needs rebuild...", pkg.Name)
@@ -219,33 +456,104 @@ func (c *cache) needsRebuildWithReason(pkg *config.Package, sysroot, host string
 		return true, "no cache exists", nil
 	}
 
-	if cache.URL != pkg.URL {
+	if cache.Version != cacheVersion {
+		reason := fmt.Sprintf("cache version changed from %d to %d", cache.Version, cacheVersion)
+		logger.Debug("  %s needs rebuild: %s", pkg.Name, reason)
+		return true, reason, nil
+	}
+
+	if cache.PkgVersion != pkg.Version {
+		reason := fmt.Sprintf("version changed from %q to %q", cache.PkgVersion, pkg.Version)
+		logger.Debug("  %s needs rebuild: %s", pkg.Name, reason)
+		return true, reason, nil
+	}
+
+	if !pkg.HasURL(cache.URL) {
 		reason := fmt.Sprintf("URL changed from %q to %q", cache.URL, pkg.URL)
 		logger.Debug("  %s needs rebuild: %s", pkg.Name, reason)
 		return true, reason, nil
 	}
 
+	if change := cache.SourceChange(pkg); change != "" {
+		reason := change + " changed"
+		logger.Debug("  %s needs rebuild: %s", pkg.Name, reason)
+		return true, reason, nil
+	}
+
+	if cache.PreBuild != pkg.PreBuild {
+		logger.Debug("  %s needs rebuild: pre-build script changed", pkg.Name)
+		return true, "pre-build script changed", nil
+	}
+
 	if cache.Build != pkg.Build {
 		logger.Debug("  %s needs rebuild: build script changed", pkg.Name)
 		return true, "build script changed", nil
 	}
 
+	if cache.PostBuild != pkg.PostBuild {
+		logger.Debug("  %s needs rebuild: post-build script changed", pkg.Name)
+		return true, "post-build script changed", nil
+	}
+
+	// Caches written before the shell was recorded always used bash.
+	cachedShell := cache.Shell
+	if cachedShell == "" {
+		cachedShell = config.ShellBash
+	}
+	if cachedShell != pkg.ScriptShell() {
+		logger.Debug("  %s needs rebuild: script shell changed", pkg.Name)
+		return true, "script shell changed", nil
+	}
+
+	if cache.MakeJobs != pkg.MakeJobs {
+		logger.Debug("  %s needs rebuild: make_jobs changed", pkg.Name)
+		return true, "make_jobs changed", nil
+	}
+
+	if cache.Preamble != c.cfg.Preamble {
+		logger.Debug("  %s needs rebuild: script preamble changed", pkg.Name)
+		return true, "script preamble changed", nil
+	}
+
+	if c.cfg.SourceDateEpoch != "" && cache.SourceDateEpoch != c.cfg.SourceDateEpoch {
+		logger.Debug("  %s needs rebuild: SOURCE_DATE_EPOCH changed", pkg.Name)
+		return true, "SOURCE_DATE_EPOCH changed", nil
+	}
+
 	if changed, reason := c.checkCommonCacheChanges(cache, pkg, sysroot, host); changed {
 		logger.Debug("  %s needs rebuild: %s", pkg.Name, reason)
 		return true, reason, nil
 	}
 
+	if !pkg.Native && cache.Toolchain != c.cfg.Toolchain {
+		logger.Debug("  %s needs rebuild: toolchain changed", pkg.Name)
+		return true, "toolchain changed", nil
+	}
+
 	srcDir := filepath.Join(pkgDir, sourceDir)
-	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) && !cache.SourceDiscarded {
 		logger.Debug("  %s needs rebuild: source directory doesn't exist", pkg.Name)
 		return true, "source directory doesn't exist", nil
 	}
 
+	if c.tracksSource(pkg) && cache.SourceDigest != "" && !cache.SourceDiscarded {
+		digest, err := sourceDigest(c.sourceRoot(pkg))
+		if err != nil {
+			return false, "", fmt.Errorf("failed to hash source directory: %w", err)
+		}
+		if digest != cache.SourceDigest {
+			logger.Debug("  %s needs rebuild: source modified", pkg.Name)
+			return true, "source modified", nil
+		}
+	}
+
 	logger.Debug("  %s does not need rebuild (cache is valid)", pkg.Name)
 	return false, "", nil
 }
 
-func (c *cache) needsReinstallWithReason(pkg *config.Package, sysroot, host string) (bool, string, error) {
+// NeedsReinstallWithReason is like NeedsReinstall, but also describes why
+// the package needs to be reinstalled.
+func (c *cache) NeedsReinstallWithReason(pkg *config.Package, sysroot, host string) (bool, string, error) {
 	logger.Debug("Checking if %s needs reinstall...", pkg.Name)
 
 	cache, err := c.Read(pkg.Name)
@@ -262,45 +570,24 @@ func (c *cache) needsReinstallWithReason(pkg *config.Package, sysroot, host stri
 		return true, "install script changed", nil
 	}
 
+	if cache.PostInstall != pkg.PostInstall {
+		logger.Debug("  %s needs reinstall: post-install script changed", pkg.Name)
+		return true, "post-install script changed", nil
+	}
+
 	if changed, reason := c.checkCommonCacheChanges(cache, pkg, sysroot, host); changed {
 		logger.Debug("  %s needs reinstall: %s", pkg.Name, reason)
 		return true, reason, nil
 	}
 
-	logger.Debug("  %s does not need reinstall (cache is valid)", pkg.Name)
-	return false, "", nil
-}
-
-func (c *cache) findDependents(pkgName string, cfg *config.Config) []string {
-	directDependents := make(map[string][]string)
-	for _, pkg := range cfg.Packages {
-		for _, dep := range pkg.DependsOn {
-			directDependents[dep] = append(directDependents[dep], pkg.Name)
-		}
-	}
-
-	visited := make(map[string]bool)
-	queue := []string{pkgName}
-	var result []string
-
-	for len(queue) > 0 {
-		current := queue[0]
-		queue = queue[1:]
-
-		if visited[current] {
-			continue
-		}
-		visited[current] = true
-
-		for _, dep := range directDependents[current] {
-			if !visited[dep] {
-				queue = append(queue, dep)
-				result = append(result, dep)
-			}
-		}
+	if cache.DestDir != c.cfg.DestDir {
+		reason := fmt.Sprintf("destdir changed from %q to %q", cache.DestDir, c.cfg.DestDir)
+		logger.Debug("  %s needs reinstall: %s", pkg.Name, reason)
+		return true, reason, nil
 	}
 
-	return result
+	logger.Debug("  %s does not need reinstall (cache is valid)", pkg.Name)
+	return false, "", nil
 }
 
 func stringSlicesEqual(a, b []string) bool {
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// loadEnvFiles prepends the entries of each package's env_file to its env,
+// so that the inline env overrides them. Since the entries become part of the
+// env, editing the file rebuilds the package like editing the env does.
+func (c *Config) loadEnvFiles() error {
+	for i := range c.Packages {
+		pkg := &c.Packages[i]
+		if pkg.EnvFile == "" {
+			continue
+		}
+		path := pkg.EnvFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(pkg.PackagesFile), path)
+		}
+		entries, err := readEnvFile(path)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", pkg.Name, err)
+		}
+		pkg.Env = slices.Concat(entries, pkg.Env)
+	}
+	return nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of an env file, skipping blank lines
+// and comments. A value may be wrapped in single or double quotes, which are
+// removed.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env_file: %w", err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE, got %q", path, lineNum, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		entries = append(entries, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env_file: %w", err)
+	}
+	return entries, nil
+}
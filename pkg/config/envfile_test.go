@@ -0,0 +1,61 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig_EnvFile(t *testing.T) {
+	path := writeConfigFile(t, "packages.yaml", `
+templates:
+  base:
+    env: [CFLAGS=-O2]
+packages:
+  - name: foo
+    url: http://foo
+    template: base
+    build: make
+    install: make install
+    env_file: foo.env
+    env: [PREFIX=/opt]
+`)
+	envFile := `
+# Build settings
+PREFIX=/usr
+  LDFLAGS = -static
+MESSAGE="hello world"
+EMPTY=
+`
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "foo.env"), []byte(envFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	expected := []string{"CFLAGS=-O2", "PREFIX=/usr", "LDFLAGS=-static", "MESSAGE=hello world", "EMPTY=", "PREFIX=/opt"}
+	if env := cfg.GetPackageByName("foo").Env; !slices.Equal(env, expected) {
+		t.Errorf("Expected env %v, got %v", expected, env)
+	}
+}
+
+func TestLoadConfig_EnvFileErrors(t *testing.T) {
+	path := writeConfigFile(t, "packages.yaml", `
+packages:
+  - {name: foo, url: http://foo, build: make, install: make install, env_file: foo.env}
+`)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "package foo: failed to read env_file") {
+		t.Errorf("Expected a missing env_file to be an error, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "foo.env"), []byte("A=1\nnot an entry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "foo.env:2: expected KEY=VALUE") {
+		t.Errorf("Expected a malformed line to be an error, got %v", err)
+	}
+}
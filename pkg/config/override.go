@@ -0,0 +1,119 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// OverridesEnvVar is passed to package scripts with the overrides the build
+// was run with, so that makepkg invocations nested through $MAKEPKG apply
+// them too. Overrides are not passed on the command line, since their
+// values often contain spaces that $MAKEPKG cannot carry.
+const OverridesEnvVar = "MAKEPKG_OVERRIDES"
+
+// overrideFields lists the package fields an Override may change, in the
+// order they are documented.
+var overrideFields = []string{"url", "version", "pre_build", "build", "post_build", "install", "post_install", "env"}
+
+// Override replaces or extends a single field of a package. It is written
+// as PACKAGE.FIELD=VALUE, or PACKAGE.FIELD+=VALUE to append VALUE as a new
+// env entry or script line.
+type Override struct {
+	Package string
+	Field   string
+	Value   string
+	Append  bool
+}
+
+// ParseOverride parses an override of the form PACKAGE.FIELD=VALUE or
+// PACKAGE.FIELD+=VALUE. Package names may contain dots; the field is the
+// part of the key after the last one.
+func ParseOverride(s string) (Override, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return Override{}, fmt.Errorf("invalid override %q (expected PACKAGE.FIELD=VALUE)", s)
+	}
+
+	var o Override
+	o.Value = value
+	if strings.HasSuffix(key, "+") {
+		key = strings.TrimSuffix(key, "+")
+		o.Append = true
+	}
+	dot := strings.LastIndex(key, ".")
+	if dot <= 0 || dot == len(key)-1 {
+		return Override{}, fmt.Errorf("invalid override %q (expected PACKAGE.FIELD=VALUE)", s)
+	}
+	o.Package, o.Field = key[:dot], key[dot+1:]
+
+	if !slices.Contains(overrideFields, o.Field) {
+		return Override{}, fmt.Errorf("cannot override field %q (expected one of %s)", o.Field, strings.Join(overrideFields, ", "))
+	}
+	if o.Append && (o.Field == "url" || o.Field == "version") {
+		return Override{}, fmt.Errorf("cannot append to field %q", o.Field)
+	}
+	if o.Field == "env" && !strings.Contains(o.Value, "=") {
+		return Override{}, fmt.Errorf("invalid env override %q (expected NAME=VALUE)", o.Value)
+	}
+	return o, nil
+}
+
+// Apply applies the override to the named package in cfg. Values are
+// substituted along with the rest of the package, so they may refer to
+// variables like the configuration file does.
+func (o Override) Apply(cfg *Config) error {
+	pkg := cfg.GetPackageByName(o.Package)
+	if pkg == nil {
+		return fmt.Errorf("override of %s.%s references unknown package '%s'", o.Package, o.Field, o.Package)
+	}
+
+	switch o.Field {
+	case "url":
+		pkg.URL = o.Value
+	case "version":
+		pkg.Version = o.Value
+	case "pre_build":
+		pkg.PreBuild = o.script(pkg.PreBuild)
+	case "build":
+		pkg.Build = o.script(pkg.Build)
+	case "post_build":
+		pkg.PostBuild = o.script(pkg.PostBuild)
+	case "install":
+		pkg.Install = o.script(pkg.Install)
+	case "post_install":
+		pkg.PostInstall = o.script(pkg.PostInstall)
+	case "env":
+		if o.Append {
+			pkg.Env = append(slices.Clone(pkg.Env), o.Value)
+		} else {
+			pkg.Env = []string{o.Value}
+		}
+	}
+	return nil
+}
+
+// script returns the overridden value of a script field currently set to
+// script.
+func (o Override) script(script string) string {
+	if !o.Append || script == "" {
+		return o.Value
+	}
+	return strings.TrimRight(script, "\n") + "\n" + o.Value
+}
+
+// EncodeOverrides encodes overrides as the value of OverridesEnvVar.
+func EncodeOverrides(overrides []string) string {
+	data, _ := json.Marshal(overrides)
+	return string(data)
+}
+
+// DecodeOverrides decodes the overrides in a value of OverridesEnvVar.
+func DecodeOverrides(s string) ([]string, error) {
+	var overrides []string
+	if err := json.Unmarshal([]byte(s), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", OverridesEnvVar, err)
+	}
+	return overrides, nil
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseOverride(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Override
+	}{
+		{"foo.build=make -j1", Override{Package: "foo", Field: "build", Value: "make -j1"}},
+		{"foo.env+=CFLAGS=-O0 -g", Override{Package: "foo", Field: "env", Value: "CFLAGS=-O0 -g", Append: true}},
+		{"python3.12.url=https://example.com/a=b", Override{Package: "python3.12", Field: "url", Value: "https://example.com/a=b"}},
+		{"foo.install=", Override{Package: "foo", Field: "install"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseOverride(tt.input)
+		if err != nil {
+			t.Errorf("ParseOverride(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseOverride(%q) = %+v, expected %+v", tt.input, got, tt.expected)
+		}
+	}
+
+	for _, input := range []string{"foo.build", "build=make", ".build=make", "foo.=make", "foo.name=bar", "foo.url+=x", "foo.env=FOO"} {
+		if _, err := ParseOverride(input); err == nil {
+			t.Errorf("ParseOverride(%q): expected an error", input)
+		}
+	}
+}
+
+func TestOverride_Apply(t *testing.T) {
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "foo", URL: "https://example.com/foo.tar.gz", Build: "make", Install: "make install", Env: []string{"A=1"}},
+		},
+	}
+
+	for _, s := range []string{"foo.build+=make check", "foo.env+=B=2", "foo.url=https://mirror.example.com/foo.tar.gz"} {
+		o, err := ParseOverride(s)
+		if err != nil {
+			t.Fatalf("ParseOverride(%q) failed: %v", s, err)
+		}
+		if err := o.Apply(cfg); err != nil {
+			t.Fatalf("Apply(%q) failed: %v", s, err)
+		}
+	}
+
+	pkg := cfg.Packages[0]
+	if pkg.Build != "make\nmake check" {
+		t.Errorf("Expected the build script to be appended to, got %q", pkg.Build)
+	}
+	if !slices.Equal(pkg.Env, []string{"A=1", "B=2"}) {
+		t.Errorf("Expected the env entry to be appended, got %v", pkg.Env)
+	}
+	if pkg.URL != "https://mirror.example.com/foo.tar.gz" {
+		t.Errorf("Expected the URL to be replaced, got %q", pkg.URL)
+	}
+
+	if err := (Override{Package: "bar", Field: "build", Value: "make"}).Apply(cfg); err == nil {
+		t.Error("Expected an error for an unknown package")
+	}
+}
+
+func TestEncodeOverrides(t *testing.T) {
+	overrides := []string{"foo.build=make CFLAGS='-O0 -g'", "foo.env+=MSG=a \"b\"\nc"}
+	got, err := DecodeOverrides(EncodeOverrides(overrides))
+	if err != nil {
+		t.Fatalf("DecodeOverrides failed: %v", err)
+	}
+	if !slices.Equal(got, overrides) {
+		t.Errorf("Expected %q to round-trip, got %q", overrides, got)
+	}
+	if _, err := DecodeOverrides("foo.build=make"); err == nil {
+		t.Error("Expected an error for a value that is not a JSON array")
+	}
+}
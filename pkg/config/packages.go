@@ -1,9 +1,12 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/pelletier/go-toml/v2"
@@ -13,28 +16,199 @@ import (
 	"github.com/aar10n/makepkg/pkg/logger"
 )
 
+// Source is an additional source archive or repository for a package,
+// extracted into Dest relative to the package's source directory.
+type Source struct {
+	URL  string `yaml:"url" toml:"url" json:"url"`
+	Dest string `yaml:"dest,omitempty" toml:"dest,omitempty" json:"dest,omitempty"`
+}
+
 // Package represents a single package definition.
 type Package struct {
-	Name         string   `yaml:"name" toml:"name"`
-	URL          string   `yaml:"url" toml:"url"`
-	Native       bool     `yaml:"native,omitempty" toml:"native,omitempty"`
-	Build        string   `yaml:"build" toml:"build"`
-	Install      string   `yaml:"install" toml:"install"`
-	Clean        string   `yaml:"clean,omitempty" toml:"clean,omitempty"`
-	Env          []string `yaml:"env,omitempty" toml:"env,omitempty"`
-	DependsOn    []string `yaml:"depends_on,omitempty" toml:"depends_on,omitempty"`
-	PackagesFile string   `yaml:"-" toml:"-"`
+	Name            string            `yaml:"name" toml:"name" json:"name"`
+	Template        string            `yaml:"template,omitempty" toml:"template,omitempty" json:"template,omitempty"`
+	Version         string            `yaml:"version,omitempty" toml:"version,omitempty" json:"version,omitempty"`
+	URL             string            `yaml:"url" toml:"url" json:"url"`
+	Mirrors         []string          `yaml:"mirrors,omitempty" toml:"mirrors,omitempty" json:"mirrors,omitempty"`
+	Filename        string            `yaml:"filename,omitempty" toml:"filename,omitempty" json:"filename,omitempty"`
+	SourceDir       string            `yaml:"source_dir,omitempty" toml:"source_dir,omitempty" json:"source_dir,omitempty"`
+	SourceCopy      bool              `yaml:"source_copy,omitempty" toml:"source_copy,omitempty" json:"source_copy,omitempty"`
+	VCS             string            `yaml:"vcs,omitempty" toml:"vcs,omitempty" json:"vcs,omitempty"`
+	GitRef          string            `yaml:"git_ref,omitempty" toml:"git_ref,omitempty" json:"git_ref,omitempty"`
+	GitCommit       string            `yaml:"git_commit,omitempty" toml:"git_commit,omitempty" json:"git_commit,omitempty"`
+	GitSubmodules   bool              `yaml:"git_submodules,omitempty" toml:"git_submodules,omitempty" json:"git_submodules,omitempty"`
+	StripComponents *int              `yaml:"strip_components,omitempty" toml:"strip_components,omitempty" json:"strip_components,omitempty"`
+	HTTPHeaders     map[string]string `yaml:"http_headers,omitempty" toml:"http_headers,omitempty" json:"http_headers,omitempty"`
+	Sources         []Source          `yaml:"sources,omitempty" toml:"sources,omitempty" json:"sources,omitempty"`
+	Patches         []string          `yaml:"patches,omitempty" toml:"patches,omitempty" json:"patches,omitempty"`
+	Enabled         *bool             `yaml:"enabled,omitempty" toml:"enabled,omitempty" json:"enabled,omitempty"`
+	EnabledIf       string            `yaml:"enabled_if,omitempty" toml:"enabled_if,omitempty" json:"enabled_if,omitempty"`
+	Native          bool              `yaml:"native,omitempty" toml:"native,omitempty" json:"native,omitempty"`
+	OnlyArch        []string          `yaml:"only_arch,omitempty" toml:"only_arch,omitempty" json:"only_arch,omitempty"`
+	SkipArch        []string          `yaml:"skip_arch,omitempty" toml:"skip_arch,omitempty" json:"skip_arch,omitempty"`
+	PreBuild        string            `yaml:"pre_build,omitempty" toml:"pre_build,omitempty" json:"pre_build,omitempty"`
+	Build           string            `yaml:"build" toml:"build" json:"build"`
+	PostBuild       string            `yaml:"post_build,omitempty" toml:"post_build,omitempty" json:"post_build,omitempty"`
+	Install         string            `yaml:"install" toml:"install" json:"install"`
+	PostInstall     string            `yaml:"post_install,omitempty" toml:"post_install,omitempty" json:"post_install,omitempty"`
+	Clean           string            `yaml:"clean,omitempty" toml:"clean,omitempty" json:"clean,omitempty"`
+	Shell           string            `yaml:"shell,omitempty" toml:"shell,omitempty" json:"shell,omitempty"`
+	MakeJobs        int               `yaml:"make_jobs,omitempty" toml:"make_jobs,omitempty" json:"make_jobs,omitempty"`
+	Env             []string          `yaml:"env,omitempty" toml:"env,omitempty" json:"env,omitempty"`
+	EnvFile         string            `yaml:"env_file,omitempty" toml:"env_file,omitempty" json:"env_file,omitempty"`
+	DependsOn       []string          `yaml:"depends_on,omitempty" toml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	BuildDepends    []string          `yaml:"build_depends,omitempty" toml:"build_depends,omitempty" json:"build_depends,omitempty"`
+	RuntimeDepends  []string          `yaml:"runtime_depends,omitempty" toml:"runtime_depends,omitempty" json:"runtime_depends,omitempty"`
+	OptionalDepends []string          `yaml:"optional_depends,omitempty" toml:"optional_depends,omitempty" json:"optional_depends,omitempty"`
+	PackagesFile    string            `yaml:"-" toml:"-" json:"-"`
+
+	// SourceURL is the URL the source was downloaded from during this run.
+	SourceURL string `yaml:"-" toml:"-" json:"-"`
+	// SourceCommit is the commit checked out for git sources during this run.
+	SourceCommit string `yaml:"-" toml:"-" json:"-"`
+	// ArchiveSum is the sha256 of the source archive downloaded during this
+	// run, if one was saved.
+	ArchiveSum string `yaml:"-" toml:"-" json:"-"`
+	// SourceDateEpoch is the SOURCE_DATE_EPOCH the package is built with
+	// during this run.
+	SourceDateEpoch string `yaml:"-" toml:"-" json:"-"`
+}
+
+// URLs returns the package URL followed by its mirrors.
+func (p *Package) URLs() []string {
+	return append([]string{p.URL}, p.Mirrors...)
+}
+
+// BuildDependencies returns the packages that must be installed before the
+// package is built: those in depends_on, build_depends and optional_depends.
+// Optional dependencies may name packages that do not exist.
+func (p *Package) BuildDependencies() []string {
+	return uniqueNames(p.DependsOn, p.BuildDepends, p.OptionalDepends)
+}
+
+// Dependencies returns every package the package requires, at build time or
+// at runtime. Optional dependencies are not included.
+func (p *Package) Dependencies() []string {
+	return uniqueNames(p.DependsOn, p.BuildDepends, p.RuntimeDepends)
+}
+
+// uniqueNames concatenates lists, dropping repeated names.
+func uniqueNames(lists ...[]string) []string {
+	var names []string
+	for _, name := range slices.Concat(lists...) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Strip returns the number of leading path components removed from archive
+// entries during extraction, defaulting to 1.
+func (p *Package) Strip() int {
+	if p.StripComponents == nil {
+		return 1
+	}
+	return *p.StripComponents
+}
+
+// HasURL reports whether url is the package URL or one of its mirrors.
+func (p *Package) HasURL(url string) bool {
+	for _, u := range p.URLs() {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEnabled reports whether the package is enabled. A package is disabled
+// by enabled: false, or by an enabled_if condition that expands, against the
+// host environment, to an empty string, 0, false, no or off.
+func (p *Package) IsEnabled() bool {
+	if p.Enabled != nil && !*p.Enabled {
+		return false
+	}
+	if p.EnabledIf == "" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(env.SubstHost(p.EnabledIf))) {
+	case "", "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
+
+// VCSGit marks a package whose URL is a git repository regardless of its form.
+const VCSGit = "git"
+
+// Shells that package scripts can run under.
+const (
+	ShellBash = "bash"
+	ShellSh   = "sh"
+)
+
+// ScriptShell returns the shell that runs the package's scripts, defaulting
+// to bash.
+func (p *Package) ScriptShell() string {
+	if p.Shell == "" {
+		return ShellBash
+	}
+	return p.Shell
+}
+
+// SupportsArch reports whether the package should be built for arch. A
+// package with only_arch set is built only for the listed architectures, and
+// one with skip_arch set is built for all but the listed architectures.
+func (p *Package) SupportsArch(arch string) bool {
+	if len(p.OnlyArch) > 0 && !slices.Contains(p.OnlyArch, arch) {
+		return false
+	}
+	return !slices.Contains(p.SkipArch, arch)
 }
 
 func (p *Package) Subst(env env.Env) {
 	env = env.Clone()
+	p.Version = env.Subst(p.Version)
 	env.Set("PKG_NAME", p.Name)
+	if p.Version != "" {
+		env.Set("PKG_VERSION", p.Version)
+	}
 	env.Set("PKG_URL", p.URL)
 	env.Set("FILE_DIR", filepath.Dir(p.PackagesFile))
 
 	p.URL = env.Subst(p.URL)
+	for i, m := range p.Mirrors {
+		p.Mirrors[i] = env.Subst(m)
+	}
+	p.Filename = env.Subst(p.Filename)
+	if p.SourceDir != "" {
+		p.SourceDir = env.Subst(p.SourceDir)
+		if !filepath.IsAbs(p.SourceDir) {
+			p.SourceDir = filepath.Join(filepath.Dir(p.PackagesFile), p.SourceDir)
+		}
+	}
+	p.GitRef = env.Subst(p.GitRef)
+	p.GitCommit = env.Subst(p.GitCommit)
+	for key, value := range p.HTTPHeaders {
+		p.HTTPHeaders[key] = env.Subst(value)
+	}
+	for i := range p.Sources {
+		p.Sources[i].URL = env.Subst(p.Sources[i].URL)
+		p.Sources[i].Dest = env.Subst(p.Sources[i].Dest)
+	}
+	for i, patch := range p.Patches {
+		patch = env.Subst(patch)
+		if !filepath.IsAbs(patch) {
+			patch = filepath.Join(filepath.Dir(p.PackagesFile), patch)
+		}
+		p.Patches[i] = patch
+	}
+	p.PreBuild = env.Subst(p.PreBuild)
 	p.Build = env.Subst(p.Build)
+	p.PostBuild = env.Subst(p.PostBuild)
 	p.Install = env.Subst(p.Install)
+	p.PostInstall = env.Subst(p.PostInstall)
 	p.Clean = env.Subst(p.Clean)
 
 	for i, e := range p.Env {
@@ -44,9 +218,13 @@ func (p *Package) Subst(env env.Env) {
 
 // Config represents the overall package configuration file.
 type Config struct {
-	FilePath  string
-	Toolchain Toolchain `yaml:"toolchain" toml:"toolchain"`
-	Packages  []Package `yaml:"packages" toml:"packages"`
+	FilePath        string
+	Toolchain       Toolchain           `yaml:"toolchain" toml:"toolchain" json:"toolchain"`
+	Env             []string            `yaml:"env,omitempty" toml:"env,omitempty" json:"env,omitempty"`
+	ScriptPreamble  string              `yaml:"script_preamble,omitempty" toml:"script_preamble,omitempty" json:"script_preamble,omitempty"`
+	SysrootSkeleton []string            `yaml:"sysroot_skeleton,omitempty" toml:"sysroot_skeleton,omitempty" json:"sysroot_skeleton,omitempty"`
+	Templates       map[string]Template `yaml:"templates,omitempty" toml:"templates,omitempty" json:"templates,omitempty"`
+	Packages        []Package           `yaml:"packages" toml:"packages" json:"packages"`
 }
 
 // GetPackageByName finds a package by name in the config.
@@ -59,111 +237,210 @@ func (c *Config) GetPackageByName(name string) *Package {
 	return nil
 }
 
+// Dependents returns the packages that depend on the named package through
+// their build dependencies, directly or transitively, nearest first.
+func (c *Config) Dependents(pkgName string) []string {
+	directDependents := make(map[string][]string)
+	for _, pkg := range c.Packages {
+		for _, dep := range pkg.BuildDependencies() {
+			directDependents[dep] = append(directDependents[dep], pkg.Name)
+		}
+	}
+
+	visited := map[string]bool{pkgName: true}
+	queue := []string{pkgName}
+	var result []string
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, dep := range directDependents[current] {
+			if !visited[dep] {
+				visited[dep] = true
+				queue = append(queue, dep)
+				result = append(result, dep)
+			}
+		}
+	}
+
+	return result
+}
+
 // Validate performs comprehensive validation on the configuration.
 func (c *Config) Validate() error {
 	if len(c.Packages) == 0 {
 		return fmt.Errorf("no packages defined")
 	}
 
+	var errs []error
+	for _, dir := range c.SysrootSkeleton {
+		if !filepath.IsLocal(dir) {
+			errs = append(errs, fmt.Errorf("sysroot_skeleton entry %q is not a path within the sysroot", dir))
+		}
+	}
+
 	pkgNames := make(map[string]bool)
 	for i, pkg := range c.Packages {
 		if pkg.Name == "" {
-			return fmt.Errorf("package at index %d missing name", i)
+			errs = append(errs, fmt.Errorf("package at index %d missing name", i))
+			continue
 		}
 
 		if pkgNames[pkg.Name] {
-			return fmt.Errorf("duplicate package name: %s", pkg.Name)
+			errs = append(errs, fmt.Errorf("duplicate package name: %s", pkg.Name))
 		}
 		pkgNames[pkg.Name] = true
 
-		if pkg.URL == "" {
-			return fmt.Errorf("package %s missing URL", pkg.Name)
+		if pkg.URL == "" && pkg.SourceDir == "" {
+			errs = append(errs, fmt.Errorf("package %s missing URL", pkg.Name))
+		}
+		if pkg.URL != "" && pkg.SourceDir != "" {
+			errs = append(errs, fmt.Errorf("package %s has both url and source_dir", pkg.Name))
+		}
+		if pkg.SourceDir != "" && !pkg.SourceCopy && (len(pkg.Sources) > 0 || len(pkg.Patches) > 0) {
+			errs = append(errs, fmt.Errorf("package %s would modify its source_dir with sources or patches (set source_copy)", pkg.Name))
+		}
+		if pkg.SourceCopy && pkg.SourceDir == "" {
+			errs = append(errs, fmt.Errorf("package %s has source_copy without source_dir", pkg.Name))
 		}
 
 		if pkg.Build == "" {
-			return fmt.Errorf("package %s missing build command", pkg.Name)
+			errs = append(errs, fmt.Errorf("package %s missing build command", pkg.Name))
 		}
 
 		if pkg.Install == "" {
-			return fmt.Errorf("package %s missing install command", pkg.Name)
+			errs = append(errs, fmt.Errorf("package %s missing install command", pkg.Name))
 		}
 
-		for _, dep := range pkg.DependsOn {
-			if dep == pkg.Name {
-				return fmt.Errorf("package %s depends on itself", pkg.Name)
+		if pkg.Filename != "" && (filepath.Base(pkg.Filename) != pkg.Filename || pkg.Filename == "." || pkg.Filename == "..") {
+			errs = append(errs, fmt.Errorf("package %s has invalid filename %q", pkg.Name, pkg.Filename))
+		}
+
+		for _, src := range pkg.Sources {
+			if src.URL == "" {
+				errs = append(errs, fmt.Errorf("package %s has a source missing URL", pkg.Name))
+			}
+			if src.Dest != "" && !filepath.IsLocal(src.Dest) {
+				errs = append(errs, fmt.Errorf("package %s source %s has invalid dest %q", pkg.Name, src.URL, src.Dest))
 			}
 		}
+
+		if pkg.VCS != "" && pkg.VCS != VCSGit {
+			errs = append(errs, fmt.Errorf("package %s has unsupported vcs %q (expected git)", pkg.Name, pkg.VCS))
+		}
+
+		if pkg.Shell != "" && pkg.Shell != ShellBash && pkg.Shell != ShellSh {
+			errs = append(errs, fmt.Errorf("package %s has unsupported shell %q (expected bash or sh)", pkg.Name, pkg.Shell))
+		}
+
+		if pkg.StripComponents != nil && *pkg.StripComponents < 0 {
+			errs = append(errs, fmt.Errorf("package %s has negative strip_components", pkg.Name))
+		}
+
+		if pkg.MakeJobs < 0 {
+			errs = append(errs, fmt.Errorf("package %s has negative make_jobs", pkg.Name))
+		}
+
+		if slices.Contains(pkg.Dependencies(), pkg.Name) || slices.Contains(pkg.OptionalDepends, pkg.Name) {
+			errs = append(errs, fmt.Errorf("package %s depends on itself", pkg.Name))
+		}
 	}
 
-	if err := c.validateDependencies(); err != nil {
-		return err
+	errs = append(errs, c.validateDependencies()...)
+	return errors.Join(errs...)
+}
+
+// DuplicateURLs returns groups of the named packages that reference an
+// identical source URL, in configuration order. URLs are compared as they
+// are, so the packages should be substituted first.
+func (c *Config) DuplicateURLs(names []string) [][]string {
+	byURL := make(map[string][]string)
+	var urls []string
+	for _, pkg := range c.Packages {
+		if pkg.URL == "" || !slices.Contains(names, pkg.Name) {
+			continue
+		}
+		if _, ok := byURL[pkg.URL]; !ok {
+			urls = append(urls, pkg.URL)
+		}
+		byURL[pkg.URL] = append(byURL[pkg.URL], pkg.Name)
 	}
 
-	return nil
+	var groups [][]string
+	for _, url := range urls {
+		if len(byURL[url]) > 1 {
+			groups = append(groups, byURL[url])
+		}
+	}
+	return groups
 }
 
-func (c *Config) validateDependencies() error {
+func (c *Config) validateDependencies() []error {
 	pkgMap := make(map[string]*Package)
 	for i := range c.Packages {
 		pkgMap[c.Packages[i].Name] = &c.Packages[i]
 	}
 
+	var errs []error
 	for _, pkg := range c.Packages {
-		for _, dep := range pkg.DependsOn {
-			if _, exists := pkgMap[dep]; !exists {
-				return fmt.Errorf("package %s depends on non-existent package %s", pkg.Name, dep)
+		for _, dep := range pkg.Dependencies() {
+			depPkg, exists := pkgMap[dep]
+			if !exists {
+				errs = append(errs, fmt.Errorf("package %s depends on non-existent package %s", pkg.Name, dep))
+			} else if !depPkg.IsEnabled() && pkg.IsEnabled() {
+				errs = append(errs, fmt.Errorf("package %s depends on disabled package %s", pkg.Name, dep))
 			}
 		}
 	}
 
-	if err := c.detectCircularDependencies(); err != nil {
-		return err
-	}
-
-	return nil
+	return append(errs, c.detectCircularDependencies()...)
 }
 
-func (c *Config) detectCircularDependencies() error {
+// detectCircularDependencies returns an error for each build dependency that
+// closes a cycle. Runtime dependencies may form cycles, since they do not
+// order the build. Self-dependencies are reported separately by Validate.
+func (c *Config) detectCircularDependencies() []error {
 	visited := make(map[string]bool)
 	recStack := make(map[string]bool)
+	var errs []error
 
-	var visit func(pkgName string) error
-	visit = func(pkgName string) error {
+	var visit func(pkgName string)
+	visit = func(pkgName string) {
 		visited[pkgName] = true
 		recStack[pkgName] = true
 
 		pkg := c.GetPackageByName(pkgName)
 		if pkg == nil {
-			return nil
+			return
 		}
 
-		for _, dep := range pkg.DependsOn {
+		for _, dep := range pkg.BuildDependencies() {
+			if dep == pkgName {
+				continue
+			}
 			if !visited[dep] {
-				if err := visit(dep); err != nil {
-					return err
-				}
+				visit(dep)
 			} else if recStack[dep] {
-				return fmt.Errorf("circular dependency detected: %s -> %s", pkgName, dep)
+				errs = append(errs, fmt.Errorf("circular dependency detected: %s -> %s", pkgName, dep))
 			}
 		}
 
 		recStack[pkgName] = false
-		return nil
 	}
 
 	for _, pkg := range c.Packages {
 		if !visited[pkg.Name] {
-			if err := visit(pkg.Name); err != nil {
-				return err
-			}
+			visit(pkg.Name)
 		}
 	}
 
-	return nil
+	return errs
 }
 
 // LoadConfig reads and parses a package configuration file (YAML or TOML).
-// If path is empty, it tries to find a config file automatically.
+// If path is empty, it tries to find a config file automatically. Remote
+// configurations must be downloaded with FetchRemoteConfig first.
 func LoadConfig(configPath string) (*Config, error) {
 	if configPath == "" {
 		logger.Debug("No config file specified, attempting auto-discovery")
@@ -176,8 +453,11 @@ func LoadConfig(configPath string) (*Config, error) {
 
 	logger.Debug("Loading configuration from: %s", configPath)
 
-	var err error
-	configPath, err = filepath.Abs(configPath)
+	if IsRemote(configPath) {
+		return nil, fmt.Errorf("remote configuration %s must be fetched with FetchRemoteConfig first", configPath)
+	}
+
+	configPath, err := filepath.Abs(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve packages path: %w", err)
 	}
@@ -197,6 +477,10 @@ func LoadConfig(configPath string) (*Config, error) {
 		if err := yaml.Unmarshal(data, &config); err != nil {
 			return nil, fmt.Errorf("failed to parse YAML: %w", err)
 		}
+	case ".json":
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %w", err)
+		}
 	default:
 		return nil, fmt.Errorf("unsupported config type: %s", filepath.Ext(configPath))
 	}
@@ -210,6 +494,12 @@ func LoadConfig(configPath string) (*Config, error) {
 	for i := range config.Packages {
 		config.Packages[i].PackagesFile = configPath
 	}
+	if err := config.loadEnvFiles(); err != nil {
+		return nil, err
+	}
+	if err := config.applyTemplates(); err != nil {
+		return nil, err
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -218,7 +508,7 @@ func LoadConfig(configPath string) (*Config, error) {
 }
 
 func findConfigFile() (string, error) {
-	candidates := []string{"packages.yaml", "packages.yml", "packages.toml"}
+	candidates := []string{"packages.yaml", "packages.yml", "packages.toml", "packages.json"}
 
 	for _, candidate := range candidates {
 		if _, err := os.Stat(candidate); err == nil {
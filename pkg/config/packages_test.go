@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/env"
+)
+
+func TestValidate_ReportsAllErrors(t *testing.T) {
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Install: "make install", DependsOn: []string{"b", "missing"}},
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"d"}},
+			{Name: "d", URL: "http://d", Build: "make", Install: "make install", DependsOn: []string{"c"}},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors, got nil")
+	}
+
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("Expected a joined error, got %T", err)
+	}
+
+	expected := []string{
+		"package a missing URL",
+		"package b missing build command",
+		"package b depends on itself",
+		"duplicate package name: a",
+		"package b depends on non-existent package missing",
+		"circular dependency detected: d -> c",
+	}
+	errs := joined.Unwrap()
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(errs), err)
+	}
+	for i, msg := range expected {
+		if errs[i].Error() != msg {
+			t.Errorf("Error %d: expected %q, got %q", i, msg, errs[i].Error())
+		}
+	}
+}
+
+func TestValidate_Valid(t *testing.T) {
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install"},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+		},
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestValidate_NoPackages(t *testing.T) {
+	cfg := &Config{}
+
+	err := cfg.Validate()
+	if err == nil || errors.Unwrap(err) != nil || err.Error() != "no packages defined" {
+		t.Errorf("Expected \"no packages defined\", got %v", err)
+	}
+}
+
+func TestValidate_DisabledDependency(t *testing.T) {
+	t.Setenv("WITH_X", "")
+	disabled := false
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "a", URL: "http://a", Build: "make", Install: "make install", Enabled: &disabled},
+			{Name: "b", URL: "http://b", Build: "make", Install: "make install", DependsOn: []string{"a"}},
+			{Name: "c", URL: "http://c", Build: "make", Install: "make install", DependsOn: []string{"a"}, EnabledIf: "${WITH_X}"},
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil || err.Error() != "package b depends on disabled package a" {
+		t.Errorf("Expected \"package b depends on disabled package a\", got %v", err)
+	}
+}
+
+func TestValidate_SourceDir(t *testing.T) {
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "a", SourceDir: "/src/a", Build: "make", Install: "make install"},
+			{Name: "b", SourceDir: "/src/b", SourceCopy: true, Patches: []string{"b.patch"}, Build: "make", Install: "make install"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cfg.Packages = append(cfg.Packages,
+		Package{Name: "c", URL: "http://c", SourceDir: "/src/c", Build: "make", Install: "make install"},
+		Package{Name: "d", SourceDir: "/src/d", Patches: []string{"d.patch"}, Build: "make", Install: "make install"},
+		Package{Name: "e", URL: "http://e", SourceCopy: true, Build: "make", Install: "make install"},
+	)
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected validation errors, got nil")
+	}
+	expected := "package c has both url and source_dir\n" +
+		"package d would modify its source_dir with sources or patches (set source_copy)\n" +
+		"package e has source_copy without source_dir"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestIsEnabled(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		pkg      Package
+		value    string
+		expected bool
+	}{
+		{Package{}, "", true},
+		{Package{Enabled: &disabled}, "1", false},
+		{Package{EnabledIf: "${WITH_X}"}, "", false},
+		{Package{EnabledIf: "${WITH_X}"}, "Off", false},
+		{Package{EnabledIf: "${WITH_X}"}, "0", false},
+		{Package{EnabledIf: "${WITH_X}"}, "yes", true},
+		{Package{EnabledIf: "${WITH_X:-1}"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("WITH_X", tt.value)
+		if got := tt.pkg.IsEnabled(); got != tt.expected {
+			t.Errorf("IsEnabled(%+v) with WITH_X=%q: expected %v, got %v", tt.pkg, tt.value, tt.expected, got)
+		}
+	}
+}
+
+func TestSubst_Version(t *testing.T) {
+	pkg := Package{
+		Name:    "foo",
+		Version: "1.2.3",
+		URL:     "https://example.com/${PKG_NAME}-${PKG_VERSION}.tar.gz",
+		Build:   "./configure --prefix=/opt/foo-${PKG_VERSION}",
+	}
+	pkg.Subst(env.NewManager())
+
+	if expected := "https://example.com/foo-1.2.3.tar.gz"; pkg.URL != expected {
+		t.Errorf("Expected URL %q, got %q", expected, pkg.URL)
+	}
+	if expected := "./configure --prefix=/opt/foo-1.2.3"; pkg.Build != expected {
+		t.Errorf("Expected build script %q, got %q", expected, pkg.Build)
+	}
+}
+
+func TestDuplicateURLs(t *testing.T) {
+	cfg := &Config{
+		Packages: []Package{
+			{Name: "a", Version: "1.0", URL: "https://example.com/foo-${PKG_VERSION}.tar.gz"},
+			{Name: "b", Version: "2.0", URL: "https://example.com/foo-${PKG_VERSION}.tar.gz"},
+			{Name: "c", Version: "1.0", URL: "https://example.com/foo-1.0.tar.gz"},
+			{Name: "d", Version: "2.0", URL: "https://example.com/foo-2.0.tar.gz"},
+		},
+	}
+	for i := range cfg.Packages {
+		cfg.Packages[i].Subst(env.NewManager())
+	}
+
+	groups := cfg.DuplicateURLs([]string{"a", "b", "c"})
+	if len(groups) != 1 || len(groups[0]) != 2 || groups[0][0] != "a" || groups[0][1] != "c" {
+		t.Errorf("Expected only a and c to share a URL, got %v", groups)
+	}
+}
+
+func TestSubst_ShellDefaults(t *testing.T) {
+	cfg, err := LoadConfig("../../examples/packages.test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zlib := cfg.GetPackageByName("zlib")
+	if zlib == nil {
+		t.Fatal("Expected zlib in examples/packages.test.yaml")
+	}
+
+	pkg := *zlib
+	pkg.Subst(env.NewManager())
+	if !strings.Contains(pkg.Build, `make AR="${AR:-ar} rc"`) {
+		t.Errorf("Expected ${AR:-ar} to be left for the shell, got %q", pkg.Build)
+	}
+
+	pkg = *zlib
+	m := env.NewManager()
+	m.Set("AR", "llvm-ar")
+	pkg.Subst(m)
+	if !strings.Contains(pkg.Build, `make AR="llvm-ar rc"`) {
+		t.Errorf("Expected the toolchain AR to be used, got %q", pkg.Build)
+	}
+
+	loop := Package{Name: "loop", Build: `for f in *.patch; do echo "${f:-none}"; done`}
+	loop.Subst(env.NewManager())
+	if !strings.Contains(loop.Build, `"${f:-none}"`) {
+		t.Errorf("Expected the shell loop variable to be left alone, got %q", loop.Build)
+	}
+}
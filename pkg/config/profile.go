@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+// Profile selects a set of root packages from a package configuration and
+// applies run-specific overrides on top of it.
+type Profile struct {
+	FilePath  string     `yaml:"-" toml:"-" json:"-"`
+	Config    string     `yaml:"config" toml:"config" json:"config"`
+	Packages  []string   `yaml:"packages,omitempty" toml:"packages,omitempty" json:"packages,omitempty"`
+	Env       []string   `yaml:"env,omitempty" toml:"env,omitempty" json:"env,omitempty"`
+	Sysroot   string     `yaml:"sysroot,omitempty" toml:"sysroot,omitempty" json:"sysroot,omitempty"`
+	Toolchain *Toolchain `yaml:"toolchain,omitempty" toml:"toolchain,omitempty" json:"toolchain,omitempty"`
+}
+
+// LoadProfile reads and parses a profile file (YAML, TOML or JSON).
+// Relative paths in the profile are resolved against the profile's directory.
+func LoadProfile(path string) (*Profile, error) {
+	logger.Debug("Loading profile from: %s", path)
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve profile path: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+
+	var profile Profile
+	switch filepath.Ext(path) {
+	case ".toml":
+		if err := toml.Unmarshal(data, &profile); err != nil {
+			return nil, fmt.Errorf("failed to parse profile TOML: %w", err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &profile); err != nil {
+			return nil, fmt.Errorf("failed to parse profile YAML: %w", err)
+		}
+	case ".json":
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return nil, fmt.Errorf("failed to parse profile JSON: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported profile type: %s", filepath.Ext(path))
+	}
+
+	profile.FilePath = path
+	dir := filepath.Dir(path)
+	if profile.Config != "" && !filepath.IsAbs(profile.Config) {
+		profile.Config = filepath.Join(dir, profile.Config)
+	}
+	if profile.Sysroot != "" && !filepath.IsAbs(profile.Sysroot) {
+		profile.Sysroot = filepath.Join(dir, profile.Sysroot)
+	}
+	if profile.Toolchain != nil && profile.Toolchain.Bin != "" && !filepath.IsAbs(profile.Toolchain.Bin) {
+		profile.Toolchain.Bin = filepath.Join(dir, profile.Toolchain.Bin)
+	}
+
+	return &profile, nil
+}
+
+// Apply applies the profile's overrides to a loaded configuration.
+// Profile env entries are appended to every package's env so that they take
+// precedence over the package's own values, and the profile toolchain is
+// merged over the configuration's toolchain. The toolchain keeps its original
+// file path so that recursive makepkg invocations load the same files.
+func (p *Profile) Apply(cfg *Config) error {
+	for _, name := range p.Packages {
+		if cfg.GetPackageByName(name) == nil {
+			return fmt.Errorf("profile %s references unknown package '%s'", p.FilePath, name)
+		}
+	}
+
+	if len(p.Env) > 0 {
+		for i := range cfg.Packages {
+			cfg.Packages[i].Env = append(cfg.Packages[i].Env, p.Env...)
+		}
+	}
+
+	if p.Toolchain != nil {
+		filePath := cfg.Toolchain.FilePath
+		cfg.Toolchain = MergeToolchainConfig(&cfg.Toolchain, p.Toolchain)
+		cfg.Toolchain.FilePath = filePath
+	}
+	return nil
+}
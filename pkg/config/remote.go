@@ -0,0 +1,64 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aar10n/makepkg/pkg/download"
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+// remoteConfigDir is the directory of the build directory that remote
+// configuration files are downloaded to.
+const remoteConfigDir = ".remote-config"
+
+// IsRemote reports whether a configuration path refers to an http(s) URL.
+func IsRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// FetchRemoteConfig downloads a remote configuration file into buildDir and
+// returns the local path. Each URL is kept in a directory named after its
+// hash, so the path, and with it FILE_DIR and PKGS_ROOT, is the same on every
+// run. The file keeps its original name so the format can still be detected
+// from the extension, and is downloaded again on every run. Remote
+// configurations must be self-contained, since relative references resolve
+// against the download directory.
+func FetchRemoteConfig(ctx context.Context, rawURL, buildDir string, cfg download.DownloaderConfig) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid config URL: %w", err)
+	}
+	name := path.Base(u.Path)
+	if name == "" || name == "/" || name == "." {
+		return "", fmt.Errorf("cannot determine config file name from URL: %s", rawURL)
+	}
+
+	sum := sha256.Sum256([]byte(rawURL))
+	dir := filepath.Join(buildDir, remoteConfigDir, hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Download to a temporary name so that a failed download does not leave
+	// a partial file behind, and the previous copy is never reused as is.
+	configPath := filepath.Join(dir, name)
+	tmpPath := configPath + ".download"
+	os.Remove(tmpPath)
+	logger.Debug("Downloading remote configuration %s to %s", rawURL, configPath)
+	if err := download.FetchFile(ctx, tmpPath, rawURL, cfg); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to download config: %w", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		return "", fmt.Errorf("failed to save config: %w", err)
+	}
+	return configPath, nil
+}
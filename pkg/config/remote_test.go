@@ -0,0 +1,53 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/download"
+)
+
+func TestFetchRemoteConfig(t *testing.T) {
+	version := "1.0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "packages:\n  - name: foo\n    version: %q\n    url: http://foo\n    build: make\n    install: make install\n", version)
+	}))
+	defer server.Close()
+
+	buildDir := t.TempDir()
+	url := server.URL + "/configs/packages.yaml"
+	first, err := FetchRemoteConfig(context.Background(), url, buildDir, download.DownloaderConfig{Retries: 1})
+	if err != nil {
+		t.Fatalf("FetchRemoteConfig failed: %v", err)
+	}
+	if filepath.Base(first) != "packages.yaml" || filepath.Dir(filepath.Dir(first)) != filepath.Join(buildDir, remoteConfigDir) {
+		t.Errorf("Expected the config to be kept under the build directory, got %s", first)
+	}
+
+	// A second run reuses the same path but not the old contents.
+	version = "2.0"
+	second, err := FetchRemoteConfig(context.Background(), url, buildDir, download.DownloaderConfig{Retries: 1})
+	if err != nil {
+		t.Fatalf("FetchRemoteConfig failed: %v", err)
+	}
+	if second != first {
+		t.Errorf("Expected the same path on every run, got %s and %s", first, second)
+	}
+	cfg, err := LoadConfig(second)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Packages[0].Version != "2.0" {
+		t.Errorf("Expected the config to be downloaded again, got version %q", cfg.Packages[0].Version)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(second))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the config file to be left behind, got %v", entries)
+	}
+}
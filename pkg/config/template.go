@@ -0,0 +1,97 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Template holds default scripts and env for the packages that reference it
+// by name. A template may itself be based on another template.
+type Template struct {
+	Template    string   `yaml:"template,omitempty" toml:"template,omitempty" json:"template,omitempty"`
+	PreBuild    string   `yaml:"pre_build,omitempty" toml:"pre_build,omitempty" json:"pre_build,omitempty"`
+	Build       string   `yaml:"build,omitempty" toml:"build,omitempty" json:"build,omitempty"`
+	PostBuild   string   `yaml:"post_build,omitempty" toml:"post_build,omitempty" json:"post_build,omitempty"`
+	Install     string   `yaml:"install,omitempty" toml:"install,omitempty" json:"install,omitempty"`
+	PostInstall string   `yaml:"post_install,omitempty" toml:"post_install,omitempty" json:"post_install,omitempty"`
+	Clean       string   `yaml:"clean,omitempty" toml:"clean,omitempty" json:"clean,omitempty"`
+	Shell       string   `yaml:"shell,omitempty" toml:"shell,omitempty" json:"shell,omitempty"`
+	Env         []string `yaml:"env,omitempty" toml:"env,omitempty" json:"env,omitempty"`
+}
+
+// extend returns t with the fields it leaves empty filled in from base. The
+// env of base comes first, so that the entries of t take precedence.
+func (t Template) extend(base Template) Template {
+	t.PreBuild = cmp.Or(t.PreBuild, base.PreBuild)
+	t.Build = cmp.Or(t.Build, base.Build)
+	t.PostBuild = cmp.Or(t.PostBuild, base.PostBuild)
+	t.Install = cmp.Or(t.Install, base.Install)
+	t.PostInstall = cmp.Or(t.PostInstall, base.PostInstall)
+	t.Clean = cmp.Or(t.Clean, base.Clean)
+	t.Shell = cmp.Or(t.Shell, base.Shell)
+	t.Env = slices.Concat(base.Env, t.Env)
+	return t
+}
+
+// applyTemplates fills in the scripts, shell and env that each package
+// leaves unset from the template it references. Templates may be defined in
+// any order and be based on one another, and must all resolve even if no
+// package uses them.
+func (c *Config) applyTemplates() error {
+	resolved := make(map[string]Template)
+
+	var resolve func(name string, chain []string) (Template, error)
+	resolve = func(name string, chain []string) (Template, error) {
+		if t, ok := resolved[name]; ok {
+			return t, nil
+		}
+		if slices.Contains(chain, name) {
+			return Template{}, fmt.Errorf("circular template reference: %s", strings.Join(append(chain, name), " -> "))
+		}
+		t, ok := c.Templates[name]
+		if !ok {
+			if len(chain) == 0 {
+				return Template{}, fmt.Errorf("unknown template %q", name)
+			}
+			return Template{}, fmt.Errorf("template %s is based on unknown template %q", chain[len(chain)-1], name)
+		}
+		if t.Template != "" {
+			base, err := resolve(t.Template, append(chain, name))
+			if err != nil {
+				return Template{}, err
+			}
+			t = t.extend(base)
+		}
+		resolved[name] = t
+		return t, nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(c.Templates)) {
+		if _, err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Packages {
+		pkg := &c.Packages[i]
+		if pkg.Template == "" {
+			continue
+		}
+		t, err := resolve(pkg.Template, nil)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", pkg.Name, err)
+		}
+		pkg.PreBuild = cmp.Or(pkg.PreBuild, t.PreBuild)
+		pkg.Build = cmp.Or(pkg.Build, t.Build)
+		pkg.PostBuild = cmp.Or(pkg.PostBuild, t.PostBuild)
+		pkg.Install = cmp.Or(pkg.Install, t.Install)
+		pkg.PostInstall = cmp.Or(pkg.PostInstall, t.PostInstall)
+		pkg.Clean = cmp.Or(pkg.Clean, t.Clean)
+		pkg.Shell = cmp.Or(pkg.Shell, t.Shell)
+		pkg.Env = slices.Concat(t.Env, pkg.Env)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_Templates(t *testing.T) {
+	path := writeConfigFile(t, "packages.yaml", `
+x-urls: &mirrors
+  mirrors: [https://mirror.example.com/pkg.tar.gz]
+
+templates:
+  static:
+    template: autotools
+    env: [LDFLAGS=-static]
+  autotools:
+    build: |
+      mkpkg::configure
+      make
+    install: mkpkg::make_install
+    env: [CFLAGS=-O2, LDFLAGS=]
+
+packages:
+  - name: zlib
+    url: https://example.com/zlib.tar.gz
+    template: static
+    <<: *mirrors
+  - name: file
+    url: https://example.com/file.tar.gz
+    template: autotools
+    build: make -C src
+    env: [CFLAGS=-O0]
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	zlib := cfg.GetPackageByName("zlib")
+	if zlib.Build != "mkpkg::configure\nmake\n" || zlib.Install != "mkpkg::make_install" {
+		t.Errorf("Expected zlib to get the scripts of the base template, got %q and %q", zlib.Build, zlib.Install)
+	}
+	if expected := []string{"CFLAGS=-O2", "LDFLAGS=", "LDFLAGS=-static"}; !slices.Equal(zlib.Env, expected) {
+		t.Errorf("Expected zlib env %v, got %v", expected, zlib.Env)
+	}
+	if !slices.Equal(zlib.Mirrors, []string{"https://mirror.example.com/pkg.tar.gz"}) {
+		t.Errorf("Expected the merge key to set zlib's mirrors, got %v", zlib.Mirrors)
+	}
+
+	file := cfg.GetPackageByName("file")
+	if file.Build != "make -C src" || file.Install != "mkpkg::make_install" {
+		t.Errorf("Expected file to override only the build script, got %q and %q", file.Build, file.Install)
+	}
+	if expected := []string{"CFLAGS=-O2", "LDFLAGS=", "CFLAGS=-O0"}; !slices.Equal(file.Env, expected) {
+		t.Errorf("Expected file env %v, got %v", expected, file.Env)
+	}
+}
+
+func TestLoadConfig_TemplateErrors(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{`
+packages:
+  - {name: foo, url: http://foo, template: missing}
+`, `package foo: unknown template "missing"`},
+		{`
+templates:
+  a: {template: missing, build: make}
+packages:
+  - {name: foo, url: http://foo, build: make, install: make install}
+`, `template a is based on unknown template "missing"`},
+		{`
+templates:
+  a: {template: b}
+  b: {template: a}
+packages:
+  - {name: foo, url: http://foo, build: make, install: make install}
+`, "circular template reference: a -> b -> a"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfigFile(t, "packages.yaml", tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("Expected an error containing %q, got %v", tt.expected, err)
+		}
+	}
+}
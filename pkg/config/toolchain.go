@@ -1,9 +1,13 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/pelletier/go-toml/v2"
@@ -26,12 +30,12 @@ var programAliases = map[string]string{
 
 // Toolchain represents toolchain configuration.
 type Toolchain struct {
-	FilePath      string   `yaml:"-" toml:"-"`
-	Arch          string   `yaml:"arch" toml:"arch"`
-	Bin           string   `yaml:"bin" toml:"bin"`
-	Host          string   `yaml:"host" toml:"host"`
-	CrossPrefix   string   `yaml:"cross_prefix" toml:"cross_prefix"`
-	ExtraPrograms []string `yaml:"extra_programs" toml:"extra_programs"`
+	FilePath      string   `yaml:"-" toml:"-" json:"-"`
+	Arch          string   `yaml:"arch" toml:"arch" json:"arch"`
+	Bin           string   `yaml:"bin" toml:"bin" json:"bin"`
+	Host          string   `yaml:"host" toml:"host" json:"host"`
+	CrossPrefix   string   `yaml:"cross_prefix" toml:"cross_prefix" json:"cross_prefix"`
+	ExtraPrograms []string `yaml:"extra_programs" toml:"extra_programs" json:"extra_programs"`
 }
 
 func (t *Toolchain) Subst(env env.Env) {
@@ -72,16 +76,46 @@ func (t *Toolchain) AddToEnv(env env.Env) {
 	}
 }
 
-// LoadToolchainConfig reads and parses a standalone toolchain configuration file (YAML or TOML).
+// Fingerprint returns a hash identifying the toolchain by its arch, host and
+// the resolved paths of the programs it provides.
+func (t *Toolchain) Fingerprint() string {
+	toolEnv := env.NewManager()
+	t.AddToEnv(toolEnv)
+	vars := toolEnv.ToSlice()
+	slices.Sort(vars)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "arch=%s\nhost=%s\n", t.Arch, t.Host)
+	for _, v := range vars {
+		// PATH comes from the host, not the toolchain
+		if strings.HasPrefix(v, "PATH=") {
+			continue
+		}
+		fmt.Fprintln(h, v)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// namedToolchains is the layout of a toolchain file that defines several
+// toolchains selected by name.
+type namedToolchains struct {
+	Toolchains map[string]Toolchain `yaml:"toolchains" toml:"toolchains" json:"toolchains"`
+}
+
+// LoadToolchainConfig reads and parses a standalone toolchain configuration file (YAML, TOML or JSON).
 // If path is empty, it tries to find a toolchain file automatically.
+// If name is non-empty, the toolchain of that name is selected from the file's toolchains map.
 // Returns the config, the resolved path, and any error.
-func LoadToolchainConfig(path string) (*Toolchain, string, error) {
+func LoadToolchainConfig(path, name string) (*Toolchain, string, error) {
 	if path == "" {
 		logger.Debug("No toolchain file specified, attempting auto-discovery")
 		var err error
 		path, err = findToolchainFile()
 		if err != nil {
 			logger.Debug("No toolchain file found (auto-discovery failed)")
+			if name != "" {
+				return nil, "", fmt.Errorf("toolchain %q requested but %w", name, err)
+			}
 			return nil, "", nil
 		}
 	}
@@ -99,35 +133,55 @@ func LoadToolchainConfig(path string) (*Toolchain, string, error) {
 		return nil, "", fmt.Errorf("failed to read toolchain file: %w", err)
 	}
 
-	var toolchainConfig Toolchain
+	var format string
+	var unmarshal func([]byte, any) error
 
 	ext := strings.ToLower(filepath.Ext(path))
 	switch ext {
 	case ".toml":
-		logger.Debug("Parsing toolchain file as TOML (based on .toml extension)")
-		if err := toml.Unmarshal(data, &toolchainConfig); err != nil {
-			return nil, "", fmt.Errorf("failed to parse toolchain TOML: %w", err)
-		}
+		format, unmarshal = "TOML", toml.Unmarshal
 	case ".yaml", ".yml":
-		logger.Debug("Parsing toolchain file as YAML (based on %s extension)", ext)
-		if err := yaml.Unmarshal(data, &toolchainConfig); err != nil {
-			return nil, "", fmt.Errorf("failed to parse toolchain YAML: %w", err)
-		}
+		format, unmarshal = "YAML", yaml.Unmarshal
+	case ".json":
+		format, unmarshal = "JSON", json.Unmarshal
 	default:
 		logger.Debug("No recognized extension, trying YAML then TOML")
-		if err := yaml.Unmarshal(data, &toolchainConfig); err != nil {
-			if tomlErr := toml.Unmarshal(data, &toolchainConfig); tomlErr != nil {
+		var probe namedToolchains
+		if err := yaml.Unmarshal(data, &probe); err != nil {
+			if tomlErr := toml.Unmarshal(data, &probe); tomlErr != nil {
 				return nil, "", fmt.Errorf("failed to parse toolchain file as YAML or TOML (yaml: %v, toml: %v)", err, tomlErr)
 			}
-			logger.Debug("Successfully parsed toolchain file as TOML")
+			format, unmarshal = "TOML", toml.Unmarshal
 		} else {
-			logger.Debug("Successfully parsed toolchain file as YAML")
+			format, unmarshal = "YAML", yaml.Unmarshal
 		}
 	}
+	logger.Debug("Parsing toolchain file as %s", format)
 
-	path, err = filepath.Abs(path)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to resolve toolchain file path: %w", err)
+	var named namedToolchains
+	if err := unmarshal(data, &named); err != nil {
+		return nil, "", fmt.Errorf("failed to parse toolchain %s: %w", format, err)
+	}
+
+	var toolchainConfig Toolchain
+	if name != "" {
+		tc, ok := named.Toolchains[name]
+		if !ok {
+			names := slices.Sorted(maps.Keys(named.Toolchains))
+			if len(names) == 0 {
+				return nil, "", fmt.Errorf("toolchain %q not found: %s does not define any named toolchains", name, path)
+			}
+			return nil, "", fmt.Errorf("toolchain %q not found in %s (available: %s)", name, path, strings.Join(names, ", "))
+		}
+		logger.Debug("Selected toolchain %q", name)
+		toolchainConfig = tc
+	} else {
+		if err := unmarshal(data, &toolchainConfig); err != nil {
+			return nil, "", fmt.Errorf("failed to parse toolchain %s: %w", format, err)
+		}
+		if len(named.Toolchains) > 0 && toolchainConfig.isEmpty() {
+			return nil, "", fmt.Errorf("%s defines named toolchains; select one with --toolchain-name", path)
+		}
 	}
 
 	toolchainConfig.FilePath = path
@@ -135,6 +189,11 @@ func LoadToolchainConfig(path string) (*Toolchain, string, error) {
 	return &toolchainConfig, path, nil
 }
 
+// isEmpty reports whether none of the toolchain's fields are set.
+func (t *Toolchain) isEmpty() bool {
+	return t.Arch == "" && t.Bin == "" && t.Host == "" && t.CrossPrefix == "" && len(t.ExtraPrograms) == 0
+}
+
 // MergeToolchainConfig merges a higher priority toolchain config into a base config.
 // Non-empty fields from the override config take precedence.
 func MergeToolchainConfig(base, override *Toolchain) Toolchain {
@@ -167,7 +226,7 @@ func MergeToolchainConfig(base, override *Toolchain) Toolchain {
 }
 
 func findToolchainFile() (string, error) {
-	candidates := []string{"toolchain.yaml", "toolchain.yml", "toolchain.toml"}
+	candidates := []string{"toolchain.yaml", "toolchain.yml", "toolchain.toml", "toolchain.json"}
 
 	logger.Debug("Searching for toolchain file in current directory")
 	for _, candidate := range candidates {
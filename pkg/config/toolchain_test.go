@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeToolchainFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write toolchain file: %v", err)
+	}
+	return path
+}
+
+func TestLoadToolchainConfig_Named(t *testing.T) {
+	path := writeToolchainFile(t, "toolchain.yaml", `
+toolchains:
+  x86_64:
+    arch: x86_64
+    host: x86_64-linux-musl
+  aarch64:
+    arch: aarch64
+    host: aarch64-linux-musl
+`)
+
+	tc, _, err := LoadToolchainConfig(path, "aarch64")
+	if err != nil {
+		t.Fatalf("LoadToolchainConfig failed: %v", err)
+	}
+	if tc.Arch != "aarch64" || tc.Host != "aarch64-linux-musl" {
+		t.Errorf("Expected the aarch64 toolchain, got %+v", tc)
+	}
+
+	_, _, err = LoadToolchainConfig(path, "riscv64")
+	if err == nil || !strings.Contains(err.Error(), "available: aarch64, x86_64") {
+		t.Errorf("Expected an error listing the available toolchains, got %v", err)
+	}
+
+	_, _, err = LoadToolchainConfig(path, "")
+	if err == nil || !strings.Contains(err.Error(), "--toolchain-name") {
+		t.Errorf("Expected an error asking for --toolchain-name, got %v", err)
+	}
+}
+
+func TestLoadToolchainConfig_Single(t *testing.T) {
+	path := writeToolchainFile(t, "toolchain.toml", `
+arch = "x86_64"
+host = "x86_64-linux-musl"
+`)
+
+	tc, _, err := LoadToolchainConfig(path, "")
+	if err != nil {
+		t.Fatalf("LoadToolchainConfig failed: %v", err)
+	}
+	if tc.Arch != "x86_64" || tc.Host != "x86_64-linux-musl" {
+		t.Errorf("Expected the x86_64 toolchain, got %+v", tc)
+	}
+}
@@ -0,0 +1,275 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+const (
+	cpioNewcMagic    = "070701"
+	cpioNewcCRCMagic = "070702"
+	cpioNewcHeader   = 110
+	cpioOdcMagic     = "070707"
+	cpioOdcHeader    = 76
+	cpioTrailer      = "TRAILER!!!"
+
+	cpioModeType    = 0170000
+	cpioModeDir     = 0040000
+	cpioModeReg     = 0100000
+	cpioModeSymlink = 0120000
+)
+
+// cpioHeader is a single entry in a cpio archive.
+type cpioHeader struct {
+	Name  string
+	Mode  uint32
+	Ino   uint32
+	Nlink uint32
+	Size  int64
+}
+
+// cpioReader reads entries from a cpio archive in the "newc" or "odc"
+// (POSIX.1 portable) format.
+type cpioReader struct {
+	r         io.Reader
+	remaining int64
+	pad       int64
+}
+
+func newCpioReader(r io.Reader) *cpioReader {
+	return &cpioReader{r: r}
+}
+
+// Next advances to the next entry, skipping any unread data of the current
+// one. It returns io.EOF at the archive trailer.
+func (c *cpioReader) Next() (*cpioHeader, error) {
+	if _, err := io.CopyN(io.Discard, c.r, c.remaining+c.pad); err != nil {
+		return nil, err
+	}
+	c.remaining, c.pad = 0, 0
+
+	magic := make([]byte, 6)
+	if _, err := io.ReadFull(c.r, magic); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var hdr *cpioHeader
+	var err error
+	switch string(magic) {
+	case cpioNewcMagic, cpioNewcCRCMagic:
+		hdr, err = c.readNewc()
+	case cpioOdcMagic:
+		hdr, err = c.readOdc()
+	default:
+		return nil, fmt.Errorf("unsupported cpio format (magic %q)", magic)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name == cpioTrailer {
+		return nil, io.EOF
+	}
+
+	c.remaining = hdr.Size
+	return hdr, nil
+}
+
+// readNewc reads the rest of a newc header, whose fields are hexadecimal and
+// whose name and data are padded to a multiple of four bytes.
+func (c *cpioReader) readNewc() (*cpioHeader, error) {
+	buf := make([]byte, cpioNewcHeader-6)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+
+	var fields [13]uint32
+	for i := range fields {
+		v, err := strconv.ParseUint(string(buf[i*8:8+i*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header: %w", err)
+		}
+		fields[i] = uint32(v)
+	}
+
+	nameSize := int64(fields[11])
+	name := make([]byte, nameSize+pad4(cpioNewcHeader+nameSize))
+	if _, err := io.ReadFull(c.r, name); err != nil {
+		return nil, err
+	}
+
+	hdr := &cpioHeader{
+		Name:  strings.TrimRight(string(name[:nameSize]), "\x00"),
+		Mode:  fields[1],
+		Ino:   fields[0],
+		Nlink: fields[4],
+		Size:  int64(fields[6]),
+	}
+	c.pad = pad4(hdr.Size)
+	return hdr, nil
+}
+
+// readOdc reads the rest of an odc header, whose fields are octal. Names and
+// data are not padded.
+func (c *cpioReader) readOdc() (*cpioHeader, error) {
+	buf := make([]byte, cpioOdcHeader-6)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return nil, err
+	}
+
+	// dev, ino, mode, uid, gid, nlink, rdev, mtime, namesize, filesize
+	widths := [10]int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+	var fields [10]uint64
+	off := 0
+	for i, w := range widths {
+		v, err := strconv.ParseUint(string(buf[off:off+w]), 8, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header: %w", err)
+		}
+		fields[i] = v
+		off += w
+	}
+
+	nameSize := int64(fields[8])
+	name := make([]byte, nameSize)
+	if _, err := io.ReadFull(c.r, name); err != nil {
+		return nil, err
+	}
+
+	hdr := &cpioHeader{
+		Name:  strings.TrimRight(string(name), "\x00"),
+		Mode:  uint32(fields[2]),
+		Ino:   uint32(fields[1]),
+		Nlink: uint32(fields[5]),
+		Size:  int64(fields[9]),
+	}
+	c.pad = 0
+	return hdr, nil
+}
+
+// Read reads from the data of the current entry.
+func (c *cpioReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// extractCpio extracts a cpio archive into targetDir, removing strip leading
+// path components from each entry. A leading "./" does not count as a
+// component.
+func extractCpio(r io.Reader, targetDir string, strip int) error {
+	cr := newCpioReader(r)
+
+	// newc stores the data for a set of hardlinks only with the last entry,
+	// so earlier empty entries are linked once the data has been written.
+	links := make(map[uint32][]string)
+
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read cpio: %w", err)
+		}
+
+		name, ok := stripComponents(hdr.Name, strip)
+		if !ok || name == "." {
+			if strip > 0 {
+				logger.Debug("Skipping %s: fewer than %d path components", hdr.Name, strip+1)
+			}
+			continue
+		}
+
+		typ := hdr.Mode & cpioModeType
+		target, ok := safeJoin(targetDir, name)
+		if !ok {
+			logger.Warn("Archive entry %s escapes the source directory", hdr.Name)
+			if typ == cpioModeReg {
+				return fmt.Errorf("archive entry %s escapes the source directory", hdr.Name)
+			}
+			continue
+		}
+
+		perm := os.FileMode(hdr.Mode & 0777)
+		switch typ {
+		case cpioModeDir:
+			if err := os.MkdirAll(target, perm|0700); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+		case cpioModeReg:
+			if hdr.Nlink > 1 && hdr.Size == 0 {
+				links[hdr.Ino] = append(links[hdr.Ino], target)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %w", err)
+			}
+
+			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, perm)
+			if err != nil {
+				return fmt.Errorf("failed to create file: %w", err)
+			}
+			if _, err := io.Copy(outFile, cr); err != nil {
+				outFile.Close()
+				return fmt.Errorf("failed to write file: %w", err)
+			}
+			outFile.Close()
+
+			for _, link := range links[hdr.Ino] {
+				if err := linkOrCopy(target, link); err != nil {
+					return err
+				}
+			}
+			delete(links, hdr.Ino)
+		case cpioModeSymlink:
+			linkname, err := io.ReadAll(cr)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink: %w", err)
+			}
+			if !safeLink(targetDir, target, string(linkname)) {
+				logger.Warn("Skipping symlink %s -> %s: target escapes the source directory", hdr.Name, linkname)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %w", err)
+			}
+			_ = os.Symlink(string(linkname), target)
+		}
+	}
+
+	// Any remaining hardlinks had no data entry, so they are empty files.
+	for _, targets := range links {
+		for _, target := range targets {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %w", err)
+			}
+			if err := os.WriteFile(target, nil, 0644); err != nil {
+				return fmt.Errorf("failed to create file: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
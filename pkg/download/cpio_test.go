@@ -0,0 +1,102 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type cpioEntry struct {
+	name string
+	mode uint32
+	data string
+}
+
+// writeCpio returns a newc or odc archive holding entries.
+func writeCpio(odc bool, entries []cpioEntry) []byte {
+	var buf bytes.Buffer
+	pad := func() {
+		if !odc {
+			buf.Write(make([]byte, pad4(int64(buf.Len()))))
+		}
+	}
+	for i, e := range append(entries, cpioEntry{name: cpioTrailer}) {
+		nameSize := len(e.name) + 1
+		if odc {
+			fmt.Fprintf(&buf, "%s%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o",
+				cpioOdcMagic, 0, i+1, e.mode, 0, 0, 1, 0, 0, nameSize, len(e.data))
+		} else {
+			fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+				cpioNewcMagic, i+1, e.mode, 0, 0, 1, 0, len(e.data), 0, 0, 0, 0, nameSize, 0)
+		}
+		buf.WriteString(e.name + "\x00")
+		pad()
+		buf.WriteString(e.data)
+		pad()
+	}
+	return buf.Bytes()
+}
+
+func TestExtractCpioArchive(t *testing.T) {
+	entries := []cpioEntry{
+		{name: "./fw-1.0", mode: cpioModeDir | 0755},
+		{name: "./fw-1.0/bin", mode: cpioModeDir | 0755},
+		{name: "./fw-1.0/bin/tool", mode: cpioModeReg | 0755, data: "#!/bin/sh\n"},
+		{name: "./fw-1.0/tool", mode: cpioModeSymlink | 0777, data: "bin/tool"},
+		{name: "./fw-1.0/escape", mode: cpioModeSymlink | 0777, data: "../../outside"},
+	}
+
+	for _, odc := range []bool{false, true} {
+		data := writeCpio(odc, entries)
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(data)
+		zw.Close()
+
+		for name, contents := range map[string][]byte{"fw-1.0.cpio": data, "fw-1.0.cpio.gz": gz.Bytes()} {
+			archive := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(archive, contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if err := extractArchive(archive, dir, 1); err != nil {
+				t.Fatalf("extractArchive(%s, odc=%v) failed: %v", name, odc, err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "bin", "tool"))
+			if err != nil || string(got) != "#!/bin/sh\n" {
+				t.Errorf("%s (odc=%v): expected bin/tool to be extracted, got %q (%v)", name, odc, got, err)
+			}
+			if info, err := os.Stat(filepath.Join(dir, "bin", "tool")); err == nil && info.Mode().Perm() != 0755 {
+				t.Errorf("%s (odc=%v): expected bin/tool to be executable, got %v", name, odc, info.Mode())
+			}
+			if link, err := os.Readlink(filepath.Join(dir, "tool")); err != nil || link != "bin/tool" {
+				t.Errorf("%s (odc=%v): expected tool -> bin/tool, got %q (%v)", name, odc, link, err)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+				t.Errorf("%s (odc=%v): expected the escaping symlink to be skipped, got %v", name, odc, err)
+			}
+		}
+	}
+}
+
+func TestExtractCpioArchive_ChainedSymlinks(t *testing.T) {
+	var entries []cpioEntry
+	for _, e := range chainedLinks {
+		if e.link != "" {
+			entries = append(entries, cpioEntry{name: e.name, mode: cpioModeSymlink | 0777, data: e.link})
+		} else {
+			entries = append(entries, cpioEntry{name: e.name, mode: cpioModeReg | 0644, data: e.data})
+		}
+	}
+	archive := filepath.Join(t.TempDir(), "chain.cpio")
+	if err := os.WriteFile(archive, writeCpio(false, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := chainedTarget(t)
+	checkChainedLinks(t, dir, extractCpioArchive(archive, dir, 0))
+}
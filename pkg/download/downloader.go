@@ -2,15 +2,24 @@ package download
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -23,119 +32,742 @@ import (
 )
 
 const (
-	maxRetries     = 3
-	retryDelay     = time.Second
-	requestTimeout = 5 * time.Minute
+	defaultRetries        = 3
+	defaultRetryDelay     = time.Second
+	defaultRequestTimeout = 5 * time.Minute
 )
 
+// SourceMarker is the name of the file written to a package's directory once
+// all of its sources have been extracted. A source directory without it was
+// left behind by an interrupted download or extraction.
+const SourceMarker = ".source-complete"
+
+// DownloaderConfig holds configuration options for the downloader.
+// Zero values select the defaults.
+type DownloaderConfig struct {
+	CacheDir   string
+	Retries    int
+	RetryDelay time.Duration
+	Timeout    time.Duration
+	Quiet      bool
+
+	// Stream extracts tar archives as they are downloaded instead of saving
+	// them to the package directory first. Archives are still saved when
+	// CacheDir is set, so that they can be shared.
+	Stream bool
+
+	// Delete removes each archive once it has been extracted. Archives in
+	// CacheDir are kept, so a later extraction restores them from there.
+	Delete bool
+
+	// Offline refuses to clone or download anything, so that only archives
+	// already in the package directory or CacheDir can be used.
+	Offline bool
+}
+
+func (c DownloaderConfig) withDefaults() DownloaderConfig {
+	if c.Retries <= 0 {
+		c.Retries = defaultRetries
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = defaultRetryDelay
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultRequestTimeout
+	}
+	return c
+}
+
 // Downloader defines the interface for downloading and extracting packages.
 type Downloader interface {
-	Download(ctx context.Context, pkgName, pkgUrl string) error
-	Extract(pkgName, pkgUrl string) error
+	Download(ctx context.Context, pkgName string, src Source) (string, error)
+	Extract(pkgName, pkgUrl string, src Source) error
+	SourceComplete(pkgName string) bool
+	ArchiveSum(pkgName, pkgUrl string, src Source) string
+	ArchivePath(pkgName, pkgUrl string, src Source) string
+	SourceDate(pkgName, pkgUrl string, src Source) time.Time
+	SetCacheDir(dir string)
+}
+
+// Source describes where a package's source can be downloaded from.
+// The Git fields only apply to git URLs, or to all URLs when VCS is "git".
+// Dest is a subdirectory of the package's source directory to clone or
+// extract into.
+type Source struct {
+	URL             string
+	Mirrors         []string
+	VCS             string
+	GitRef          string
+	GitCommit       string
+	GitSubmodules   bool
+	Headers         map[string]string
+	Dest            string
+	StripComponents int
+
+	// Filename, if set, is the name the archive is saved and extracted as,
+	// for URLs whose path does not end in the archive's name.
+	Filename string
+
+	// Dir, if set, is an existing local directory used as the source instead
+	// of downloading URL. It is symlinked into place, or copied if Copy is
+	// set.
+	Dir  string
+	Copy bool
+
+	// ArchiveSum, if set, is the sha256 of the archive recorded when it was
+	// last downloaded. An existing archive that no longer matches it is
+	// downloaded again instead of being reused.
+	ArchiveSum string
+}
+
+// sourceDir returns the directory the source is cloned or extracted into.
+func (s Source) sourceDir(pkgDir string) (string, error) {
+	root := filepath.Join(pkgDir, "source")
+	dir, ok := safeJoin(root, s.Dest)
+	if !ok {
+		return "", fmt.Errorf("source destination %s escapes the source directory", s.Dest)
+	}
+	return dir, nil
+}
+
+// URLs returns the primary URL followed by the mirrors, in the order they
+// should be tried.
+func (s Source) URLs() []string {
+	return append([]string{s.URL}, s.Mirrors...)
+}
+
+// IsGit reports whether url is cloned as a git repository rather than
+// downloaded as an archive.
+func (s Source) IsGit(url string) bool {
+	return s.VCS == "git" || IsGitURL(url)
+}
+
+// archiveName returns the name of the archive downloaded from url.
+func (s Source) archiveName(url string) string {
+	if s.Filename != "" {
+		return s.Filename
+	}
+	return getFilenameFromURL(url)
 }
 
 type downloader struct {
 	buildDir string
+	cfg      DownloaderConfig
 }
 
 var _ Downloader = (*downloader)(nil)
 
-func NewDownloader(buildDir string) Downloader {
-	return &downloader{buildDir}
+// NewDownloader creates a downloader for the given build directory. If
+// cfg.CacheDir is non-empty, downloaded archives are shared through it.
+func NewDownloader(buildDir string, cfg DownloaderConfig) Downloader {
+	return &downloader{buildDir, cfg.withDefaults()}
 }
 
-func (d *downloader) Download(ctx context.Context, pkgName, pkgUrl string) error {
-	pkgDir := filepath.Join(d.buildDir, pkgName)
-	archiveFile := filepath.Join(pkgDir, getFilenameFromURL(pkgUrl))
+// SetCacheDir sets the shared archive cache directory. An empty dir disables
+// the cache.
+func (d *downloader) SetCacheDir(dir string) {
+	d.cfg.CacheDir = dir
+}
 
+// DefaultCacheDir returns the default shared archive cache directory,
+// $XDG_CACHE_HOME/makepkg or ~/.cache/makepkg.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "makepkg")
+}
+
+// Download fetches the package source, trying the primary URL first and then
+// each mirror in turn. It returns the URL the source was obtained from. The
+// package's sources are considered incomplete until the source is extracted.
+func (d *downloader) Download(ctx context.Context, pkgName string, src Source) (string, error) {
+	pkgDir := filepath.Join(d.buildDir, pkgName)
 	if err := os.MkdirAll(pkgDir, 0755); err != nil {
-		return fmt.Errorf("failed to create package directory: %w", err)
+		return "", fmt.Errorf("failed to create package directory: %w", err)
+	}
+	if err := os.Remove(filepath.Join(pkgDir, SourceMarker)); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove source marker: %w", err)
+	}
+	if src.Dir != "" {
+		// Local sources are linked or copied by Extract
+		return "", nil
 	}
 
-	if _, err := os.Stat(archiveFile); err == nil {
-		logger.Debug("File already exists at %s, skipping download", archiveFile)
+	urls := src.URLs()
+	for _, pkgUrl := range urls {
+		if src.IsGit(pkgUrl) {
+			continue
+		}
+		archiveFile := filepath.Join(pkgDir, src.archiveName(pkgUrl))
+		if _, err := os.Stat(archiveFile); err == nil && verifyArchive(archiveFile, src.ArchiveSum) {
+			logger.Debug("File already exists at %s, skipping download", archiveFile)
+			return pkgUrl, nil
+		}
+		if d.restoreCached(archiveFile, pkgUrl) {
+			if verifyArchive(archiveFile, src.ArchiveSum) {
+				return pkgUrl, nil
+			}
+			// Replace the corrupted entry once the archive is downloaded
+			os.Remove(d.cachePath(archiveFile, pkgUrl))
+		}
+	}
+
+	if d.cfg.Offline {
+		if src.IsGit(src.URL) {
+			return "", fmt.Errorf("cannot clone %s offline", src.URL)
+		}
+		return "", fmt.Errorf("cannot download %s offline: it is not in the build directory or download cache", src.URL)
+	}
+
+	var lastErr error
+	for i, pkgUrl := range urls {
+		if i > 0 {
+			logger.Info("  Trying mirror %s", pkgUrl)
+		}
+		if err := d.fetch(ctx, pkgDir, pkgUrl, src); err != nil {
+			if len(urls) > 1 {
+				logger.Warn("Failed to download %s from %s: %v", pkgName, pkgUrl, err)
+			}
+			lastErr = err
+			continue
+		}
+		if i > 0 {
+			logger.Info("  Downloaded %s from mirror %s", pkgName, pkgUrl)
+		}
+		return pkgUrl, nil
+	}
+
+	return "", lastErr
+}
+
+func (d *downloader) fetch(ctx context.Context, pkgDir, pkgUrl string, src Source) error {
+	if src.IsGit(pkgUrl) {
+		sourceDir, err := src.sourceDir(pkgDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(sourceDir, 0755); err != nil {
+			return fmt.Errorf("failed to create source directory: %w", err)
+		}
+		if err := cloneGitRepo(sourceDir, strings.TrimPrefix(pkgUrl, "git+"), src.GitRef, src.GitCommit); err != nil {
+			os.RemoveAll(sourceDir)
+			return err
+		}
+		if src.GitSubmodules {
+			if err := runGit(sourceDir, "submodule", "update", "--init", "--recursive", "--depth=1"); err != nil {
+				os.RemoveAll(sourceDir)
+				return fmt.Errorf("git submodule update failed: %w", err)
+			}
+		}
 		return nil
 	}
 
-	if isGitURL(pkgUrl) {
-		sourceDir := filepath.Join(pkgDir, "source")
+	if d.streams(src.archiveName(pkgUrl)) {
+		return d.fetchStreamed(ctx, pkgDir, pkgUrl, src)
+	}
+
+	archiveFile := filepath.Join(pkgDir, src.archiveName(pkgUrl))
+	if err := downloadFile(ctx, archiveFile, pkgUrl, d.cfg, src.Headers); err != nil {
+		return err
+	}
+	d.storeCached(archiveFile, pkgUrl)
+	return nil
+}
+
+// streams reports whether the archive named name is extracted while it is
+// downloaded rather than saved first.
+func (d *downloader) streams(name string) bool {
+	return d.cfg.Stream && d.cfg.CacheDir == "" && isTarArchive(name)
+}
+
+// fetchStreamed downloads the tar archive at pkgUrl and extracts it into the
+// source's destination as it is received, without saving the archive.
+func (d *downloader) fetchStreamed(ctx context.Context, pkgDir, pkgUrl string, src Source) error {
+	sourceDir, err := src.sourceDir(pkgDir)
+	if err != nil {
+		return err
+	}
+	name := src.archiveName(pkgUrl)
+
+	// A failed attempt leaves a partial tree behind, which the next attempt
+	// overwrites since it extracts the same archive.
+	err = withRetries(d.cfg, func() error {
 		if err := os.MkdirAll(sourceDir, 0755); err != nil {
 			return fmt.Errorf("failed to create source directory: %w", err)
 		}
-		return cloneGitRepo(sourceDir, pkgUrl)
+		return attemptStream(ctx, pkgUrl, name, d.cfg, src.Headers, func(body io.Reader, _ http.Header) error {
+			return extractTar(body, name, sourceDir, src.StripComponents)
+		})
+	})
+	if err != nil {
+		os.RemoveAll(sourceDir)
+		return err
 	}
+	return nil
+}
+
+// cachePath returns the location of url's archive in the shared cache.
+func (d *downloader) cachePath(archiveFile, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(d.cfg.CacheDir, hex.EncodeToString(sum[:]), filepath.Base(archiveFile))
+}
 
-	return downloadFile(ctx, archiveFile, pkgUrl)
+// restoreCached links or copies url's archive from the shared cache into
+// archiveFile. It reports whether the archive was found.
+func (d *downloader) restoreCached(archiveFile, url string) bool {
+	if d.cfg.CacheDir == "" {
+		return false
+	}
+
+	cached := d.cachePath(archiveFile, url)
+	if _, err := os.Stat(cached); err != nil {
+		return false
+	}
+	if err := linkOrCopy(cached, archiveFile); err != nil {
+		logger.Warn("Failed to restore %s from download cache: %v", url, err)
+		os.Remove(archiveFile)
+		return false
+	}
+	logger.Debug("Restored %s from download cache %s", archiveFile, cached)
+	return true
+}
+
+// storeCached adds archiveFile to the shared cache. The archive is copied to a
+// temporary file and renamed into place so concurrent builds never observe a
+// partially written entry.
+func (d *downloader) storeCached(archiveFile, url string) {
+	if d.cfg.CacheDir == "" {
+		return
+	}
+
+	cached := d.cachePath(archiveFile, url)
+	if _, err := os.Stat(cached); err == nil {
+		return
+	}
+	if err := copyAtomic(archiveFile, cached); err != nil {
+		logger.Warn("Failed to add %s to download cache: %v", url, err)
+		return
+	}
+	logger.Debug("Stored %s in download cache %s", archiveFile, cached)
+}
+
+func copyAtomic(source, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
 }
 
-func (d *downloader) Extract(pkgName, pkgUrl string) error {
+// Extract extracts the archive downloaded from pkgUrl into the source's
+// destination within the package's source directory, removing
+// src.StripComponents leading path components from each entry. The archive
+// is removed afterwards if the downloader was configured to delete archives.
+// A local src.Dir is linked or copied into place instead. On success the
+// package's sources are marked complete.
+func (d *downloader) Extract(pkgName, pkgUrl string, src Source) error {
 	pkgDir := filepath.Join(d.buildDir, pkgName)
-	sourceDir := filepath.Join(pkgDir, "source")
-	archiveFile := filepath.Join(pkgDir, getFilenameFromURL(pkgUrl))
+	if src.Dir == "" && src.IsGit(pkgUrl) {
+		// git sources are cloned directly into the source directory
+		return markSourceComplete(pkgDir)
+	}
+
+	sourceDir, err := src.sourceDir(pkgDir)
+	if err != nil {
+		return err
+	}
+	if src.Dir != "" {
+		if err := useLocalSource(src.Dir, sourceDir, src.Copy); err != nil {
+			return err
+		}
+		return markSourceComplete(pkgDir)
+	}
+	name := src.archiveName(pkgUrl)
+	archiveFile := filepath.Join(pkgDir, name)
+	if _, err := os.Stat(archiveFile); os.IsNotExist(err) && d.streams(name) {
+		// Extracted while it was downloaded
+		return markSourceComplete(pkgDir)
+	}
 
 	if err := os.MkdirAll(sourceDir, 0755); err != nil {
 		return fmt.Errorf("failed to create source directory: %w", err)
 	}
 
-	if err := extractArchive(archiveFile, sourceDir); err != nil {
+	if err := extractArchive(archiveFile, sourceDir, src.StripComponents); err != nil {
 		return fmt.Errorf("failed to extract archive: %w", err)
 	}
+	if d.cfg.Delete {
+		if err := os.Remove(archiveFile); err != nil {
+			logger.Warn("Failed to remove archive %s: %v", archiveFile, err)
+		}
+	}
+
+	return markSourceComplete(pkgDir)
+}
+
+// SourceComplete reports whether the package's source directory exists and
+// all of its sources were extracted into it.
+func (d *downloader) SourceComplete(pkgName string) bool {
+	pkgDir := filepath.Join(d.buildDir, pkgName)
+	if _, err := os.Stat(filepath.Join(pkgDir, "source")); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(pkgDir, SourceMarker))
+	return err == nil
+}
+
+// ArchiveSum returns the sha256 of the archive downloaded from pkgUrl, or ""
+// if no archive was saved for it.
+func (d *downloader) ArchiveSum(pkgName, pkgUrl string, src Source) string {
+	if src.Dir != "" || src.IsGit(pkgUrl) {
+		return ""
+	}
+	sum, err := fileSum(filepath.Join(d.buildDir, pkgName, src.archiveName(pkgUrl)))
+	if err != nil {
+		return ""
+	}
+	return sum
+}
+
+// ArchivePath returns the path of the archive downloaded from pkgUrl, or ""
+// if there is none. An archive removed from the package directory after
+// extraction is found in the download cache instead.
+func (d *downloader) ArchivePath(pkgName, pkgUrl string, src Source) string {
+	if src.Dir != "" || src.IsGit(pkgUrl) {
+		return ""
+	}
+	archiveFile := filepath.Join(d.buildDir, pkgName, src.archiveName(pkgUrl))
+	if _, err := os.Stat(archiveFile); err == nil {
+		return archiveFile
+	}
+	if d.cfg.CacheDir != "" {
+		cached := d.cachePath(archiveFile, pkgUrl)
+		if _, err := os.Stat(cached); err == nil {
+			return cached
+		}
+	}
+	return ""
+}
+
+// SourceDate returns the date of the source downloaded from pkgUrl, for
+// SOURCE_DATE_EPOCH: the date of the last commit of a git source or local
+// git checkout, or the modification time of an archive, which is set when it
+// is downloaded. It returns the zero time if the source has no date, such as
+// a streamed archive.
+func (d *downloader) SourceDate(pkgName, pkgUrl string, src Source) time.Time {
+	pkgDir := filepath.Join(d.buildDir, pkgName)
+	if src.Dir != "" || src.IsGit(pkgUrl) {
+		dir := src.Dir
+		if dir == "" {
+			var err error
+			if dir, err = src.sourceDir(pkgDir); err != nil {
+				return time.Time{}
+			}
+		}
+		date, err := GitCommitTime(dir)
+		if err != nil {
+			return time.Time{}
+		}
+		return date
+	}
+	info, err := os.Stat(filepath.Join(pkgDir, src.archiveName(pkgUrl)))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// archiveDate returns the modification time of the newest entry of the tar or
+// zip archive at path, or the Unix epoch if it has none or cannot be read.
+func archiveDate(path string) time.Time {
+	var newest time.Time
+	if strings.HasSuffix(path, ".zip") {
+		newest = zipDate(path)
+	} else if isTarArchive(path) {
+		newest = tarDate(path)
+	}
+	if newest.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return newest
+}
+
+// zipDate returns the modification time of the newest entry of the zip
+// archive at path, or the zero time.
+func zipDate(path string) time.Time {
+	var newest time.Time
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return newest
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Modified.After(newest) {
+			newest = f.Modified
+		}
+	}
+	return newest
+}
+
+// tarDate returns the modification time of the newest entry of the plain or
+// compressed tar archive at path, or the zero time.
+func tarDate(path string) time.Time {
+	var newest time.Time
+	file, err := os.Open(path)
+	if err != nil {
+		return newest
+	}
+	defer file.Close()
+
+	var reader io.Reader
+	closeReader := func() {}
+	if strings.HasSuffix(path, ".lz") {
+		reader, err = newLzipReader(file)
+	} else {
+		reader, closeReader, err = decompressPayload(bufio.NewReader(file))
+	}
+	if err != nil {
+		return newest
+	}
+	defer closeReader()
+
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return newest
+		}
+		if header.ModTime.After(newest) {
+			newest = header.ModTime
+		}
+	}
+}
 
+// verifyArchive reports whether the archive at path matches sum, which
+// always holds when sum is empty. An archive that does not match is removed.
+func verifyArchive(path, sum string) bool {
+	if sum == "" {
+		return true
+	}
+	if got, err := fileSum(path); err == nil && got == sum {
+		return true
+	}
+	logger.Warn("Archive %s does not match the checksum recorded when it was downloaded, downloading it again", path)
+	os.Remove(path)
+	return false
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func markSourceComplete(pkgDir string) error {
+	if err := os.WriteFile(filepath.Join(pkgDir, SourceMarker), nil, 0644); err != nil {
+		return fmt.Errorf("failed to write source marker: %w", err)
+	}
 	return nil
 }
 
-func downloadFile(ctx context.Context, path, url string) error {
+// FetchFile downloads a single file from url to path, retrying and timing
+// out as configured by cfg.
+func FetchFile(ctx context.Context, path, url string, cfg DownloaderConfig) error {
+	return downloadFile(ctx, path, url, cfg.withDefaults(), nil)
+}
+
+func downloadFile(ctx context.Context, path, url string, cfg DownloaderConfig, headers map[string]string) error {
 	if _, err := os.Stat(path); err == nil {
 		logger.Debug("File already exists at %s, skipping download", path)
 		return nil
 	}
 
+	return withRetries(cfg, func() error {
+		return attemptDownload(ctx, path, url, cfg, headers)
+	})
+}
+
+// withRetries calls attempt until it succeeds, up to cfg.Retries times,
+// backing off exponentially between attempts.
+func withRetries(cfg DownloaderConfig, attempt func() error) error {
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 1 {
-			delay := retryDelay * time.Duration(1<<uint(attempt-2))
-			logger.Debug("Retry attempt %d/%d after %v delay", attempt, maxRetries, delay)
+	for i := 1; i <= cfg.Retries; i++ {
+		if i > 1 {
+			delay := cfg.RetryDelay * time.Duration(1<<uint(i-2))
+			logger.Debug("Retry attempt %d/%d after %v delay", i, cfg.Retries, delay)
 			time.Sleep(delay)
 		}
 
-		if err := attemptDownload(ctx, path, url); err != nil {
+		if err := attempt(); err != nil {
 			lastErr = err
-			logger.Warn("Download attempt %d/%d failed: %v", attempt, maxRetries, err)
+			logger.Warn("Download attempt %d/%d failed: %v", i, cfg.Retries, err)
 			continue
 		}
 		return nil
 	}
 
-	return fmt.Errorf("failed after %d attempts: %w", maxRetries, lastErr)
+	return fmt.Errorf("failed after %d attempts: %w", cfg.Retries, lastErr)
 }
 
-func getFilenameFromURL(url string) string {
-	parts := strings.Split(url, "/")
-	return parts[len(parts)-1]
+// getFilenameFromURL returns the last element of the path of rawURL,
+// ignoring any query string or fragment.
+func getFilenameFromURL(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		parts := strings.Split(rawURL, "/")
+		return parts[len(parts)-1]
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		// Never name the archive after the package directory itself
+		return "archive"
+	}
+	return name
+}
+
+// IsGitURL reports whether url refers to a git repository: it uses the git
+// scheme, a git+ scheme such as git+https, which is stripped before cloning,
+// or ends in .git.
+func IsGitURL(url string) bool {
+	return strings.HasPrefix(url, "git://") || strings.HasPrefix(url, "git+") || strings.HasSuffix(url, ".git")
+}
+
+func cloneGitRepo(sourceDir, url, ref, commit string) error {
+	args := []string{"clone", "--depth=1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, url, sourceDir)
+	if err := runGit("", args...); err != nil {
+		return fmt.Errorf("git clone failed: %w", err)
+	}
+
+	if commit != "" {
+		if err := runGit(sourceDir, "fetch", "--depth=1", "origin", commit); err != nil {
+			return fmt.Errorf("git fetch failed: %w", err)
+		}
+		if err := runGit(sourceDir, "checkout", "--quiet", commit); err != nil {
+			return fmt.Errorf("git checkout failed: %w", err)
+		}
+	}
+	return nil
 }
 
-func isGitURL(url string) bool {
-	return strings.HasSuffix(url, ".git")
+// GitHead returns the commit SHA checked out in the git repository at dir.
+func GitHead(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
-func cloneGitRepo(sourceDir, url string) error {
-	cmd := exec.Command("git", "clone", "--depth=1", url, sourceDir)
+// GitCommitTime returns the committer date of the HEAD commit of the git
+// repository at dir.
+func GitCommitTime(dir string) (time.Time, error) {
+	cmd := exec.Command("git", "log", "-1", "--format=%ct")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("git log failed: %w", err)
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected git log output %q", out)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func runGit(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
 	cmdOutput, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("git clone failed: %w\nOutput: %s", err, string(cmdOutput))
+		return fmt.Errorf("%w\nOutput: %s", err, string(cmdOutput))
 	}
 	return nil
 }
 
-func attemptDownload(ctx context.Context, path, url string) error {
+func attemptDownload(ctx context.Context, path, url string, cfg DownloaderConfig, headers map[string]string) error {
+	return attemptStream(ctx, url, filepath.Base(path), cfg, headers, func(body io.Reader, header http.Header) error {
+		out, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, body); err != nil {
+			out.Close()
+			os.Remove(path)
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+
+		// Date the archive as the server does, or else by its newest entry
+		// or the epoch, so that it does not depend on when it was
+		// downloaded.
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			modified = archiveDate(path)
+		}
+		os.Chtimes(path, modified, modified)
+		return nil
+	})
+}
+
+// attemptStream requests url once and passes the response body to consume
+// as it is received, along with the response headers. name is the file name
+// shown in the progress output.
+func attemptStream(ctx context.Context, url, name string, cfg DownloaderConfig, headers map[string]string, consume func(io.Reader, http.Header) error) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
 	client := &http.Client{
-		Timeout: requestTimeout,
+		Transport: transport,
+		Timeout:   cfg.Timeout,
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -147,26 +779,44 @@ func attemptDownload(ctx context.Context, path, url string) error {
 		return fmt.Errorf("bad status: %s", resp.Status)
 	}
 
-	out, err := os.Create(path)
-	if err != nil {
-		return err
+	var body io.Reader = resp.Body
+	if !cfg.Quiet {
+		body = io.TeeReader(resp.Body, newProgressWriter(name, resp.ContentLength))
 	}
-	defer out.Close()
+	return consume(body, resp.Header)
+}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		os.Remove(path)
-		return err
+// isTarArchive reports whether name is a plain or compressed tar archive.
+func isTarArchive(name string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz", ".tar.zst", ".tar.zstd", ".tar.lz"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// isCpioArchive reports whether name is a plain or compressed cpio archive.
+func isCpioArchive(name string) bool {
+	for _, suffix := range []string{".cpio", ".cpio.gz", ".cpio.xz", ".cpio.zst", ".cpio.zstd"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
-func extractArchive(archivePath, targetDir string) error {
+func extractArchive(archivePath, targetDir string, strip int) error {
 	if strings.HasSuffix(archivePath, ".deb") {
 		return extractDeb(archivePath, targetDir)
 	} else if strings.HasSuffix(archivePath, ".snap") {
 		return extractSnap(archivePath, targetDir)
+	} else if strings.HasSuffix(archivePath, ".zip") {
+		return extractZip(archivePath, targetDir, strip)
+	} else if strings.HasSuffix(archivePath, ".rpm") {
+		return extractRpm(archivePath, targetDir)
+	} else if isCpioArchive(archivePath) {
+		return extractCpioArchive(archivePath, targetDir, strip)
 	}
 
 	file, err := os.Open(archivePath)
@@ -175,36 +825,50 @@ func extractArchive(archivePath, targetDir string) error {
 	}
 	defer file.Close()
 
-	var reader io.Reader = file
+	return extractTar(file, archivePath, targetDir, strip)
+}
+
+// extractTar extracts the tar archive read from r into targetDir, removing
+// strip leading path components from each entry. The compression is
+// determined from the archive's file name.
+func extractTar(r io.Reader, name, targetDir string, strip int) error {
+	var reader io.Reader = r
 
-	if strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz") || strings.HasSuffix(archivePath, ".apk") {
-		gzReader, err := gzip.NewReader(file)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".apk") {
+		gzReader, err := gzip.NewReader(r)
 		if err != nil {
 			return fmt.Errorf("failed to create gzip reader: %w", err)
 		}
 		defer gzReader.Close()
 		reader = gzReader
-	} else if strings.HasSuffix(archivePath, ".bz2") {
-		reader = bzip2.NewReader(file)
-	} else if strings.HasSuffix(archivePath, ".xz") {
-		xzReader, err := xz.NewReader(file)
+	} else if strings.HasSuffix(name, ".bz2") {
+		reader = bzip2.NewReader(r)
+	} else if strings.HasSuffix(name, ".xz") {
+		xzReader, err := xz.NewReader(r)
 		if err != nil {
 			return fmt.Errorf("failed to create xz reader: %w", err)
 		}
 		reader = xzReader
-	} else if strings.HasSuffix(archivePath, ".zst") || strings.HasSuffix(archivePath, ".zstd") {
-		zstdReader, err := zstd.NewReader(file)
+	} else if strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".zstd") {
+		zstdReader, err := zstd.NewReader(r)
 		if err != nil {
 			return fmt.Errorf("failed to create zstd reader: %w", err)
 		}
 		defer zstdReader.Close()
 		reader = zstdReader
+	} else if strings.HasSuffix(name, ".lz") {
+		lzReader, err := newLzipReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to create lzip reader: %w", err)
+		}
+		reader = lzReader
 	}
 
 	tarReader := tar.NewReader(reader)
 
-	var topLevelDir string
-	firstEntry := true
+	files := newFileWriter()
+	defer files.wait()
+	var pendingLinks []hardlink
 
 	for {
 		header, err := tarReader.Next()
@@ -220,31 +884,21 @@ func extractArchive(archivePath, targetDir string) error {
 			continue
 		}
 
-		if firstEntry {
-			parts := strings.Split(header.Name, "/")
-			if len(parts) > 0 {
-				topLevelDir = parts[0]
-			}
-			firstEntry = false
-			logger.Debug("Detected top-level directory: %s (from: %s)", topLevelDir, header.Name)
-		}
-
-		name := header.Name
-		if topLevelDir != "" && strings.HasPrefix(name, topLevelDir+"/") {
-			name = strings.TrimPrefix(name, topLevelDir+"/")
-			logger.Debug("Stripped prefix from %s -> %s", header.Name, name)
-		} else if name == topLevelDir {
-			logger.Debug("Skipping top-level directory: %s", name)
+		name, ok := stripComponents(header.Name, strip)
+		if !ok {
+			logger.Debug("Skipping %s: fewer than %d path components", header.Name, strip+1)
 			continue
 		}
 
-		if name == "" {
-			logger.Debug("Skipping empty name (was: %s)", header.Name)
+		target, ok := safeJoin(targetDir, name)
+		if !ok {
+			logger.Warn("Archive entry %s escapes the source directory", header.Name)
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink {
+				return fmt.Errorf("archive entry %s escapes the source directory", header.Name)
+			}
 			continue
 		}
 
-		target := filepath.Join(targetDir, name)
-
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
@@ -255,23 +909,40 @@ func extractArchive(archivePath, targetDir string) error {
 				return fmt.Errorf("failed to create parent directory: %w", err)
 			}
 
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+			if err := files.write(target, os.FileMode(header.Mode), header.Size, tarReader); err != nil {
+				return err
 			}
 
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to write file: %w", err)
-			}
-			outFile.Close()
-
 		case tar.TypeSymlink:
+			if !safeLink(targetDir, target, header.Linkname) {
+				logger.Warn("Skipping symlink %s -> %s: target escapes the source directory", header.Name, header.Linkname)
+				continue
+			}
 			_ = os.Symlink(header.Linkname, target)
+		case tar.TypeLink:
+			linkname, ok := stripComponents(header.Linkname, strip)
+			if !ok {
+				logger.Warn("Skipping hardlink %s -> %s: target is stripped from the archive", header.Name, header.Linkname)
+				continue
+			}
+			// The link source may still be being written
+			if err := files.wait(); err != nil {
+				return err
+			}
+			pending, err := extractHardlink(targetDir, target, linkname)
+			if err != nil {
+				return err
+			}
+			if pending != nil {
+				pendingLinks = append(pendingLinks, *pending)
+			}
 		}
 	}
 
-	return nil
+	if err := files.wait(); err != nil {
+		return err
+	}
+	return resolveHardlinks(targetDir, pendingLinks)
 }
 
 func extractDeb(archivePath, targetDir string) error {
@@ -358,9 +1029,18 @@ func extractTarFromBytes(data []byte, name, targetDir string) error {
 		tarReader = zstdReader
 	} else if strings.HasSuffix(name, ".bz2") {
 		tarReader = bzip2.NewReader(reader)
+	} else if strings.HasSuffix(name, ".lz") {
+		lzReader, err := newLzipReader(reader)
+		if err != nil {
+			return fmt.Errorf("failed to create lzip reader: %w", err)
+		}
+		tarReader = lzReader
 	}
 
 	tr := tar.NewReader(tarReader)
+	files := newFileWriter()
+	defer files.wait()
+	var pendingLinks []hardlink
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -371,7 +1051,14 @@ func extractTarFromBytes(data []byte, name, targetDir string) error {
 		}
 
 		name := strings.TrimPrefix(header.Name, "./")
-		target := filepath.Join(targetDir, name)
+		target, ok := safeJoin(targetDir, name)
+		if !ok {
+			logger.Warn("Archive entry %s escapes the source directory", header.Name)
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink {
+				return fmt.Errorf("archive entry %s escapes the source directory", header.Name)
+			}
+			continue
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -382,23 +1069,393 @@ func extractTarFromBytes(data []byte, name, targetDir string) error {
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return fmt.Errorf("failed to create parent directory: %w", err)
 			}
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			if err := files.write(target, os.FileMode(header.Mode), header.Size, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !safeLink(targetDir, target, header.Linkname) {
+				logger.Warn("Skipping symlink %s -> %s: target escapes the source directory", header.Name, header.Linkname)
+				continue
+			}
+			_ = os.Symlink(header.Linkname, target)
+		case tar.TypeLink:
+			if err := files.wait(); err != nil {
+				return err
+			}
+			pending, err := extractHardlink(targetDir, target, strings.TrimPrefix(header.Linkname, "./"))
+			if err != nil {
+				return err
+			}
+			if pending != nil {
+				pendingLinks = append(pendingLinks, *pending)
+			}
+		}
+	}
+
+	if err := files.wait(); err != nil {
+		return err
+	}
+	return resolveHardlinks(targetDir, pendingLinks)
+}
+
+const (
+	rpmLeadSize   = 96
+	rpmLeadMagic  = "\xed\xab\xee\xdb"
+	rpmHdrMagic   = "\x8e\xad\xe8"
+	rpmHdrPreface = 16
+	rpmIndexEntry = 16
+)
+
+// extractRpm extracts the cpio payload of an RPM package. The lead, signature
+// header and main header are skipped and the payload compression is detected
+// from its magic bytes.
+func extractRpm(archivePath, targetDir string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(reader, lead); err != nil {
+		return fmt.Errorf("failed to read RPM lead: %w", err)
+	}
+	if string(lead[:4]) != rpmLeadMagic {
+		return fmt.Errorf("not a valid RPM package")
+	}
+
+	// The signature header is padded to an 8-byte boundary, the main header
+	// is not.
+	for _, padded := range []bool{true, false} {
+		if err := skipRpmHeader(reader, padded); err != nil {
+			return err
+		}
+	}
+
+	payload, closer, err := decompressPayload(reader)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	return extractCpio(payload, targetDir, 0)
+}
+
+// extractCpioArchive extracts a newc or odc cpio archive, optionally
+// compressed with gzip, xz or zstd, into targetDir.
+func extractCpioArchive(archivePath, targetDir string, strip int) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	payload, closer, err := decompressPayload(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	return extractCpio(payload, targetDir, strip)
+}
+
+func skipRpmHeader(r io.Reader, padded bool) error {
+	preface := make([]byte, rpmHdrPreface)
+	if _, err := io.ReadFull(r, preface); err != nil {
+		return fmt.Errorf("failed to read RPM header: %w", err)
+	}
+	if string(preface[:3]) != rpmHdrMagic {
+		return fmt.Errorf("invalid RPM header magic")
+	}
+
+	count := int64(binary.BigEndian.Uint32(preface[8:12]))
+	size := int64(binary.BigEndian.Uint32(preface[12:16]))
+	length := count*rpmIndexEntry + size
+	if padded {
+		length += (8 - length%8) % 8
+	}
+
+	if _, err := io.CopyN(io.Discard, r, length); err != nil {
+		return fmt.Errorf("failed to skip RPM header: %w", err)
+	}
+	return nil
+}
+
+// decompressPayload wraps r in a decompressor chosen by its magic bytes.
+// Uncompressed data is returned as is.
+func decompressPayload(r *bufio.Reader) (io.Reader, func(), error) {
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzReader, func() { gzReader.Close() }, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create xz reader: %w", err)
+		}
+		return xzReader, func() {}, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zstdReader, zstdReader.Close, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(r), func() {}, nil
+	}
+	return r, func() {}, nil
+}
+
+func extractZip(archivePath, targetDir string, strip int) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip: %w", err)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		name, ok := stripComponents(f.Name, strip)
+		if !ok {
+			logger.Debug("Skipping %s: fewer than %d path components", f.Name, strip+1)
+			continue
+		}
+
+		mode := f.Mode()
+		target, ok := safeJoin(targetDir, name)
+		if !ok {
+			logger.Warn("Archive entry %s escapes the source directory", f.Name)
+			if mode.IsRegular() {
+				return fmt.Errorf("archive entry %s escapes the source directory", f.Name)
+			}
+			continue
+		}
+
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+		case mode&os.ModeSymlink != 0:
+			linkname, err := readZipFile(f)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink: %w", err)
+			}
+			if !safeLink(targetDir, target, string(linkname)) {
+				logger.Warn("Skipping symlink %s -> %s: target escapes the source directory", f.Name, linkname)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %w", err)
+			}
+			_ = os.Symlink(string(linkname), target)
+		default:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %w", err)
+			}
+
+			perm := mode.Perm()
+			if perm == 0 {
+				perm = 0644
+			}
+			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, perm)
 			if err != nil {
 				return fmt.Errorf("failed to create file: %w", err)
 			}
-			if _, err := io.Copy(outFile, tr); err != nil {
+
+			rc, err := f.Open()
+			if err != nil {
 				outFile.Close()
-				return fmt.Errorf("failed to write file: %w", err)
+				return fmt.Errorf("failed to open zip entry: %w", err)
 			}
+			_, err = io.Copy(outFile, rc)
+			rc.Close()
 			outFile.Close()
-		case tar.TypeSymlink:
-			_ = os.Symlink(header.Linkname, target)
+			if err != nil {
+				return fmt.Errorf("failed to write file: %w", err)
+			}
 		}
 	}
 
 	return nil
 }
 
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// stripComponents removes n leading path components from an archive entry
+// name, like tar's --strip-components. It returns false if nothing is left.
+func stripComponents(name string, n int) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) <= n || (len(parts) == 1 && parts[0] == "") {
+		return "", false
+	}
+	return strings.Join(parts[n:], "/"), true
+}
+
+// hardlink is a hardlink entry whose source had not been extracted yet when
+// the entry was read.
+type hardlink struct {
+	target   string
+	linkname string
+}
+
+// extractHardlink creates a hardlink at target pointing to linkname, which is
+// relative to targetDir. If the link source does not exist yet, the link is
+// returned so that it can be resolved once the rest of the archive has been
+// extracted.
+func extractHardlink(targetDir, target, linkname string) (*hardlink, error) {
+	source, ok := safeJoin(targetDir, linkname)
+	if !ok {
+		logger.Warn("Hardlink %s -> %s escapes the source directory", target, linkname)
+		return nil, fmt.Errorf("hardlink target %s escapes the source directory", linkname)
+	}
+
+	if _, err := os.Lstat(source); os.IsNotExist(err) {
+		logger.Debug("Deferring hardlink %s -> %s", target, linkname)
+		return &hardlink{target: target, linkname: linkname}, nil
+	}
+	return nil, linkOrCopy(source, target)
+}
+
+// resolveHardlinks creates any hardlinks that were deferred during extraction.
+func resolveHardlinks(targetDir string, links []hardlink) error {
+	for _, link := range links {
+		source, _ := safeJoin(targetDir, link.linkname)
+		if _, err := os.Lstat(source); err != nil {
+			return fmt.Errorf("hardlink target %s not found in archive", link.linkname)
+		}
+		if err := linkOrCopy(source, link.target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkOrCopy hardlinks source to target, falling back to copying the file
+// contents if the link cannot be created.
+func linkOrCopy(source, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+	os.Remove(target)
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+
+	logger.Debug("Hardlink %s -> %s failed, copying instead", target, source)
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open hardlink source: %w", err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat hardlink source: %w", err)
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	// The archive's date is its SOURCE_DATE_EPOCH
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// safeJoin joins name onto dir and reports whether the result stays inside
+// dir, both as written and once the symlinks already extracted along it are
+// resolved, so that a chain of links cannot lead an entry out of dir.
+func safeJoin(dir, name string) (string, bool) {
+	target := filepath.Join(dir, name)
+	if !isWithin(dir, target) || !resolvesWithin(dir, target) {
+		return "", false
+	}
+	return target, true
+}
+
+// safeLink reports whether a symlink created at path with the given link
+// target resolves to a location inside dir, following the symlinks already
+// extracted along path and the link target.
+func safeLink(dir, path, linkname string) bool {
+	if filepath.IsAbs(linkname) {
+		return isWithin(dir, linkname) && resolvesWithin(dir, linkname)
+	}
+	if !isWithin(dir, filepath.Join(filepath.Dir(path), linkname)) {
+		return false
+	}
+	parent, err := resolvePath(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	// The link target is not cleaned, since a ".." that follows a symlink
+	// leaves the symlink's target rather than its parent directory.
+	return resolvesWithin(dir, parent+string(filepath.Separator)+linkname)
+}
+
+// resolvesWithin reports whether path is inside dir once the symlinks along
+// both are resolved.
+func resolvesWithin(dir, path string) bool {
+	root, err := resolvePath(dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	return isWithin(root, resolved)
+}
+
+// resolvePath returns the location path refers to on disk. The symlinks in
+// its longest existing prefix are resolved, and the components that do not
+// exist yet are appended as they are.
+func resolvePath(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		i := strings.LastIndex(path, string(filepath.Separator))
+		if i < 0 {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{path[i+1:]}, rest...)
+		path = path[:i]
+		if path == "" {
+			path = string(filepath.Separator)
+		}
+	}
+}
+
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
 func extractSnap(archivePath, targetDir string) error {
 	logger.Debug("Extracting .snap using unsquashfs")
 
@@ -0,0 +1,488 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestGetFilenameFromURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/foo-1.2.tar.gz", "foo-1.2.tar.gz"},
+		{"https://example.com/foo-1.2.tar.gz?token=abc", "foo-1.2.tar.gz"},
+		{"https://example.com/foo-1.2.tar.gz#sha256", "foo-1.2.tar.gz"},
+		{"https://example.com/dl/foo-1.2.tar.gz/?x=1", "foo-1.2.tar.gz"},
+		{"https://example.com/get?file=foo-1.2.tar.gz&token=abc", "get"},
+		{"https://example.com/foo%201.2.tar.gz", "foo 1.2.tar.gz"},
+		{"https://example.com", "archive"},
+		{"https://example.com/", "archive"},
+	}
+
+	for _, tt := range tests {
+		if got := getFilenameFromURL(tt.url); got != tt.expected {
+			t.Errorf("getFilenameFromURL(%q) = %q, expected %q", tt.url, got, tt.expected)
+		}
+	}
+}
+
+func TestSourceArchiveName(t *testing.T) {
+	src := Source{URL: "https://example.com/get?id=42", Filename: "foo-1.2.tar.xz"}
+	if got := src.archiveName(src.URL); got != "foo-1.2.tar.xz" {
+		t.Errorf("Expected the filename override, got %q", got)
+	}
+}
+
+func TestIsGitURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://github.com/owner/repo.git", true},
+		{"git://example.com/repo", true},
+		{"git+https://github.com/owner/repo", true},
+		{"git+ssh://git@github.com/owner/repo", true},
+		{"https://github.com/owner/repo", false},
+		{"https://example.com/foo-1.2.tar.gz", false},
+		{"https://example.com/git+foo.tar.gz", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsGitURL(tt.url); got != tt.expected {
+			t.Errorf("IsGitURL(%q) = %v, expected %v", tt.url, got, tt.expected)
+		}
+	}
+}
+
+func TestSourceIsGit(t *testing.T) {
+	src := Source{URL: "https://github.com/owner/repo", VCS: "git"}
+	if !src.IsGit(src.URL) {
+		t.Errorf("Expected vcs: git to mark %s as a git repository", src.URL)
+	}
+	src.VCS = ""
+	if src.IsGit(src.URL) {
+		t.Errorf("Expected %s not to be a git repository without vcs: git", src.URL)
+	}
+}
+
+func writeTarGz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtract_Archives(t *testing.T) {
+	for _, del := range []bool{false, true} {
+		buildDir := t.TempDir()
+		archive := filepath.Join(buildDir, "foo", "foo-1.0.tar.gz")
+		if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTarGz(t, archive, map[string]string{"foo-1.0/Makefile": "all:\n"})
+
+		d := NewDownloader(buildDir, DownloaderConfig{Delete: del})
+		src := Source{URL: "https://example.com/foo-1.0.tar.gz", StripComponents: 1}
+		if err := d.Extract("foo", src.URL, src); err != nil {
+			t.Fatalf("Extract failed: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(buildDir, "foo", "source", "Makefile")); err != nil {
+			t.Errorf("Expected the archive to be extracted: %v", err)
+		}
+		_, err := os.Stat(archive)
+		if del && !os.IsNotExist(err) {
+			t.Errorf("Expected the archive to be deleted after extraction, got %v", err)
+		}
+		if !del && err != nil {
+			t.Errorf("Expected the archive to be kept after extraction, got %v", err)
+		}
+	}
+}
+
+func TestSourceComplete(t *testing.T) {
+	buildDir := t.TempDir()
+	archive := filepath.Join(buildDir, "foo", "foo-1.0.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTarGz(t, archive, map[string]string{"foo-1.0/Makefile": "all:\n"})
+
+	d := NewDownloader(buildDir, DownloaderConfig{})
+	src := Source{URL: "https://example.com/foo-1.0.tar.gz", StripComponents: 1}
+	if d.SourceComplete("foo") {
+		t.Error("Expected a source that was never extracted to be incomplete")
+	}
+
+	// The archive is already present, so this does not hit the network.
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if err := d.Extract("foo", src.URL, src); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if !d.SourceComplete("foo") {
+		t.Error("Expected the source to be complete after extraction")
+	}
+
+	// A download that is not followed by an extraction leaves the source
+	// incomplete.
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if d.SourceComplete("foo") {
+		t.Error("Expected the source to be incomplete until it is extracted again")
+	}
+}
+
+func TestExtractTar_ZstdFrames(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"foo-1.0/a", "foo-1.0/b"} {
+		content := strings.Repeat(name+"\n", 1000)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the tar stream across frames at an offset that falls inside
+	// the first file, as parallel compressors like pzstd do.
+	var data bytes.Buffer
+	raw := archive.Bytes()
+	for _, part := range [][]byte{raw[:1000], raw[1000:]} {
+		zw, err := zstd.NewWriter(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(part)
+		zw.Close()
+	}
+
+	dir := t.TempDir()
+	if err := extractTar(bytes.NewReader(data.Bytes()), "foo-1.0.tar.zst", dir, 1); err != nil {
+		t.Fatalf("extractTar failed: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != strings.Repeat("foo-1.0/"+name+"\n", 1000) {
+			t.Errorf("Expected %s to be extracted intact (%v)", name, err)
+		}
+	}
+}
+
+func TestExtract_LocalSource(t *testing.T) {
+	local := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(local, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local, "src", "main.c"), []byte("int main;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/main.c", filepath.Join(local, "main.c")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, copySource := range []bool{false, true} {
+		buildDir := t.TempDir()
+		d := NewDownloader(buildDir, DownloaderConfig{})
+		src := Source{Dir: local, Copy: copySource}
+		url, err := d.Download(context.Background(), "foo", src)
+		if err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		if err := d.Extract("foo", url, src); err != nil {
+			t.Fatalf("Extract failed: %v", err)
+		}
+		if !d.SourceComplete("foo") {
+			t.Error("Expected the local source to be complete")
+		}
+
+		sourceDir := filepath.Join(buildDir, "foo", "source")
+		info, err := os.Lstat(sourceDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLink := info.Mode()&os.ModeSymlink != 0; isLink == copySource {
+			t.Errorf("copy=%v: expected the source to be a symlink: %v, got mode %v", copySource, !copySource, info.Mode())
+		}
+		if got, err := os.ReadFile(filepath.Join(sourceDir, "main.c")); err != nil || string(got) != "int main;\n" {
+			t.Errorf("copy=%v: expected main.c to be readable through the source, got %q (%v)", copySource, got, err)
+		}
+		if link, err := os.Readlink(filepath.Join(sourceDir, "main.c")); err != nil || link != "src/main.c" {
+			t.Errorf("copy=%v: expected main.c to remain a symlink, got %q (%v)", copySource, link, err)
+		}
+	}
+}
+
+func TestDownload_ArchiveSum(t *testing.T) {
+	buildDir := t.TempDir()
+	archive := filepath.Join(buildDir, "foo", "foo-1.0.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTarGz(t, archive, map[string]string{"foo-1.0/Makefile": "all:\n"})
+	good, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(good)
+	}))
+	defer server.Close()
+
+	d := NewDownloader(buildDir, DownloaderConfig{Quiet: true})
+	src := Source{URL: server.URL + "/foo-1.0.tar.gz", StripComponents: 1}
+	sum := d.ArchiveSum("foo", src.URL, src)
+	if sum == "" {
+		t.Fatal("Expected the sum of the saved archive")
+	}
+
+	// The recorded sum matches, so the archive is reused.
+	src.ArchiveSum = sum
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected a matching archive to be reused, got %d requests", requests)
+	}
+
+	// A corrupted archive is downloaded again.
+	if err := os.WriteFile(archive, good[:len(good)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected a corrupted archive to be downloaded again, got %d requests", requests)
+	}
+	if got := d.ArchiveSum("foo", src.URL, src); got != sum {
+		t.Errorf("Expected the downloaded archive to match the recorded sum, got %s", got)
+	}
+}
+
+func TestSourceDate(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	d := NewDownloader(t.TempDir(), DownloaderConfig{Quiet: true})
+	src := Source{URL: server.URL + "/foo-1.0.tar.gz"}
+	if date := d.SourceDate("foo", src.URL, src); !date.IsZero() {
+		t.Errorf("Expected no date before the archive is downloaded, got %v", date)
+	}
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if date := d.SourceDate("foo", src.URL, src); !date.Equal(modified) {
+		t.Errorf("Expected the archive to be dated %v by the server, got %v", modified, date)
+	}
+}
+
+func TestSourceDate_NoLastModified(t *testing.T) {
+	newest := time.Date(2023, 7, 4, 8, 30, 0, 0, time.UTC)
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for _, modTime := range []time.Time{newest.Add(-time.Hour), newest, newest.Add(-2 * time.Hour)} {
+		tw.WriteHeader(&tar.Header{Name: modTime.Format("150405"), Mode: 0644, Typeflag: tar.TypeReg, ModTime: modTime})
+	}
+	tw.Close()
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/foo") {
+			w.Write(archive.Bytes())
+		} else {
+			w.Write([]byte("not an archive"))
+		}
+	}))
+	defer server.Close()
+
+	d := NewDownloader(t.TempDir(), DownloaderConfig{Quiet: true})
+	for _, tt := range []struct {
+		name     string
+		expected time.Time
+	}{
+		{"foo", newest},
+		{"bar", time.Unix(0, 0)},
+	} {
+		src := Source{URL: server.URL + "/" + tt.name + "-1.0.tar.gz"}
+		if _, err := d.Download(context.Background(), tt.name, src); err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		if date := d.SourceDate(tt.name, src.URL, src); !date.Equal(tt.expected) {
+			t.Errorf("Expected %s to be dated %v, got %v", tt.name, tt.expected, date)
+		}
+	}
+}
+
+func TestDownload_Offline(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	buildDir := t.TempDir()
+	d := NewDownloader(buildDir, DownloaderConfig{Offline: true})
+	for _, src := range []Source{
+		{URL: server.URL + "/foo-1.0.tar.gz"},
+		{URL: server.URL + "/foo.git", VCS: "git"},
+	} {
+		if _, err := d.Download(context.Background(), "foo", src); err == nil || !strings.Contains(err.Error(), "offline") {
+			t.Errorf("Expected fetching %s offline to fail, got %v", src.URL, err)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests offline, got %d", requests)
+	}
+
+	archive := filepath.Join(buildDir, "foo", "foo-1.0.tar.gz")
+	writeTarGz(t, archive, map[string]string{"foo-1.0/Makefile": "all:\n"})
+	src := Source{URL: server.URL + "/foo-1.0.tar.gz"}
+	if _, err := d.Download(context.Background(), "foo", src); err != nil {
+		t.Errorf("Expected an archive already downloaded to be used offline, got %v", err)
+	}
+}
+
+// chainedLinks is an archive that walks out of the target directory through
+// symlinks extracted earlier: l1 -> ., l1/l2 -> .. (which resolves to the
+// parent of the target), then a file written through l2.
+var chainedLinks = []struct {
+	name, link, data string
+}{
+	{name: "l1", link: "."},
+	{name: "l1/l2", link: ".."},
+	{name: "l2/evil", data: "evil\n"},
+}
+
+// checkChainedLinks verifies that extracting chainedLinks into dir left
+// nothing behind in dir's parent.
+func checkChainedLinks(t *testing.T, dir string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(dir), "evil")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the target directory, got %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "l2")); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("expected the escaping l1/l2 symlink to be skipped")
+	}
+}
+
+// chainedTarget returns an empty target directory with a parent that
+// extraction must not touch.
+func chainedTarget(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "source")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeChainedTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range chainedLinks {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Mode: 0777, Linkname: e.link, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar_ChainedSymlinks(t *testing.T) {
+	dir := chainedTarget(t)
+	err := extractTar(bytes.NewReader(writeChainedTar(t)), "chain.tar", dir, 0)
+	checkChainedLinks(t, dir, err)
+}
+
+func TestExtractTarFromBytes_ChainedSymlinks(t *testing.T) {
+	dir := chainedTarget(t)
+	err := extractTarFromBytes(writeChainedTar(t), "data.tar", dir)
+	checkChainedLinks(t, dir, err)
+}
+
+func TestExtractZip_ChainedSymlinks(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "chain.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range chainedLinks {
+		hdr := &zip.FileHeader{Name: e.name}
+		hdr.SetMode(0644)
+		content := e.data
+		if e.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			content = e.link
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dir := chainedTarget(t)
+	checkChainedLinks(t, dir, extractZip(archive, dir, 0))
+}
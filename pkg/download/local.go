@@ -0,0 +1,93 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// useLocalSource makes the local directory dir the source at sourceDir,
+// replacing anything already there. The source is a symlink to dir, so the
+// build runs in place, unless copySource is set.
+func useLocalSource(dir, sourceDir string, copySource bool) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to use source directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("source directory %s is not a directory", dir)
+	}
+
+	// RemoveAll removes a previous symlink without following it.
+	if err := os.RemoveAll(sourceDir); err != nil {
+		return fmt.Errorf("failed to remove old source: %w", err)
+	}
+	if !copySource {
+		return os.Symlink(dir, sourceDir)
+	}
+	if err := CopyTree(dir, sourceDir, false); err != nil {
+		os.RemoveAll(sourceDir)
+		return fmt.Errorf("failed to copy source directory: %w", err)
+	}
+	return nil
+}
+
+// CopyTree copies the directories, regular files and symlinks under src to
+// dst, preserving permissions. Symlinks are copied as is, not followed. If
+// skipExisting is set, files that already exist in dst are left as they are.
+func CopyTree(src, dst string, skipExisting bool) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if skipExisting {
+			if _, err := os.Lstat(target); err == nil {
+				return nil
+			}
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			linkname, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkname, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
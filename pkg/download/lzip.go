@@ -0,0 +1,147 @@
+package download
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	lzipMagic      = "LZIP"
+	lzipHeaderLen  = 6
+	lzipTrailerLen = 20
+
+	lzipMinDictSize = 1 << 12
+	lzipMaxDictSize = 1 << 29
+
+	// lzipProperties are the LZMA literal and position parameters used by
+	// every lzip member (lc=3, lp=0, pb=2).
+	lzipProperties = 0x5d
+)
+
+// lzipReader decompresses lzip data. An lzip file is a sequence of members,
+// each an LZMA stream terminated by an end marker, between a six byte header
+// and a twenty byte trailer holding the CRC and size of its data.
+type lzipReader struct {
+	r      *bufio.Reader
+	member *lzma.Reader
+	crc    hash.Hash32
+	size   uint64
+}
+
+func newLzipReader(r io.Reader) (*lzipReader, error) {
+	z := &lzipReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	if err := z.nextMember(); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("lzip: %w", io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+// nextMember reads the header of the next member and prepares to decompress
+// it. It returns io.EOF if there are no more members; like lzip, anything
+// after the last member that is not a member header is ignored.
+func (z *lzipReader) nextMember() error {
+	header, err := z.r.Peek(lzipHeaderLen)
+	if len(header) < lzipHeaderLen || string(header[:4]) != lzipMagic {
+		if z.member == nil && err == nil {
+			return fmt.Errorf("lzip: not an lzip file")
+		}
+		return io.EOF
+	}
+	if header[4] != 1 {
+		return fmt.Errorf("lzip: unsupported version %d", header[4])
+	}
+	dictSize := uint32(1) << (header[5] & 0x1f)
+	dictSize -= dictSize / 16 * uint32(header[5]>>5)
+	if dictSize < lzipMinDictSize || dictSize > lzipMaxDictSize {
+		return fmt.Errorf("lzip: invalid dictionary size %d", dictSize)
+	}
+	z.r.Discard(lzipHeaderLen)
+
+	// Decode the member as a classic .lzma stream of unknown size.
+	lzmaHeader := make([]byte, 13)
+	lzmaHeader[0] = lzipProperties
+	binary.LittleEndian.PutUint32(lzmaHeader[1:], dictSize)
+	binary.LittleEndian.PutUint64(lzmaHeader[5:], ^uint64(0))
+	member, err := lzma.NewReader(&prefixedReader{prefix: lzmaHeader, r: z.r})
+	if err != nil {
+		return fmt.Errorf("lzip: %w", err)
+	}
+	z.member = member
+	z.crc.Reset()
+	z.size = 0
+	return nil
+}
+
+// checkTrailer verifies the trailer of the current member.
+func (z *lzipReader) checkTrailer() error {
+	trailer := make([]byte, lzipTrailerLen)
+	if _, err := io.ReadFull(z.r, trailer); err != nil {
+		return fmt.Errorf("lzip: truncated member trailer")
+	}
+	if crc := binary.LittleEndian.Uint32(trailer[0:]); crc != z.crc.Sum32() {
+		return fmt.Errorf("lzip: CRC mismatch (expected %08x, got %08x)", crc, z.crc.Sum32())
+	}
+	if size := binary.LittleEndian.Uint64(trailer[4:]); size != z.size {
+		return fmt.Errorf("lzip: data size mismatch (expected %d, got %d)", size, z.size)
+	}
+	return nil
+}
+
+func (z *lzipReader) Read(p []byte) (int, error) {
+	for {
+		if z.member == nil {
+			return 0, io.EOF
+		}
+		n, err := z.member.Read(p)
+		z.crc.Write(p[:n])
+		z.size += uint64(n)
+		if err == io.EOF {
+			if err := z.checkTrailer(); err != nil {
+				return n, err
+			}
+			if err := z.nextMember(); err == io.EOF {
+				z.member = nil
+			} else if err != nil {
+				return n, err
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// prefixedReader reads prefix and then r. It implements io.ByteReader so
+// the LZMA decoder reads from r without buffering past the end of a member.
+type prefixedReader struct {
+	prefix []byte
+	r      *bufio.Reader
+}
+
+func (p *prefixedReader) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+func (p *prefixedReader) ReadByte() (byte, error) {
+	if len(p.prefix) > 0 {
+		c := p.prefix[0]
+		p.prefix = p.prefix[1:]
+		return c, nil
+	}
+	return p.r.ReadByte()
+}
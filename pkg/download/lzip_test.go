@@ -0,0 +1,99 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// lzipMember compresses data as a single lzip member with an 8 MiB
+// dictionary.
+func lzipMember(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	w, err := lzma.WriterConfig{DictCap: 1 << 23, EOSMarker: true}.NewWriter(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the .lzma header with an lzip header and append the trailer
+	body := stream.Bytes()[13:]
+	member := append([]byte(lzipMagic), 1, 23)
+	member = append(member, body...)
+	member = binary.LittleEndian.AppendUint32(member, crc32.ChecksumIEEE(data))
+	member = binary.LittleEndian.AppendUint64(member, uint64(len(data)))
+	return binary.LittleEndian.AppendUint64(member, uint64(len(member)+8))
+}
+
+func TestLzipReader(t *testing.T) {
+	first := bytes.Repeat([]byte("hello lzip "), 1000)
+	second := []byte("second member")
+	data := append(lzipMember(t, first), lzipMember(t, second)...)
+
+	r, err := newLzipReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("newLzipReader failed: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decompress: %v", err)
+	}
+	if want := append(first, second...); !bytes.Equal(got, want) {
+		t.Errorf("Expected %d bytes of both members, got %d bytes", len(want), len(got))
+	}
+}
+
+func TestLzipReader_Corrupt(t *testing.T) {
+	if _, err := newLzipReader(strings.NewReader("not an lzip file")); err == nil {
+		t.Error("Expected an error for data without an lzip header")
+	}
+
+	data := lzipMember(t, []byte("some data"))
+	data[len(data)-20] ^= 0xff
+	r, err := newLzipReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("newLzipReader failed: %v", err)
+	}
+	if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "CRC mismatch") {
+		t.Errorf("Expected a CRC mismatch, got %v", err)
+	}
+}
+
+func TestExtractTar_Lzip(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := "all:\n"
+	if err := tw.WriteHeader(&tar.Header{Name: "foo-1.0/Makefile", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	data := lzipMember(t, archive.Bytes())
+	if err := extractTar(bytes.NewReader(data), "foo-1.0.tar.lz", dir, 1); err != nil {
+		t.Fatalf("extractTar failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "Makefile"))
+	if err != nil || string(got) != content {
+		t.Errorf("Expected Makefile to be extracted, got %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,58 @@
+package download
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+const progressInterval = time.Second
+
+// progressWriter counts the bytes written through it and periodically logs
+// the progress of a download.
+type progressWriter struct {
+	name    string
+	total   int64
+	written int64
+	start   time.Time
+	last    time.Time
+}
+
+func newProgressWriter(name string, total int64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{name: name, total: total, start: now, last: now}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.report(now)
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) report(now time.Time) {
+	speed := FormatBytes(int64(float64(p.written) / now.Sub(p.start).Seconds()))
+	if p.total > 0 {
+		logger.Info("  %s: %d%% (%s / %s, %s/s)", p.name, p.written*100/p.total,
+			FormatBytes(p.written), FormatBytes(p.total), speed)
+	} else {
+		logger.Info("  %s: %s (%s/s)", p.name, FormatBytes(p.written), speed)
+	}
+}
+
+// FormatBytes formats n bytes with binary units, such as "1.5 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// maxBufferedFileSize is the size above which extracted files are written
+// directly from the archive instead of being buffered and written in the
+// background, bounding the memory held by pending writes.
+const maxBufferedFileSize = 32 << 20
+
+// fileWriter writes the regular files of an archive on a bounded number of
+// goroutines while the archive itself is read sequentially. Directories and
+// links are still created by the reading goroutine, so parent directories
+// always exist before their files are written.
+type fileWriter struct {
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+	pending map[string]bool
+}
+
+func newFileWriter() *fileWriter {
+	return &fileWriter{
+		sem:     make(chan struct{}, runtime.NumCPU()),
+		pending: make(map[string]bool),
+	}
+}
+
+// write creates target with the given mode and size bytes of content read
+// from r. Small files are read into memory and written in the background;
+// the error of a background write is returned by a later call or by wait.
+func (w *fileWriter) write(target string, mode os.FileMode, size int64, r io.Reader) error {
+	if err := w.firstErr(); err != nil {
+		return err
+	}
+	// Later entries for the same path replace earlier ones, so they must
+	// not race with them.
+	if w.pending[target] {
+		if err := w.wait(); err != nil {
+			return err
+		}
+	}
+
+	if size > maxBufferedFileSize {
+		return writeFile(target, mode, r)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	w.pending[target] = true
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		if err := writeFile(target, mode, bytes.NewReader(data)); err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait waits for the pending writes and returns the first error of any of
+// them. The writer can be used again afterwards.
+func (w *fileWriter) wait() error {
+	w.wg.Wait()
+	clear(w.pending)
+	return w.firstErr()
+}
+
+func (w *fileWriter) firstErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// writeFile creates target with the given mode and copies r into it.
+func writeFile(target string, mode os.FileMode, r io.Reader) error {
+	outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := io.Copy(outFile, r); err != nil {
+		outFile.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return outFile.Close()
+}
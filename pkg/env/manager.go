@@ -4,14 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/aar10n/makepkg/pkg/logger"
 )
 
-var reSubst = regexp.MustCompile(`\$\{([^}]+)}`)
-
 type Env interface {
 	Get(key string) (string, bool)
 	Set(key, value string)
@@ -19,7 +17,7 @@ type Env interface {
 	Subst(s string) string
 	SubstWarnUndefined(s string) (string, []string)
 	AddToEnv(other Env)
-	EnvironmentForPackage(pkgName string, pkgEnv []string, sysroot string, makeJobs int) Env
+	EnvironmentForPackage(pkgName, pkgVersion string, globalEnv, pkgEnv []string, sysroot string, makeJobs int) Env
 	ToSlice() []string
 	Clone() Env
 }
@@ -40,6 +38,16 @@ func NewManager() *Manager {
 	return env
 }
 
+// Inherit copies the named variables from the host environment, skipping any
+// that are unset.
+func (e *Manager) Inherit(keys ...string) {
+	for _, key := range keys {
+		if value, ok := os.LookupEnv(key); ok {
+			e.baseEnv[key] = value
+		}
+	}
+}
+
 func (e *Manager) Set(key, value string) {
 	//value = e.Subst(value)
 	logger.Debug("Setting %s=%s", key, value)
@@ -61,24 +69,13 @@ func (e *Manager) PrependToVar(key, value, sep string) {
 }
 
 func (e *Manager) Subst(s string) string {
-	return reSubst.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[2 : len(match)-1]
-		if val, ok := e.baseEnv[varName]; ok {
-			return val
-		}
-		return match
-	})
+	return substitute(s, e.Get, nil)
 }
 
 func (e *Manager) SubstWarnUndefined(s string) (string, []string) {
 	undefined := make([]string, 0)
-	result := reSubst.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[2 : len(match)-1]
-		if val, ok := e.baseEnv[varName]; ok {
-			return val
-		}
-		undefined = append(undefined, varName)
-		return match
+	result := substitute(s, e.Get, func(name string) {
+		undefined = append(undefined, name)
 	})
 	return result, undefined
 }
@@ -93,9 +90,14 @@ func (m *Manager) AddToEnv(other Env) {
 }
 
 // EnvironmentForPackage prepares environment variables for building and installing a package.
-func (e *Manager) EnvironmentForPackage(pkgName string, pkgEnv []string, sysroot string, makeJobs int) Env {
+// The global env entries are applied before the package's own, which take precedence.
+// PKG_VERSION is only set if pkgVersion is non-empty.
+func (e *Manager) EnvironmentForPackage(pkgName, pkgVersion string, globalEnv, pkgEnv []string, sysroot string, makeJobs int) Env {
 	env := e.Clone()
 	env.Set("PKG_NAME", pkgName)
+	if pkgVersion != "" {
+		env.Set("PKG_VERSION", pkgVersion)
+	}
 
 	if makeJobs > 0 {
 		env.Set("MAKEFLAGS", fmt.Sprintf("-j%d", makeJobs))
@@ -121,7 +123,7 @@ func (e *Manager) EnvironmentForPackage(pkgName string, pkgEnv []string, sysroot
 		env.PrependToVar("LD_LIBRARY_PATH", filepath.Join(sysroot, "lib"), ":")
 	}
 
-	for _, envVar := range pkgEnv {
+	for _, envVar := range slices.Concat(globalEnv, pkgEnv) {
 		parts := strings.SplitN(envVar, "=", 2)
 		if len(parts) == 2 {
 			key := parts[0]
@@ -134,6 +136,19 @@ func (e *Manager) EnvironmentForPackage(pkgName string, pkgEnv []string, sysroot
 	return env
 }
 
+// UseCCache wraps the C and C++ compilers in env with ccache, storing the
+// cache in dir. The host's cc and c++ are wrapped when no compiler is set.
+func UseCCache(env Env, dir string) {
+	for _, compiler := range []struct{ key, fallback string }{{"CC", "cc"}, {"CXX", "c++"}} {
+		value, ok := env.Get(compiler.key)
+		if !ok || value == "" {
+			value = compiler.fallback
+		}
+		env.Set(compiler.key, "ccache "+value)
+	}
+	env.Set("CCACHE_DIR", dir)
+}
+
 func (e *Manager) ToSlice() []string {
 	result := make([]string, 0, len(e.baseEnv))
 	for k, v := range e.baseEnv {
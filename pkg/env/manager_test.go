@@ -0,0 +1,36 @@
+package env
+
+import "testing"
+
+func TestEnvironmentForPackage_GlobalEnv(t *testing.T) {
+	m := newTestManager(map[string]string{"PREFIX": "/usr"})
+
+	env := m.EnvironmentForPackage("foo", "",
+		[]string{"CFLAGS=-O2", "DEST=${PREFIX}/${PKG_NAME}"},
+		[]string{"CFLAGS=-O0 -g"},
+		"", 0)
+
+	if got, _ := env.Get("CFLAGS"); got != "-O0 -g" {
+		t.Errorf("Package env should override global env, got CFLAGS=%q", got)
+	}
+	if got, _ := env.Get("DEST"); got != "/usr/foo" {
+		t.Errorf("Global env should be substituted, got DEST=%q", got)
+	}
+}
+
+func TestUseCCache(t *testing.T) {
+	env := NewManager()
+	env.Set("CC", "/opt/cross/bin/x86_64-linux-musl-gcc")
+	UseCCache(env, "/build/.ccache")
+
+	expected := map[string]string{
+		"CC":         "ccache /opt/cross/bin/x86_64-linux-musl-gcc",
+		"CXX":        "ccache c++",
+		"CCACHE_DIR": "/build/.ccache",
+	}
+	for key, value := range expected {
+		if got, _ := env.Get(key); got != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, got)
+		}
+	}
+}
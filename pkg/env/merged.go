@@ -1,6 +1,7 @@
 package env
 
 import (
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -48,35 +49,24 @@ func (m *mergedEnv) AddToEnv(other Env) {
 }
 
 func (m *mergedEnv) Subst(s string) string {
-	return reSubst.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[2 : len(match)-1]
-		if val, ok := m.Get(varName); ok {
-			return val
-		}
-		return match
-	})
+	return substitute(s, m.Get, nil)
 }
 
 func (m *mergedEnv) SubstWarnUndefined(s string) (string, []string) {
 	undefined := make([]string, 0)
-	result := reSubst.ReplaceAllStringFunc(s, func(match string) string {
-		varName := match[2 : len(match)-1]
-		if val, ok := m.Get(varName); ok {
-			return val
-		}
-		undefined = append(undefined, varName)
-		return match
+	result := substitute(s, m.Get, func(name string) {
+		undefined = append(undefined, name)
 	})
 	return result, undefined
 }
 
-func (m *mergedEnv) EnvironmentForPackage(pkgName string, pkgEnv []string, sysroot string, makeJobs int) Env {
+func (m *mergedEnv) EnvironmentForPackage(pkgName, pkgVersion string, globalEnv, pkgEnv []string, sysroot string, makeJobs int) Env {
 	newEnv := NewManager()
 	for i := len(m.envs) - 1; i >= 0; i-- {
 		m.envs[i].AddToEnv(newEnv)
 	}
 
-	for _, kv := range pkgEnv {
+	for _, kv := range slices.Concat(globalEnv, pkgEnv) {
 		parts := strings.SplitN(kv, "=", 2)
 		if len(parts) == 2 {
 			newEnv.Set(parts[0], parts[1])
@@ -84,6 +74,9 @@ func (m *mergedEnv) EnvironmentForPackage(pkgName string, pkgEnv []string, sysro
 	}
 
 	newEnv.Set("PKG_NAME", pkgName)
+	if pkgVersion != "" {
+		newEnv.Set("PKG_VERSION", pkgVersion)
+	}
 	if sysroot != "" {
 		newEnv.Set("SYSROOT", sysroot)
 	}
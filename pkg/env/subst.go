@@ -0,0 +1,149 @@
+package env
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+// maxSubstDepth limits how deeply variable values are expanded.
+const maxSubstDepth = 32
+
+// warned records the warnings already logged, since the same variables are
+// substituted into many fields of many packages.
+var warned sync.Map
+
+// warnOnce logs a warning unless one with the same key was logged before.
+func warnOnce(key, format string, args ...any) {
+	if _, loaded := warned.LoadOrStore(key, true); !loaded {
+		logger.Warn(format, args...)
+	}
+}
+
+// substitute expands variable references in s using lookup. It supports
+// ${VAR}, ${VAR:-default} (default if VAR is empty) and ${VAR:+alt} (alt if
+// VAR is non-empty). Defaults and alternates may themselves contain
+// references, and variable values are expanded recursively. References to
+// undefined variables are left untouched, so that scripts can still resolve
+// them at run time, and bare ones are reported through undefined, if non-nil.
+func substitute(s string, lookup func(string) (string, bool), undefined func(string)) string {
+	sub := &substituter{lookup: lookup, undefined: undefined}
+	return sub.expand(s)
+}
+
+// SubstHost expands variable references in s against the host environment,
+// treating unset variables as empty.
+func SubstHost(s string) string {
+	return substitute(s, func(name string) (string, bool) {
+		return os.Getenv(name), true
+	}, nil)
+}
+
+type substituter struct {
+	lookup    func(string) (string, bool)
+	undefined func(string)
+	expanding []string
+}
+
+func (sub *substituter) expand(s string) string {
+	var out strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+		end := matchBrace(s, start+2)
+		if end < 0 {
+			out.WriteString(s)
+			return out.String()
+		}
+
+		out.WriteString(s[:start])
+		out.WriteString(sub.expandRef(s[start:end+1], s[start+2:end]))
+		s = s[end+1:]
+	}
+}
+
+// matchBrace returns the index of the '}' closing a reference whose body
+// starts at i, accounting for nested references, or -1 if there is none.
+func matchBrace(s string, i int) int {
+	depth := 1
+	for i < len(s) {
+		switch {
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i += 2
+			continue
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+		i++
+	}
+	return -1
+}
+
+func (sub *substituter) expandRef(ref, body string) string {
+	name, op, word := body, "", ""
+	if i := strings.Index(body, ":"); i >= 0 && i+1 < len(body) && (body[i+1] == '-' || body[i+1] == '+') {
+		name, op, word = body[:i], body[i:i+2], body[i+2:]
+	}
+
+	val, ok := sub.lookup(name)
+	if !ok && op != "" {
+		return ref
+	}
+	switch op {
+	case ":-":
+		if val != "" {
+			return sub.expandValue(ref, name, val)
+		}
+		return sub.expand(word)
+	case ":+":
+		if val != "" {
+			return sub.expand(word)
+		}
+		return ""
+	}
+
+	if ok {
+		return sub.expandValue(ref, name, val)
+	}
+	if sub.undefined != nil {
+		sub.undefined(name)
+	}
+	return ref
+}
+
+// expandValue expands references in the value of name. A reference that is
+// part of a cycle is left unresolved.
+func (sub *substituter) expandValue(ref, name, val string) string {
+	if !strings.Contains(val, "${") {
+		return val
+	}
+
+	for i, n := range sub.expanding {
+		if n == name {
+			// A cycle is reported once, whichever of its variables it is
+			// entered through.
+			members := slices.Sorted(slices.Values(sub.expanding[i:]))
+			cycle := append(append([]string{}, sub.expanding[i:]...), name)
+			warnOnce("cycle:"+strings.Join(members, ","), "Variable reference cycle: %s", strings.Join(cycle, " -> "))
+			return ref
+		}
+	}
+	if len(sub.expanding) >= maxSubstDepth {
+		warnOnce("depth:"+name, "Variable %s exceeds maximum expansion depth of %d", name, maxSubstDepth)
+		return val
+	}
+
+	sub.expanding = append(sub.expanding, name)
+	defer func() { sub.expanding = sub.expanding[:len(sub.expanding)-1] }()
+	return sub.expand(val)
+}
@@ -0,0 +1,132 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aar10n/makepkg/pkg/logger"
+)
+
+func newTestManager(vars map[string]string) *Manager {
+	m := &Manager{baseEnv: make(map[string]string)}
+	for k, v := range vars {
+		m.Set(k, v)
+	}
+	return m
+}
+
+func TestSubst_Bare(t *testing.T) {
+	m := newTestManager(map[string]string{"FOO": "foo"})
+
+	if got := m.Subst("a/${FOO}/b"); got != "a/foo/b" {
+		t.Errorf("Expected 'a/foo/b', got %q", got)
+	}
+	if got := m.Subst("${UNSET}/b"); got != "${UNSET}/b" {
+		t.Errorf("Undefined variable should be left untouched, got %q", got)
+	}
+}
+
+func TestSubst_Default(t *testing.T) {
+	m := newTestManager(map[string]string{"SET": "value", "EMPTY": ""})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"${SET:-default}", "value"},
+		{"${EMPTY:-default}", "default"},
+		{"${EMPTY:-}", ""},
+		{"${EMPTY:-${SET}}", "value"},
+		{"${EMPTY:-${UNSET:-inner}}/x", "${UNSET:-inner}/x"},
+		{"${UNSET:-default}", "${UNSET:-default}"},
+		{"${UNSET:-${SET}}", "${UNSET:-${SET}}"},
+	}
+
+	for _, tt := range tests {
+		if got := m.Subst(tt.input); got != tt.expected {
+			t.Errorf("Subst(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestSubst_Alternate(t *testing.T) {
+	m := newTestManager(map[string]string{"SET": "value", "EMPTY": ""})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"${SET:+alt}", "alt"},
+		{"${EMPTY:+alt}", ""},
+		{"${UNSET:+alt}", "${UNSET:+alt}"},
+		{"-I${SET:+${SET}/include}", "-Ivalue/include"},
+	}
+
+	for _, tt := range tests {
+		if got := m.Subst(tt.input); got != tt.expected {
+			t.Errorf("Subst(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestSubstWarnUndefined(t *testing.T) {
+	m := newTestManager(map[string]string{"SET": "value"})
+
+	result, undefined := m.SubstWarnUndefined("${SET} ${MISSING} ${OTHER:-x} ${UNCLOSED")
+	if result != "value ${MISSING} ${OTHER:-x} ${UNCLOSED" {
+		t.Errorf("Unexpected result: %q", result)
+	}
+	if len(undefined) != 1 || undefined[0] != "MISSING" {
+		t.Errorf("Expected [MISSING] to be undefined, got %v", undefined)
+	}
+}
+
+func TestSubst_Recursive(t *testing.T) {
+	m := newTestManager(map[string]string{
+		"FOO":    "${BAR}",
+		"BAR":    "${BAZ}/bin",
+		"BAZ":    "/opt",
+		"PREFIX": "${FOO:-/usr}",
+	})
+
+	if got := m.Subst("${FOO}"); got != "/opt/bin" {
+		t.Errorf("Expected '/opt/bin', got %q", got)
+	}
+	if got := m.Subst("${PREFIX}"); got != "/opt/bin" {
+		t.Errorf("Expected '/opt/bin', got %q", got)
+	}
+}
+
+func TestSubst_Cycle(t *testing.T) {
+	m := newTestManager(map[string]string{
+		"A":    "${B}",
+		"B":    "${A}",
+		"SELF": "x${SELF}",
+	})
+
+	if got := m.Subst("${A}"); got != "${A}" {
+		t.Errorf("Expected cycle to leave '${A}' unresolved, got %q", got)
+	}
+	if got := m.Subst("${SELF}"); got != "x${SELF}" {
+		t.Errorf("Expected self-reference to be left unresolved, got %q", got)
+	}
+}
+
+func TestSubst_CycleWarnsOnce(t *testing.T) {
+	var output strings.Builder
+	logger.SetErrorOutput(&output)
+	defer logger.SetErrorOutput(os.Stderr)
+
+	m := newTestManager(map[string]string{
+		"C": "${D}",
+		"D": "${C}",
+	})
+	m.Subst("${C}")
+	m.Subst("${D}/bin")
+	m.Clone().Subst("--prefix=${C}")
+
+	if n := strings.Count(output.String(), "Variable reference cycle"); n != 1 {
+		t.Errorf("Expected the cycle to be reported once, got %d warnings: %q", n, output.String())
+	}
+}
@@ -1,10 +1,47 @@
 package logger
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/aar10n/makepkg/pkg/term"
+)
+
+// Format selects how log messages are written to the console.
+type Format string
+
+const (
+	// FormatText writes messages as plain text lines.
+	FormatText Format = "text"
+	// FormatJSON writes each message as a JSON object on its own line.
+	FormatJSON Format = "json"
+)
+
+// ColorMode selects when console output is colored.
+type ColorMode string
+
+const (
+	// ColorAuto colors output written to a terminal unless NO_COLOR is set.
+	ColorAuto ColorMode = "auto"
+	// ColorAlways always colors output.
+	ColorAlways ColorMode = "always"
+	// ColorNever never colors output.
+	ColorNever ColorMode = "never"
+)
+
+// Color is an ANSI foreground color.
+type Color string
+
+const (
+	ColorNone   Color = ""
+	ColorRed    Color = "31"
+	ColorGreen  Color = "32"
+	ColorYellow Color = "33"
 )
 
 var (
@@ -22,6 +59,9 @@ type Logger struct {
 	info    *log.Logger
 	warning *log.Logger
 	err     *log.Logger
+	file    *log.Logger
+	format  Format
+	color   ColorMode
 	verbose bool
 	prefix  string
 	mu      sync.RWMutex
@@ -34,6 +74,8 @@ func NewLogger(verbose bool) *Logger {
 		info:    log.New(os.Stdout, "", 0),
 		warning: log.New(os.Stderr, "", 0),
 		err:     log.New(os.Stderr, "", 0),
+		format:  FormatText,
+		color:   ColorNever,
 		verbose: verbose,
 		prefix:  "",
 	}
@@ -53,6 +95,13 @@ func (l *Logger) SetPrefix(prefix string) {
 	l.prefix = prefix
 }
 
+// Prefix returns the prefix of all log messages.
+func (l *Logger) Prefix() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.prefix
+}
+
 // Clone creates a copy of the logger that can be independently configured.
 func (l *Logger) Clone() *Logger {
 	l.mu.RLock()
@@ -63,6 +112,9 @@ func (l *Logger) Clone() *Logger {
 		info:    log.New(l.info.Writer(), l.info.Prefix(), l.info.Flags()),
 		warning: log.New(l.warning.Writer(), l.warning.Prefix(), l.warning.Flags()),
 		err:     log.New(l.err.Writer(), l.err.Prefix(), l.err.Flags()),
+		file:    l.file,
+		format:  l.format,
+		color:   l.color,
 		verbose: l.verbose,
 		prefix:  l.prefix,
 	}
@@ -94,39 +146,135 @@ func (l *Logger) SetErrorOutput(w io.Writer) {
 	l.err.SetOutput(w)
 }
 
+// SetFormat sets the format of console output. The log file, if any, is
+// always written as text.
+func (l *Logger) SetFormat(format Format) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format = format
+}
+
+// Format returns the format of console output.
+func (l *Logger) Format() Format {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.format
+}
+
+// SetColorMode sets when console output is colored. Loggers start out with
+// ColorNever. The log file, if any, is never colored.
+func (l *Logger) SetColorMode(mode ColorMode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.color = mode
+}
+
+// SetFileOutput tees all log levels to w, with each line timestamped.
+// Console output is unaffected. Passing nil stops the tee.
+func (l *Logger) SetFileOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w == nil {
+		l.file = nil
+		return
+	}
+	l.file = log.New(w, "", log.LstdFlags|log.Lmicroseconds)
+}
+
+// SetLogFile opens path for appending and tees all log levels to it, with
+// each line timestamped.
+func (l *Logger) SetLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.SetFileOutput(file)
+	return nil
+}
+
+// jsonEntry is a log message in FormatJSON.
+type jsonEntry struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Prefix string `json:"prefix,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+// useColor reports whether output to console should be colored under mode.
+func useColor(mode ColorMode, console *log.Logger) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorAuto:
+		if os.Getenv("NO_COLOR") != "" {
+			return false
+		}
+		f, ok := console.Writer().(*os.File)
+		return ok && term.IsTerminal(f)
+	default:
+		return false
+	}
+}
+
+// output formats a message and writes it to the console logger and to the
+// log file, if any. In text format the message is preceded by tag and the
+// logger's prefix, and the console line is shown in color if enabled.
+func (l *Logger) output(level string, console *log.Logger, color Color, tag, format string, args ...interface{}) {
+	l.mu.RLock()
+	prefix := l.prefix
+	file := l.file
+	logFormat := l.format
+	colorMode := l.color
+	l.mu.RUnlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if logFormat == FormatJSON {
+		data, _ := json.Marshal(jsonEntry{
+			Time:   time.Now().Format(time.RFC3339Nano),
+			Level:  level,
+			Prefix: prefix,
+			Msg:    msg,
+		})
+		console.Print(string(data))
+	} else if color != ColorNone && useColor(colorMode, console) {
+		console.Print("\x1b[" + string(color) + "m" + tag + prefix + msg + "\x1b[0m")
+	} else {
+		console.Print(tag + prefix + msg)
+	}
+	if file != nil {
+		file.Print(tag + prefix + msg)
+	}
+}
+
 // Debug logs a debug message (only if verbose is enabled).
 func (l *Logger) Debug(format string, args ...interface{}) {
 	l.mu.RLock()
 	verbose := l.verbose
-	prefix := l.prefix
 	l.mu.RUnlock()
 	if verbose {
-		l.debug.Printf("[DEBUG] "+prefix+format, args...)
+		l.output("debug", l.debug, ColorNone, "[DEBUG] ", format, args...)
 	}
 }
 
 // Info logs an informational message.
 func (l *Logger) Info(format string, args ...interface{}) {
-	l.mu.RLock()
-	prefix := l.prefix
-	l.mu.RUnlock()
-	l.info.Printf(prefix+format, args...)
+	l.output("info", l.info, ColorNone, "", format, args...)
+}
+
+// InfoColor logs an informational message shown in color when console
+// output is colored.
+func (l *Logger) InfoColor(color Color, format string, args ...interface{}) {
+	l.output("info", l.info, color, "", format, args...)
 }
 
 // Warn logs a warning message.
 func (l *Logger) Warn(format string, args ...interface{}) {
-	l.mu.RLock()
-	prefix := l.prefix
-	l.mu.RUnlock()
-	l.warning.Printf("Warning: "+prefix+format, args...)
+	l.output("warn", l.warning, ColorYellow, "Warning: ", format, args...)
 }
 
 // Error logs an error message.
 func (l *Logger) Error(format string, args ...interface{}) {
-	l.mu.RLock()
-	prefix := l.prefix
-	l.mu.RUnlock()
-	l.err.Printf("Error: "+prefix+format, args...)
+	l.output("error", l.err, ColorRed, "Error: ", format, args...)
 }
 
 // Default returns the default logger instance.
@@ -163,6 +311,21 @@ func SetErrorOutput(w io.Writer) {
 	Default().SetErrorOutput(w)
 }
 
+// SetFormat sets the console output format of the default logger.
+func SetFormat(format Format) {
+	Default().SetFormat(format)
+}
+
+// SetColorMode sets when console output of the default logger is colored.
+func SetColorMode(mode ColorMode) {
+	Default().SetColorMode(mode)
+}
+
+// SetLogFile tees all log levels of the default logger to the file at path.
+func SetLogFile(path string) error {
+	return Default().SetLogFile(path)
+}
+
 // Debug logs a debug message using the default logger.
 func Debug(format string, args ...interface{}) {
 	Default().Debug(format, args...)
@@ -2,8 +2,11 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogger_BasicFunctionality(t *testing.T) {
@@ -154,3 +157,91 @@ func TestConcurrency(t *testing.T) {
 		t.Error("Expected concurrent logging to work")
 	}
 }
+
+func TestLogger_FileOutput(t *testing.T) {
+	var console, file bytes.Buffer
+	l := NewLogger(false)
+	l.SetOutput(&console)
+	l.SetFileOutput(&file)
+
+	l.Info("file message")
+	l.Warn("file warning")
+	if console.String() != "file message\nWarning: file warning\n" {
+		t.Errorf("Console output should not be timestamped, got: %q", console.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(file.String()), "\n")
+	timestamp := regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6} `)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "file message") || !strings.HasSuffix(lines[1], "Warning: file warning") {
+		t.Fatalf("Expected both messages in the log file, got: %q", file.String())
+	}
+	for _, line := range lines {
+		if !timestamp.MatchString(line) {
+			t.Errorf("Expected a timestamped line, got: %q", line)
+		}
+	}
+
+	clone := l.Clone()
+	clone.SetPrefix("[DRY RUN] ")
+	clone.Info("cloned message")
+	if !strings.Contains(file.String(), "[DRY RUN] cloned message") {
+		t.Errorf("Cloned logger should write to the same log file, got: %q", file.String())
+	}
+}
+
+func TestLogger_JSONFormat(t *testing.T) {
+	var console, file bytes.Buffer
+	l := NewLogger(true)
+	l.SetOutput(&console)
+	l.SetFileOutput(&file)
+	l.SetFormat(FormatJSON)
+
+	clone := l.Clone()
+	clone.SetPrefix("[DRY RUN] ")
+	clone.Warn("disk %d%% full", 90)
+	l.Debug("debug message")
+
+	lines := strings.Split(strings.TrimSpace(console.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, got: %q", console.String())
+	}
+
+	var entries [2]map[string]string
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entries[i]); err != nil {
+			t.Fatalf("Line %q is not a JSON object: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entries[i]["time"]); err != nil {
+			t.Errorf("Expected an RFC 3339 time, got %q", entries[i]["time"])
+		}
+	}
+	if entries[0]["level"] != "warn" || entries[0]["msg"] != "disk 90% full" || entries[0]["prefix"] != "[DRY RUN] " {
+		t.Errorf("Unexpected warning entry: %v", entries[0])
+	}
+	if _, ok := entries[1]["prefix"]; ok || entries[1]["level"] != "debug" || entries[1]["msg"] != "debug message" {
+		t.Errorf("Unexpected debug entry: %v", entries[1])
+	}
+
+	if !strings.Contains(file.String(), "Warning: [DRY RUN] disk 90% full") {
+		t.Errorf("Log file should stay in text format, got: %q", file.String())
+	}
+}
+
+func TestLogger_Color(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(false)
+	l.SetOutput(&buf)
+
+	l.Warn("plain")
+	l.SetColorMode(ColorAuto)
+	l.Warn("not a terminal")
+	l.SetColorMode(ColorAlways)
+	l.Warn("colored")
+	l.Info("info")
+	l.InfoColor(ColorGreen, "success")
+
+	expected := "Warning: plain\nWarning: not a terminal\n\x1b[33mWarning: colored\x1b[0m\ninfo\n\x1b[32msuccess\x1b[0m\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,45 @@
+package term
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+func getWinsize(fd uintptr) (*winsize, bool) {
+	ws := &winsize{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(ws)))
+	if errno != 0 {
+		return nil, false
+	}
+	return ws, true
+}
+
+// IsTerminal reports whether the file is connected to a terminal.
+func IsTerminal(f *os.File) bool {
+	_, ok := getWinsize(f.Fd())
+	return ok
+}
+
+// Width returns the column width of the terminal connected to f.
+// The COLUMNS environment variable takes precedence when set. Returns false
+// if the width cannot be determined.
+func Width(f *os.File) (int, bool) {
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols, true
+	}
+
+	ws, ok := getWinsize(f.Fd())
+	if !ok || ws.Col == 0 {
+		return 0, false
+	}
+	return int(ws.Col), true
+}